@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+// jwk is a JSON Web Key (RFC 7517) with the members of the key types we verify with.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+
+	N string `json:"n"` // RSA
+	E string `json:"e"`
+
+	Crv string `json:"crv"` // EC and OKP
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	K string `json:"k"` // oct
+}
+
+// LoadJWKS returns a Verifier for tokens signed with any key of a JWKS file. RSA, EC
+// (P-256, P-384 and P-521), Ed25519 and symmetric keys are supported, encryption keys
+// are skipped.
+func LoadJWKS(path string) (*Verifier, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parsing JWKS %s: %w", path, err)
+	}
+
+	v := &Verifier{}
+	for i, k := range set.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		parsed, err := k.parse()
+		if err != nil {
+			return nil, fmt.Errorf("key %d (%q) of JWKS %s: %w", i, k.Kid, path, err)
+		}
+		v.keys = append(v.keys, parsed)
+	}
+	if len(v.keys) == 0 {
+		return nil, fmt.Errorf("JWKS %s has no signing keys", path)
+	}
+	return v, nil
+}
+
+func (k jwk) parse() (key, error) {
+	parsed := key{id: k.Kid, alg: k.Alg}
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return key{}, fmt.Errorf("n: %w", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return key{}, fmt.Errorf("e: %w", err)
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return key{}, fmt.Errorf("exponent out of range")
+		}
+		parsed.public = &rsa.PublicKey{N: n, E: int(e.Int64())}
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return key{}, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return key{}, fmt.Errorf("x: %w", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return key{}, fmt.Errorf("y: %w", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return key{}, fmt.Errorf("point is not on %s", k.Crv)
+		}
+		parsed.public = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return key{}, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return key{}, fmt.Errorf("x is not an Ed25519 public key")
+		}
+		parsed.public = crypto.PublicKey(ed25519.PublicKey(x))
+
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil || len(secret) == 0 {
+			return key{}, fmt.Errorf("k is not a base64url secret")
+		}
+		parsed.secret = secret
+
+	default:
+		return key{}, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+	return parsed, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,201 @@
+// Package auth verifies the JWT access tokens peers present on the /sdp websocket. Tokens
+// are signed by whatever issues them to clients, monoport only holds the verification keys:
+// an HMAC secret, or the public keys of a JWKS file.
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // hashes of the supported algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// clockSkew is how far the clocks of the token issuer and monoport may drift apart.
+const clockSkew = 30 * time.Second
+
+var (
+	// ErrInvalidToken is returned for tokens that are malformed or not signed by a known key.
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrExpiredToken is returned for tokens past their expiry, or not valid yet.
+	ErrExpiredToken = errors.New("token expired or not valid yet")
+)
+
+// Grants are what a token allows its peer to do.
+type Grants struct {
+	CanPublish     bool `json:"canPublish"`
+	CanSubscribe   bool `json:"canSubscribe"`
+	CanPublishData bool `json:"canPublishData"`
+	IsAdmin        bool `json:"isAdmin"` // moderator of the room it joins
+}
+
+// Claims are the claims of an access token monoport reads.
+type Claims struct {
+	Identity  string `json:"sub"`            // the only peer ID the token can be used with
+	Room      string `json:"room,omitempty"` // the only room it can join, empty for any
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	Grants    Grants `json:"grants"`
+}
+
+// key is one verification key, secret for HMAC and public for every other algorithm.
+type key struct {
+	id     string // kid, empty matches every token
+	alg    string // algorithm the key is restricted to, empty for any that fits its type
+	secret []byte
+	public crypto.PublicKey
+}
+
+// Verifier checks the signature and validity of access tokens.
+type Verifier struct {
+	keys []key
+}
+
+// NewHMACVerifier returns a Verifier for tokens signed with an HMAC secret.
+func NewHMACVerifier(secret []byte) *Verifier {
+	return &Verifier{keys: []key{{secret: secret}}}
+}
+
+// NewVerifier returns a Verifier for an HMAC secret (HS256, HS384 or HS512) or a JWKS
+// file, nil when both are empty and authentication is off.
+func NewVerifier(secret, jwksFile string) (*Verifier, error) {
+	switch {
+	case secret != "" && jwksFile != "":
+		return nil, errors.New("only one of an HMAC secret and a JWKS file can be used")
+	case secret != "":
+		return NewHMACVerifier([]byte(secret)), nil
+	case jwksFile != "":
+		return LoadJWKS(jwksFile)
+	}
+	return nil, nil
+}
+
+// Verify checks a token's signature, expiry and not-before time and returns its claims.
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a JWS compact serialization", ErrInvalidToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidToken, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", ErrInvalidToken, err)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range v.keys {
+		if k.id != "" && header.Kid != "" && k.id != header.Kid {
+			continue
+		}
+		if k.alg != "" && k.alg != header.Alg {
+			continue
+		}
+		if verifySignature(header.Alg, k, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("%w: no key verifies its %q signature", ErrInvalidToken, header.Alg)
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrInvalidToken, err)
+	}
+	if claims.Identity == "" {
+		return nil, fmt.Errorf("%w: no sub claim", ErrInvalidToken)
+	}
+	if claims.ExpiresAt == 0 {
+		return nil, fmt.Errorf("%w: no exp claim", ErrInvalidToken)
+	}
+	now := time.Now()
+	if now.Add(-clockSkew).After(time.Unix(claims.ExpiresAt, 0)) || now.Add(clockSkew).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, ErrExpiredToken
+	}
+	return &claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifySignature checks signature with k, the algorithm has to fit the type of the key so
+// a public key can never be used as an HMAC secret.
+func verifySignature(alg string, k key, signed, signature []byte) bool {
+	hash, ok := algorithmHash(alg)
+	if !ok {
+		return false
+	}
+
+	if strings.HasPrefix(alg, "HS") {
+		if k.secret == nil {
+			return false
+		}
+		mac := hmac.New(hash.New, k.secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	}
+
+	if alg == "EdDSA" {
+		public, ok := k.public.(ed25519.PublicKey)
+		return ok && ed25519.Verify(public, signed, signature)
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch public := k.public.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") {
+			return rsa.VerifyPKCS1v15(public, hash, digest, signature) == nil
+		}
+		if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(public, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+	case *ecdsa.PublicKey:
+		// r and s are concatenated, each padded to the size of the curve
+		size := (public.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(public, digest, r, s)
+	}
+	return false
+}
+
+// algorithmHash returns the hash of a JWS algorithm, none is never accepted.
+func algorithmHash(alg string) (crypto.Hash, bool) {
+	switch alg {
+	case "HS256", "RS256", "PS256", "ES256":
+		return crypto.SHA256, true
+	case "HS384", "RS384", "PS384", "ES384":
+		return crypto.SHA384, true
+	case "HS512", "RS512", "PS512", "ES512", "EdDSA":
+		return crypto.SHA512, true
+	}
+	return 0, false
+}
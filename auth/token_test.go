@@ -0,0 +1,239 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// token builds a JWT, sign returns the signature of the signing input.
+func token(t *testing.T, header map[string]string, claims Claims, sign func(signed []byte) []byte) string {
+	t.Helper()
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func hs256(secret []byte) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+func rs256(t *testing.T, private *rsa.PrivateKey) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, private, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	}
+}
+
+// writeJWKS writes the public halves of RSA keys by kid into a JWKS file.
+func writeJWKS(t *testing.T, keys map[string]*rsa.PrivateKey) string {
+	t.Helper()
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	for kid, private := range keys {
+		set.Keys = append(set.Keys, map[string]string{
+			"kty": "RSA",
+			"kid": kid,
+			"n":   base64.RawURLEncoding.EncodeToString(private.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(private.E)).Bytes()),
+		})
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVerify(t *testing.T) {
+	keyA, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyB, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, err := LoadJWKS(writeJWKS(t, map[string]*rsa.PrivateKey{"a": keyA, "b": keyB}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("monoport-test-secret")
+	hmacVerifier := NewHMACVerifier(secret)
+
+	// the public key in the forms an attacker would try as an HMAC secret
+	publicDER, err := x509.MarshalPKIXPublicKey(&keyA.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+
+	now := time.Now()
+	valid := Claims{Identity: "alice", Room: "standup", ExpiresAt: now.Add(time.Hour).Unix(), Grants: Grants{CanPublish: true}}
+	with := func(change func(*Claims)) Claims {
+		claims := valid
+		change(&claims)
+		return claims
+	}
+
+	tests := []struct {
+		name     string
+		verifier *Verifier
+		token    string
+		wantErr  error
+	}{
+		{
+			name:     "HS256",
+			verifier: hmacVerifier,
+			token:    token(t, map[string]string{"alg": "HS256"}, valid, hs256(secret)),
+		},
+		{
+			name:     "HS256 with the wrong secret",
+			verifier: hmacVerifier,
+			token:    token(t, map[string]string{"alg": "HS256"}, valid, hs256([]byte("other"))),
+			wantErr:  ErrInvalidToken,
+		},
+		{
+			name:     "alg none",
+			verifier: hmacVerifier,
+			token:    token(t, map[string]string{"alg": "none"}, valid, func([]byte) []byte { return nil }),
+			wantErr:  ErrInvalidToken,
+		},
+		{
+			name:     "alg none against a JWKS",
+			verifier: jwks,
+			token:    token(t, map[string]string{"alg": "none", "kid": "a"}, valid, func([]byte) []byte { return nil }),
+			wantErr:  ErrInvalidToken,
+		},
+		{
+			name:     "RS256 signed by the key of its kid",
+			verifier: jwks,
+			token:    token(t, map[string]string{"alg": "RS256", "kid": "b"}, valid, rs256(t, keyB)),
+		},
+		{
+			name:     "RS256 without a kid tries every key",
+			verifier: jwks,
+			token:    token(t, map[string]string{"alg": "RS256"}, valid, rs256(t, keyB)),
+		},
+		{
+			name:     "RS256 signed by another key than its kid",
+			verifier: jwks,
+			token:    token(t, map[string]string{"alg": "RS256", "kid": "a"}, valid, rs256(t, keyB)),
+			wantErr:  ErrInvalidToken,
+		},
+		{
+			name:     "RS256 with an unknown kid",
+			verifier: jwks,
+			token:    token(t, map[string]string{"alg": "RS256", "kid": "c"}, valid, rs256(t, keyA)),
+			wantErr:  ErrInvalidToken,
+		},
+		{
+			name:     "HS256 keyed with the DER public key",
+			verifier: jwks,
+			token:    token(t, map[string]string{"alg": "HS256", "kid": "a"}, valid, hs256(publicDER)),
+			wantErr:  ErrInvalidToken,
+		},
+		{
+			name:     "HS256 keyed with the PEM public key",
+			verifier: jwks,
+			token:    token(t, map[string]string{"alg": "HS256", "kid": "a"}, valid, hs256(publicPEM)),
+			wantErr:  ErrInvalidToken,
+		},
+		{
+			name:     "RS256 against an HMAC secret",
+			verifier: hmacVerifier,
+			token:    token(t, map[string]string{"alg": "RS256"}, valid, rs256(t, keyA)),
+			wantErr:  ErrInvalidToken,
+		},
+		{
+			name:     "expired within the clock skew",
+			verifier: hmacVerifier,
+			token:    token(t, map[string]string{"alg": "HS256"}, with(func(c *Claims) { c.ExpiresAt = now.Add(-clockSkew / 2).Unix() }), hs256(secret)),
+		},
+		{
+			name:     "expired beyond the clock skew",
+			verifier: hmacVerifier,
+			token:    token(t, map[string]string{"alg": "HS256"}, with(func(c *Claims) { c.ExpiresAt = now.Add(-2 * clockSkew).Unix() }), hs256(secret)),
+			wantErr:  ErrExpiredToken,
+		},
+		{
+			name:     "not valid yet within the clock skew",
+			verifier: hmacVerifier,
+			token:    token(t, map[string]string{"alg": "HS256"}, with(func(c *Claims) { c.NotBefore = now.Add(clockSkew / 2).Unix() }), hs256(secret)),
+		},
+		{
+			name:     "not valid yet beyond the clock skew",
+			verifier: hmacVerifier,
+			token:    token(t, map[string]string{"alg": "HS256"}, with(func(c *Claims) { c.NotBefore = now.Add(2 * clockSkew).Unix() }), hs256(secret)),
+			wantErr:  ErrExpiredToken,
+		},
+		{
+			name:     "no exp",
+			verifier: hmacVerifier,
+			token:    token(t, map[string]string{"alg": "HS256"}, with(func(c *Claims) { c.ExpiresAt = 0 }), hs256(secret)),
+			wantErr:  ErrInvalidToken,
+		},
+		{
+			name:     "no sub",
+			verifier: hmacVerifier,
+			token:    token(t, map[string]string{"alg": "HS256"}, with(func(c *Claims) { c.Identity = "" }), hs256(secret)),
+			wantErr:  ErrInvalidToken,
+		},
+		{
+			name:     "not a JWT",
+			verifier: hmacVerifier,
+			token:    "abc.def",
+			wantErr:  ErrInvalidToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := tt.verifier.Verify(tt.token)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if claims.Identity != "alice" || claims.Room != "standup" || !claims.Grants.CanPublish {
+				t.Errorf("got claims %+v", claims)
+			}
+		})
+	}
+}
@@ -0,0 +1,660 @@
+// Package config loads monoport's configuration. Every setting has a default, can be set in
+// a YAML file, and is overridden by its environment variable and then by its command line
+// flag. Invalid settings are all reported at once by Load, before anything starts.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/stun"
+	"github.com/pion/webrtc/v3"
+	sfu_server "github.com/samyak112/monoport/sfu"
+	"gopkg.in/yaml.v3"
+)
+
+// FileEnv holds the path of the YAML configuration file, the -config flag overrides it.
+const FileEnv = "MONOPORT_CONFIG"
+
+// Config is the whole configuration of a monoport server.
+type Config struct {
+	HTTP         HTTPConfig         `yaml:"http"`
+	UDP          UDPConfig          `yaml:"udp"`
+	ICE          ICEConfig          `yaml:"ice"`
+	Channels     ChannelConfig      `yaml:"channels"`
+	Codecs       []string           `yaml:"codecs"` // negotiated codecs, empty for every one in Codecs
+	Log          LogConfig          `yaml:"log"`
+	Auth         AuthConfig         `yaml:"auth"`
+	Recording    RecordingConfig    `yaml:"recording"`
+	RTPIngest    RTPIngestConfig    `yaml:"rtpIngest"`
+	Interceptors InterceptorsConfig `yaml:"interceptors"`
+}
+
+// HTTPConfig configures the HTTP server: signaling, WHIP, WHEP, HLS and the APIs.
+type HTTPConfig struct {
+	Listen string `yaml:"listen"`
+	// AllowedOrigins are the origins browsers may open /sdp websockets from besides the
+	// server's own, "*" allows every origin
+	AllowedOrigins []string `yaml:"allowedOrigins"`
+}
+
+// UDPConfig configures the UDP port STUN and all WebRTC media share. With both udp4 and
+// udp6 network types and a wildcard host it is one dual-stack socket.
+type UDPConfig struct {
+	Listen string `yaml:"listen"`
+}
+
+// ICEConfig configures the ICE candidates of the server and the ICE servers clients use.
+type ICEConfig struct {
+	// AnnouncedIPs replace the addresses of the host candidates, the public IPs of a
+	// server behind 1:1 NAT such as a cloud VM. Each address family takes either one IP
+	// for all its host candidates or public/local pairs. Empty discovers it, see PublicIP.
+	AnnouncedIPs []string       `yaml:"announcedIPs"`
+	PublicIP     PublicIPConfig `yaml:"publicIP"`
+	// Servers are the STUN and TURN servers handed to clients and used by the server's own
+	// PeerConnections. Empty with announced IPs points at monoport's own STUN server.
+	Servers      []ICEServer `yaml:"servers"`
+	NetworkTypes []string    `yaml:"networkTypes"` // udp4, udp6, tcp4 and tcp6
+	// TCPListen is the address of the ICE-TCP port when tcp4 or tcp6 is among the network
+	// types. Empty shares the HTTP port, connections are told apart by their first bytes.
+	TCPListen string `yaml:"tcpListen"`
+}
+
+// PublicIPConfig configures the discovery of the public IP announced when AnnouncedIPs is
+// empty. Sources are tried in order: the host's interfaces, cloud metadata endpoints,
+// STUN servers.
+type PublicIPConfig struct {
+	Discover      bool `yaml:"discover"`
+	CloudMetadata bool `yaml:"cloudMetadata"` // ask the metadata endpoints of GCP, AWS and Azure
+	// STUNServers are asked for our address after the stun: URLs of Servers
+	STUNServers []string `yaml:"stunServers"`
+	// Interval between re-checks of the discovered address, 0 checks only at startup
+	Interval time.Duration `yaml:"interval"`
+}
+
+// ICEServer is a STUN or TURN server, TURN servers need a username and credential.
+type ICEServer struct {
+	URLs       []string `yaml:"urls"`
+	Username   string   `yaml:"username"`
+	Credential string   `yaml:"credential"`
+}
+
+// ChannelConfig sizes the queues between the network and the SFU.
+type ChannelConfig struct {
+	Packets   int `yaml:"packets"`   // STUN packets read from the UDP port
+	Signaling int `yaml:"signaling"` // messages from the SFU to websockets
+}
+
+// InterceptorsConfig selects the built-in interceptors every PeerConnection is built with.
+type InterceptorsConfig struct {
+	NACK                bool                      `yaml:"nack"`    // ask publishers to retransmit lost packets
+	Reports             bool                      `yaml:"reports"` // RTCP sender and receiver reports
+	TWCC                bool                      `yaml:"twcc"`    // transport wide congestion control feedback
+	BandwidthEstimation BandwidthEstimationConfig `yaml:"bandwidthEstimation"`
+}
+
+// BandwidthEstimationConfig configures the estimate of every subscriber's bandwidth, which
+// picks the simulcast layers they get. It runs on TWCC feedback.
+type BandwidthEstimationConfig struct {
+	Enabled        bool `yaml:"enabled"`
+	InitialBitrate int  `yaml:"initialBitrate"` // bits per second assumed before any feedback arrived
+	MinBitrate     int  `yaml:"minBitrate"`
+	MaxBitrate     int  `yaml:"maxBitrate"`
+}
+
+// LogConfig configures the logs of pion, the WebRTC stack.
+type LogConfig struct {
+	Level string `yaml:"level"` // disabled, error, warn, info, debug or trace
+}
+
+// AuthConfig holds the secrets of the admin API and of /sdp access tokens.
+type AuthConfig struct {
+	AdminToken string `yaml:"adminToken"` // bearer token of the admin API, empty turns it off
+	JWTSecret  string `yaml:"jwtSecret"`  // HMAC secret access tokens are signed with
+	JWKSFile   string `yaml:"jwksFile"`   // JWKS file with the keys access tokens are signed with
+}
+
+// RecordingConfig configures recordings.
+type RecordingConfig struct {
+	Dir string `yaml:"dir"` // empty for the SFU's default
+	Max int    `yaml:"max"` // recordings running at once
+}
+
+// RTPIngestConfig configures plain RTP ingests.
+type RTPIngestConfig struct {
+	// PortMin and PortMax bound the UDP ports handed out, 0 and 0 let the OS pick any
+	PortMin int `yaml:"portMin"`
+	PortMax int `yaml:"portMax"`
+	Max     int `yaml:"max"` // ingests running at once
+}
+
+// Codecs are the codec names Config.Codecs may list.
+var Codecs = []string{"opus", "g722", "pcmu", "pcma", "vp8", "vp9", "h264", "av1"}
+
+// Default returns the configuration used when nothing is set.
+func Default() *Config {
+	estimation := sfu_server.NewBandwidthEstimation()
+	return &Config{
+		HTTP: HTTPConfig{Listen: ":8000"},
+		UDP:  UDPConfig{Listen: ":5000"},
+		ICE: ICEConfig{
+			NetworkTypes: []string{"udp4", "udp6"},
+			PublicIP: PublicIPConfig{
+				Discover:      true,
+				CloudMetadata: false,
+				STUNServers:   []string{"stun:stun.l.google.com:19302"},
+				Interval:      5 * time.Minute,
+			},
+		},
+		Channels:  ChannelConfig{Packets: 1024, Signaling: 256},
+		Log:       LogConfig{Level: "warn"},
+		Recording: RecordingConfig{Max: 8},
+		RTPIngest: RTPIngestConfig{Max: 16},
+		Interceptors: InterceptorsConfig{
+			NACK:    true,
+			Reports: true,
+			TWCC:    true,
+			BandwidthEstimation: BandwidthEstimationConfig{
+				Enabled:        true,
+				InitialBitrate: estimation.InitialBitrate,
+				MinBitrate:     estimation.MinBitrate,
+				MaxBitrate:     estimation.MaxBitrate,
+			},
+		},
+	}
+}
+
+// setting is one setting that can be set by an environment variable and a flag.
+type setting struct {
+	flag  string // empty for secrets, which don't belong on a command line
+	env   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{"http-listen", "MONOPORT_HTTP_LISTEN", "address the HTTP server listens on",
+		func(c *Config, v string) error { c.HTTP.Listen = v; return nil }},
+	{"allowed-origins", "MONOPORT_ALLOWED_ORIGINS", "comma separated origins allowed to open /sdp websockets, * for any",
+		func(c *Config, v string) error { c.HTTP.AllowedOrigins = splitList(v); return nil }},
+	{"udp-listen", "MONOPORT_UDP_LISTEN", "address of the UDP port shared by STUN and media",
+		func(c *Config, v string) error { c.UDP.Listen = v; return nil }},
+	{"announced-ips", "MONOPORT_ANNOUNCED_IPS", "comma separated public IPs announced in host candidates, one per address family or public/local pairs",
+		func(c *Config, v string) error { c.ICE.AnnouncedIPs = splitList(v); return nil }},
+	{"discover-public-ip", "MONOPORT_DISCOVER_PUBLIC_IP", "discover the public IP when no IPs are announced (true or false)",
+		func(c *Config, v string) error { return parseBool(&c.ICE.PublicIP.Discover, v) }},
+	{"cloud-metadata", "MONOPORT_CLOUD_METADATA", "ask cloud metadata endpoints for the public IP (true or false)",
+		func(c *Config, v string) error { return parseBool(&c.ICE.PublicIP.CloudMetadata, v) }},
+	{"public-ip-stun-servers", "MONOPORT_PUBLIC_IP_STUN_SERVERS", "comma separated STUN URLs asked for the public IP",
+		func(c *Config, v string) error { c.ICE.PublicIP.STUNServers = splitList(v); return nil }},
+	{"public-ip-interval", "MONOPORT_PUBLIC_IP_INTERVAL", "interval between re-checks of the discovered public IP, e.g. 5m, 0 for never",
+		func(c *Config, v string) error {
+			interval, err := time.ParseDuration(strings.TrimSpace(v))
+			if err != nil {
+				return fmt.Errorf("%q is not a duration", v)
+			}
+			c.ICE.PublicIP.Interval = interval
+			return nil
+		}},
+	{"ice-servers", "MONOPORT_ICE_SERVERS", "comma separated STUN and TURN URLs handed to clients, TURN credentials as turn:user:pass@host, or a JSON list like ice.servers",
+		func(c *Config, v string) error {
+			servers, err := parseICEServers(v)
+			if err != nil {
+				return err
+			}
+			c.ICE.Servers = servers
+			return nil
+		}},
+	{"network-types", "MONOPORT_NETWORK_TYPES", "comma separated ICE network types: udp4, udp6, tcp4, tcp6",
+		func(c *Config, v string) error { c.ICE.NetworkTypes = splitList(v); return nil }},
+	{"ice-tcp-listen", "MONOPORT_ICE_TCP_LISTEN", "address of the ICE-TCP port, empty shares the HTTP port",
+		func(c *Config, v string) error { c.ICE.TCPListen = v; return nil }},
+	{"packet-channel-size", "MONOPORT_PACKET_CHANNEL_SIZE", "STUN packets queued between the UDP port and the STUN server",
+		func(c *Config, v string) error { return parseInt(&c.Channels.Packets, v) }},
+	{"signal-channel-size", "MONOPORT_SIGNAL_CHANNEL_SIZE", "messages queued between the SFU and the websockets",
+		func(c *Config, v string) error { return parseInt(&c.Channels.Signaling, v) }},
+	{"nack", "MONOPORT_NACK", "ask publishers to retransmit lost packets (true or false)",
+		func(c *Config, v string) error { return parseBool(&c.Interceptors.NACK, v) }},
+	{"rtcp-reports", "MONOPORT_RTCP_REPORTS", "send RTCP sender and receiver reports (true or false)",
+		func(c *Config, v string) error { return parseBool(&c.Interceptors.Reports, v) }},
+	{"twcc", "MONOPORT_TWCC", "negotiate transport wide congestion control (true or false)",
+		func(c *Config, v string) error { return parseBool(&c.Interceptors.TWCC, v) }},
+	{"bandwidth-estimation", "MONOPORT_BANDWIDTH_ESTIMATION", "estimate every subscriber's bandwidth, needs twcc (true or false)",
+		func(c *Config, v string) error { return parseBool(&c.Interceptors.BandwidthEstimation.Enabled, v) }},
+	{"bwe-initial-bitrate", "MONOPORT_BWE_INITIAL_BITRATE", "bits per second assumed before a subscriber's first feedback",
+		func(c *Config, v string) error {
+			return parseInt(&c.Interceptors.BandwidthEstimation.InitialBitrate, v)
+		}},
+	{"bwe-min-bitrate", "MONOPORT_BWE_MIN_BITRATE", "lowest bandwidth estimate in bits per second",
+		func(c *Config, v string) error { return parseInt(&c.Interceptors.BandwidthEstimation.MinBitrate, v) }},
+	{"bwe-max-bitrate", "MONOPORT_BWE_MAX_BITRATE", "highest bandwidth estimate in bits per second",
+		func(c *Config, v string) error { return parseInt(&c.Interceptors.BandwidthEstimation.MaxBitrate, v) }},
+	{"codecs", "MONOPORT_CODECS", "comma separated codecs to negotiate: " + strings.Join(Codecs, ", "),
+		func(c *Config, v string) error { c.Codecs = splitList(v); return nil }},
+	{"log-level", "MONOPORT_LOG_LEVEL", "level of pion's logs: disabled, error, warn, info, debug or trace",
+		func(c *Config, v string) error { c.Log.Level = v; return nil }},
+	{"rtp-ingest-max", "MONOPORT_RTP_INGEST_MAX", "plain RTP ingests running at once",
+		func(c *Config, v string) error { return parseInt(&c.RTPIngest.Max, v) }},
+	{"", "MONOPORT_ADMIN_TOKEN", "bearer token of the admin API",
+		func(c *Config, v string) error { c.Auth.AdminToken = v; return nil }},
+	{"", "MONOPORT_JWT_SECRET", "HMAC secret of /sdp access tokens",
+		func(c *Config, v string) error { c.Auth.JWTSecret = v; return nil }},
+	{"jwks-file", "MONOPORT_JWKS_FILE", "JWKS file with the keys of /sdp access tokens",
+		func(c *Config, v string) error { c.Auth.JWKSFile = v; return nil }},
+	{"recording-dir", "MONOPORT_RECORDING_DIR", "directory recordings are written to",
+		func(c *Config, v string) error { c.Recording.Dir = v; return nil }},
+	{"recording-max", "MONOPORT_RECORDING_MAX", "recordings running at once",
+		func(c *Config, v string) error { return parseInt(&c.Recording.Max, v) }},
+	{"rtp-ingest-ports", "MONOPORT_RTP_INGEST_PORTS", "UDP port range of plain RTP ingests, as min-max",
+		func(c *Config, v string) error {
+			minPort, maxPort, ok := strings.Cut(v, "-")
+			if !ok {
+				return fmt.Errorf("%q is not a min-max range", v)
+			}
+			if err := parseInt(&c.RTPIngest.PortMin, minPort); err != nil {
+				return err
+			}
+			return parseInt(&c.RTPIngest.PortMax, maxPort)
+		}},
+}
+
+// Load reads the configuration: defaults, then the YAML file named by -config or FileEnv,
+// then environment variables, then the flags in args (usually os.Args[1:]).
+func Load(args []string) (*Config, error) {
+	flags := flag.NewFlagSet("monoport", flag.ContinueOnError)
+	file := flags.String("config", os.Getenv(FileEnv), "YAML configuration file, also "+FileEnv)
+	flagValues := make(map[string]*string)
+	for _, s := range settings {
+		if s.flag != "" {
+			flagValues[s.flag] = flags.String(s.flag, "", s.usage+", also "+s.env)
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := Default()
+	if *file != "" {
+		if err := c.loadFile(*file); err != nil {
+			return nil, err
+		}
+	}
+
+	var errs []error
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.env); ok {
+			if err := s.set(c, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", s.env, err))
+			}
+		}
+	}
+	flags.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name {
+				if err := s.set(c, *flagValues[s.flag]); err != nil {
+					errs = append(errs, fmt.Errorf("-%s: %w", s.flag, err))
+				}
+			}
+		}
+	})
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadFile overlays a YAML file on c, keys it doesn't know are an error.
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks every setting and reports all invalid ones.
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if err := checkListenAddress(c.HTTP.Listen); err != nil {
+		invalid("http.listen: %v", err)
+	}
+	if err := checkListenAddress(c.UDP.Listen); err != nil {
+		invalid("udp.listen: %v", err)
+	}
+	if err := checkAnnouncedIPs(c.ICE.AnnouncedIPs); err != nil {
+		invalid("ice.announcedIPs: %v", err)
+	}
+	for i, server := range c.ICE.Servers {
+		if len(server.URLs) == 0 {
+			invalid("ice.servers[%d]: no urls", i)
+		}
+		for _, raw := range server.URLs {
+			uri, err := stun.ParseURI(raw)
+			if err != nil {
+				invalid("ice.servers[%d]: %q: %v", i, raw, err)
+				continue
+			}
+			if (uri.Scheme == stun.SchemeTypeTURN || uri.Scheme == stun.SchemeTypeTURNS) && (server.Username == "" || server.Credential == "") {
+				invalid("ice.servers[%d]: TURN server %q needs a username and credential", i, raw)
+			}
+		}
+	}
+	for _, raw := range c.ICE.PublicIP.STUNServers {
+		if uri, err := stun.ParseURI(raw); err != nil || uri.Scheme != stun.SchemeTypeSTUN {
+			invalid("ice.publicIP.stunServers: %q is not a stun: URL", raw)
+		}
+	}
+	if c.ICE.PublicIP.Interval < 0 {
+		invalid("ice.publicIP.interval: %s is negative", c.ICE.PublicIP.Interval)
+	}
+	if len(c.ICE.NetworkTypes) == 0 {
+		invalid("ice.networkTypes: at least one is needed")
+	}
+	for _, networkType := range c.ICE.NetworkTypes {
+		if _, err := webrtc.NewNetworkType(networkType); err != nil {
+			invalid("ice.networkTypes: %q is not one of udp4, udp6, tcp4 and tcp6", networkType)
+		}
+	}
+	if c.ICE.TCPListen != "" {
+		if err := checkListenAddress(c.ICE.TCPListen); err != nil {
+			invalid("ice.tcpListen: %v", err)
+		}
+		if c.ICE.TCPListen == c.HTTP.Listen {
+			invalid("ice.tcpListen: leave it empty to share the HTTP port")
+		}
+	}
+	if c.Channels.Packets <= 0 {
+		invalid("channels.packets: %d is not a positive size", c.Channels.Packets)
+	}
+	if c.Channels.Signaling <= 0 {
+		invalid("channels.signaling: %d is not a positive size", c.Channels.Signaling)
+	}
+	if b := c.Interceptors.BandwidthEstimation; b.Enabled {
+		if !c.Interceptors.TWCC {
+			invalid("interceptors.bandwidthEstimation: runs on TWCC feedback, interceptors.twcc must be on")
+		}
+		if b.MinBitrate <= 0 || b.MinBitrate > b.InitialBitrate || b.InitialBitrate > b.MaxBitrate {
+			invalid("interceptors.bandwidthEstimation: bitrates must be positive with min <= initial <= max, got %d, %d, %d",
+				b.MinBitrate, b.InitialBitrate, b.MaxBitrate)
+		}
+	}
+	for _, codec := range c.Codecs {
+		if !slices.Contains(Codecs, strings.ToLower(codec)) {
+			invalid("codecs: %q is not one of %s", codec, strings.Join(Codecs, ", "))
+		}
+	}
+	if _, err := c.Log.PionLevel(); err != nil {
+		invalid("log.level: %v", err)
+	}
+	if c.Auth.JWTSecret != "" && c.Auth.JWKSFile != "" {
+		invalid("auth: only one of jwtSecret and jwksFile can be set")
+	}
+	if r := c.RTPIngest; r.PortMin < 0 || r.PortMax > 65535 || r.PortMin > r.PortMax {
+		invalid("rtpIngest: invalid port range %d-%d", r.PortMin, r.PortMax)
+	}
+	if c.Recording.Max <= 0 {
+		invalid("recording.max: %d is not a positive limit", c.Recording.Max)
+	}
+	if c.RTPIngest.Max <= 0 {
+		invalid("rtpIngest.max: %d is not a positive limit", c.RTPIngest.Max)
+	}
+	return errors.Join(errs...)
+}
+
+// UDPPort returns the port of UDP.Listen.
+func (c *Config) UDPPort() int {
+	_, port, _ := net.SplitHostPort(c.UDP.Listen)
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// UDPNetwork returns the network the UDP port is opened on: "udp4" or "udp6" when only
+// one of them is among the network types, else "udp", which is dual-stack on a wildcard
+// address and follows the family of a specific one.
+func (c *Config) UDPNetwork() string {
+	udp4 := slices.Contains(c.ICE.NetworkTypes, "udp4")
+	udp6 := slices.Contains(c.ICE.NetworkTypes, "udp6")
+	switch {
+	case udp4 && !udp6:
+		return "udp4"
+	case udp6 && !udp4:
+		return "udp6"
+	}
+	return "udp"
+}
+
+// ICETCP reports whether passive ICE-TCP candidates are gathered, the fallback for
+// networks that block UDP.
+func (c *Config) ICETCP() bool {
+	return slices.Contains(c.ICE.NetworkTypes, "tcp4") || slices.Contains(c.ICE.NetworkTypes, "tcp6")
+}
+
+// WebRTCICEServers returns the ICE servers as pion takes them. Without any configured but
+// with announced IPs, it is monoport's own STUN server on the first public IP of each
+// address family.
+func (c *Config) WebRTCICEServers() []webrtc.ICEServer {
+	servers := make([]webrtc.ICEServer, 0, len(c.ICE.Servers))
+	for _, server := range c.ICE.Servers {
+		s := webrtc.ICEServer{URLs: server.URLs, Username: server.Username}
+		if server.Credential != "" {
+			s.Credential = server.Credential
+		}
+		servers = append(servers, s)
+	}
+	if len(servers) == 0 && len(c.ICE.AnnouncedIPs) > 0 {
+		var urls []string
+		seen := make(map[bool]bool) // by whether the family is IPv4
+		for _, announced := range c.ICE.AnnouncedIPs {
+			public, _, _ := strings.Cut(announced, "/")
+			ip := net.ParseIP(public)
+			if ip == nil || seen[ip.To4() != nil] {
+				continue
+			}
+			seen[ip.To4() != nil] = true
+			urls = append(urls, "stun:"+net.JoinHostPort(public, strconv.Itoa(c.UDPPort())))
+		}
+		servers = append(servers, webrtc.ICEServer{URLs: urls})
+	}
+	return servers
+}
+
+// PublicIPSTUNServers returns the STUN URLs asked for the public IP: those of Servers,
+// then PublicIP.STUNServers.
+func (c *Config) PublicIPSTUNServers() []string {
+	var candidates, urls []string
+	for _, server := range c.ICE.Servers {
+		candidates = append(candidates, server.URLs...)
+	}
+	for _, raw := range append(candidates, c.ICE.PublicIP.STUNServers...) {
+		if uri, err := stun.ParseURI(raw); err == nil && uri.Scheme == stun.SchemeTypeSTUN && !slices.Contains(urls, raw) {
+			urls = append(urls, raw)
+		}
+	}
+	return urls
+}
+
+// InterceptorConfig returns the interceptors as the SFU takes them, custom interceptors
+// can be added to the result.
+func (i InterceptorsConfig) InterceptorConfig() sfu_server.InterceptorConfig {
+	config := sfu_server.InterceptorConfig{NACK: i.NACK, Reports: i.Reports, TWCC: i.TWCC}
+	if b := i.BandwidthEstimation; b.Enabled {
+		config.BandwidthEstimation = sfu_server.NewBandwidthEstimation()
+		config.BandwidthEstimation.InitialBitrate = b.InitialBitrate
+		config.BandwidthEstimation.MinBitrate = b.MinBitrate
+		config.BandwidthEstimation.MaxBitrate = b.MaxBitrate
+	}
+	return config
+}
+
+// WebRTCNetworkTypes returns the ICE network types as pion takes them.
+func (c *Config) WebRTCNetworkTypes() []webrtc.NetworkType {
+	networkTypes := make([]webrtc.NetworkType, 0, len(c.ICE.NetworkTypes))
+	for _, name := range c.ICE.NetworkTypes {
+		if networkType, err := webrtc.NewNetworkType(name); err == nil {
+			networkTypes = append(networkTypes, networkType)
+		}
+	}
+	return networkTypes
+}
+
+// PionLevel parses Level.
+func (l LogConfig) PionLevel() (logging.LogLevel, error) {
+	switch strings.ToLower(l.Level) {
+	case "disabled":
+		return logging.LogLevelDisabled, nil
+	case "error":
+		return logging.LogLevelError, nil
+	case "warn":
+		return logging.LogLevelWarn, nil
+	case "info":
+		return logging.LogLevelInfo, nil
+	case "debug":
+		return logging.LogLevelDebug, nil
+	case "trace":
+		return logging.LogLevelTrace, nil
+	}
+	return 0, fmt.Errorf("unknown level %q", l.Level)
+}
+
+// checkAnnouncedIPs applies pion's rules for NAT1To1 IPs: per address family either a
+// single public IP, or public/local pairs of the same family with every local IP once.
+func checkAnnouncedIPs(announced []string) error {
+	type family struct {
+		sole   bool
+		locals []string
+	}
+	var ipv4, ipv6 family
+	for _, entry := range announced {
+		publicIP, localIP, isPair := strings.Cut(entry, "/")
+		public := net.ParseIP(publicIP)
+		if public == nil {
+			return fmt.Errorf("%q is not an IP address or a public/local pair", entry)
+		}
+		f := &ipv6
+		if public.To4() != nil {
+			f = &ipv4
+		}
+		if !isPair {
+			if f.sole || len(f.locals) > 0 {
+				return fmt.Errorf("%q: a single IP must be the only one of its address family", entry)
+			}
+			f.sole = true
+			continue
+		}
+		local := net.ParseIP(localIP)
+		if local == nil || (local.To4() != nil) != (public.To4() != nil) {
+			return fmt.Errorf("%q: the local IP must be an address of the same family", entry)
+		}
+		if f.sole || slices.Contains(f.locals, local.String()) {
+			return fmt.Errorf("%q: every local IP can only be mapped once, and not alongside a single IP", entry)
+		}
+		f.locals = append(f.locals, local.String())
+	}
+	return nil
+}
+
+func checkListenAddress(address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parseICEServers reads the ICE servers of an environment variable or flag: either a JSON
+// list shaped like ice.servers, or comma separated URLs where TURN URLs may carry their
+// credentials as turn:user:pass@host:port. Special characters in them are percent-encoded.
+func parseICEServers(value string) ([]ICEServer, error) {
+	if strings.HasPrefix(strings.TrimSpace(value), "[") {
+		var servers []ICEServer
+		decoder := yaml.NewDecoder(strings.NewReader(value))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&servers); err != nil {
+			return nil, fmt.Errorf("not a JSON list of ICE servers: %v", err)
+		}
+		return servers, nil
+	}
+
+	var servers []ICEServer
+	for _, raw := range splitList(value) {
+		server := ICEServer{URLs: []string{raw}}
+		scheme, rest, _ := strings.Cut(raw, ":")
+		userinfo, host, hasUserinfo := cutLast(rest, "@")
+		if hasUserinfo && (scheme == "turn" || scheme == "turns") {
+			username, credential, _ := strings.Cut(userinfo, ":")
+			var err error
+			if server.Username, err = url.PathUnescape(username); err != nil {
+				return nil, fmt.Errorf("%q: invalid username: %v", raw, err)
+			}
+			if server.Credential, err = url.PathUnescape(credential); err != nil {
+				return nil, fmt.Errorf("%q: invalid credential: %v", raw, err)
+			}
+			server.URLs = []string{scheme + ":" + host}
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// cutLast is strings.Cut around the last instance of sep.
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+func parseInt(dst *int, value string) error {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return fmt.Errorf("%q is not a number", value)
+	}
+	*dst = n
+	return nil
+}
+
+func parseBool(dst *bool, value string) error {
+	b, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		return fmt.Errorf("%q is not true or false", value)
+	}
+	*dst = b
+	return nil
+}
@@ -0,0 +1,231 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheckAnnouncedIPs(t *testing.T) {
+	tests := []struct {
+		name      string
+		announced []string
+		wantErr   string
+	}{
+		{name: "none"},
+		{name: "one per family", announced: []string{"203.0.113.10", "2001:db8::10"}},
+		{name: "pairs", announced: []string{"203.0.113.10/10.0.0.5", "203.0.113.11/10.0.0.6"}},
+		{name: "single IP of one family and pairs of the other", announced: []string{"2001:db8::10", "203.0.113.10/10.0.0.5"}},
+		{name: "not an IP", announced: []string{"example.com"}, wantErr: "is not an IP address"},
+		{name: "two single IPs of a family", announced: []string{"203.0.113.10", "203.0.113.11"}, wantErr: "must be the only one"},
+		{name: "single IP after a pair", announced: []string{"203.0.113.10/10.0.0.5", "203.0.113.11"}, wantErr: "must be the only one"},
+		{name: "pair after a single IP", announced: []string{"203.0.113.11", "203.0.113.10/10.0.0.5"}, wantErr: "mapped once"},
+		{name: "local IP mapped twice", announced: []string{"203.0.113.10/10.0.0.5", "203.0.113.11/10.0.0.5"}, wantErr: "mapped once"},
+		{name: "mixed families in a pair", announced: []string{"203.0.113.10/fd00::5"}, wantErr: "same family"},
+		{name: "pair without a local IP", announced: []string{"203.0.113.10/"}, wantErr: "same family"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkAnnouncedIPs(tt.announced)
+			checkErr(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(*Config)
+		wantErr []string // all of them in the error
+	}{
+		{name: "defaults", change: func(*Config) {}},
+		{name: "bad HTTP address", change: func(c *Config) { c.HTTP.Listen = "8080" }, wantErr: []string{"http.listen"}},
+		{name: "bad UDP port", change: func(c *Config) { c.UDP.Listen = ":70000" }, wantErr: []string{"udp.listen"}},
+		{name: "bad announced IP", change: func(c *Config) { c.ICE.AnnouncedIPs = []string{"nope"} }, wantErr: []string{"ice.announcedIPs"}},
+		{
+			name:    "TURN without credentials",
+			change:  func(c *Config) { c.ICE.Servers = []ICEServer{{URLs: []string{"turn:turn.example.com:3478"}}} },
+			wantErr: []string{"needs a username and credential"},
+		},
+		{
+			name: "TURN with credentials",
+			change: func(c *Config) {
+				c.ICE.Servers = []ICEServer{{URLs: []string{"turn:turn.example.com:3478"}, Username: "u", Credential: "p"}}
+			},
+		},
+		{name: "ICE server without URLs", change: func(c *Config) { c.ICE.Servers = []ICEServer{{}} }, wantErr: []string{"no urls"}},
+		{name: "TURN asked for the public IP", change: func(c *Config) { c.ICE.PublicIP.STUNServers = []string{"turn:t:3478"} }, wantErr: []string{"not a stun: URL"}},
+		{name: "no network types", change: func(c *Config) { c.ICE.NetworkTypes = nil }, wantErr: []string{"at least one"}},
+		{name: "unknown network type", change: func(c *Config) { c.ICE.NetworkTypes = []string{"udp4", "sctp"} }, wantErr: []string{`"sctp"`}},
+		{name: "ICE-TCP on the HTTP address", change: func(c *Config) { c.ICE.TCPListen = c.HTTP.Listen }, wantErr: []string{"ice.tcpListen"}},
+		{name: "empty channel", change: func(c *Config) { c.Channels.Signaling = 0 }, wantErr: []string{"channels.signaling"}},
+		{name: "bandwidth estimation without TWCC", change: func(c *Config) { c.Interceptors.TWCC = false }, wantErr: []string{"interceptors.twcc must be on"}},
+		{
+			name: "bitrates out of order",
+			change: func(c *Config) {
+				c.Interceptors.BandwidthEstimation.MinBitrate = c.Interceptors.BandwidthEstimation.MaxBitrate + 1
+			},
+			wantErr: []string{"min <= initial <= max"},
+		},
+		{name: "unknown codec", change: func(c *Config) { c.Codecs = []string{"theora"} }, wantErr: []string{"codecs"}},
+		{name: "codecs in any case", change: func(c *Config) { c.Codecs = []string{"VP8", "Opus"} }},
+		{name: "unknown log level", change: func(c *Config) { c.Log.Level = "loud" }, wantErr: []string{"log.level"}},
+		{name: "secret and JWKS", change: func(c *Config) { c.Auth.JWTSecret, c.Auth.JWKSFile = "s", "keys.json" }, wantErr: []string{"only one of"}},
+		{name: "port range upside down", change: func(c *Config) { c.RTPIngest.PortMin, c.RTPIngest.PortMax = 20000, 10000 }, wantErr: []string{"port range"}},
+		{name: "no recordings", change: func(c *Config) { c.Recording.Max = 0 }, wantErr: []string{"recording.max"}},
+		{
+			name:    "every problem at once",
+			change:  func(c *Config) { c.HTTP.Listen, c.Recording.Max = "bad", 0 },
+			wantErr: []string{"http.listen", "recording.max"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			tt.change(c)
+			err := c.Validate()
+			if len(tt.wantErr) == 0 {
+				checkErr(t, err, "")
+			}
+			for _, want := range tt.wantErr {
+				checkErr(t, err, want)
+			}
+		})
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "monoport.yaml")
+	yaml := "http:\n  listen: \":1001\"\nudp:\n  listen: \":2001\"\nrecording:\n  max: 3\n"
+	if err := os.WriteFile(file, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		env           map[string]string
+		args          []string
+		wantHTTP      string
+		wantUDP       string
+		wantRecording int
+		wantErr       string
+	}{
+		{name: "file over defaults", args: []string{"-config", file}, wantHTTP: ":1001", wantUDP: ":2001", wantRecording: 3},
+		{
+			name:     "environment over file",
+			env:      map[string]string{"MONOPORT_HTTP_LISTEN": ":1002"},
+			args:     []string{"-config", file},
+			wantHTTP: ":1002", wantUDP: ":2001", wantRecording: 3,
+		},
+		{
+			name:     "flag over environment",
+			env:      map[string]string{"MONOPORT_HTTP_LISTEN": ":1002", "MONOPORT_RECORDING_MAX": "4"},
+			args:     []string{"-config", file, "-http-listen", ":1003"},
+			wantHTTP: ":1003", wantUDP: ":2001", wantRecording: 4,
+		},
+		{
+			name:     "file from the environment",
+			env:      map[string]string{FileEnv: file},
+			wantHTTP: ":1001", wantUDP: ":2001", wantRecording: 3,
+		},
+		{
+			name:    "bad values are reported with their source",
+			env:     map[string]string{"MONOPORT_RECORDING_MAX": "many"},
+			args:    []string{"-packet-channel-size", "lots"},
+			wantErr: "MONOPORT_RECORDING_MAX",
+		},
+		{
+			name:    "flag value is still validated",
+			args:    []string{"-recording-max", "0"},
+			wantErr: "recording.max",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(FileEnv, "")
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			c, err := Load(tt.args)
+			checkErr(t, err, tt.wantErr)
+			if err != nil {
+				return
+			}
+			if c.HTTP.Listen != tt.wantHTTP || c.UDP.Listen != tt.wantUDP || c.Recording.Max != tt.wantRecording {
+				t.Errorf("got http %q, udp %q, recording max %d, want %q, %q, %d",
+					c.HTTP.Listen, c.UDP.Listen, c.Recording.Max, tt.wantHTTP, tt.wantUDP, tt.wantRecording)
+			}
+		})
+	}
+}
+
+func TestParseICEServers(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []ICEServer
+		wantErr string
+	}{
+		{
+			name:  "STUN URLs",
+			value: "stun:a.example.com:3478, stun:b.example.com:3478",
+			want:  []ICEServer{{URLs: []string{"stun:a.example.com:3478"}}, {URLs: []string{"stun:b.example.com:3478"}}},
+		},
+		{
+			name:  "TURN with credentials",
+			value: "turn:alice:secret@turn.example.com:3478?transport=tcp",
+			want:  []ICEServer{{URLs: []string{"turn:turn.example.com:3478?transport=tcp"}, Username: "alice", Credential: "secret"}},
+		},
+		{
+			name:  "percent-encoded credentials",
+			value: "turns:al%3Aice:p%40ss@turn.example.com:5349",
+			want:  []ICEServer{{URLs: []string{"turns:turn.example.com:5349"}, Username: "al:ice", Credential: "p@ss"}},
+		},
+		{
+			name:  "TURN without credentials is left to validation",
+			value: "turn:turn.example.com:3478",
+			want:  []ICEServer{{URLs: []string{"turn:turn.example.com:3478"}}},
+		},
+		{
+			name:  "JSON",
+			value: `[{"urls": ["turn:turn.example.com:3478", "turns:turn.example.com:5349"], "username": "u", "credential": "p"}]`,
+			want:  []ICEServer{{URLs: []string{"turn:turn.example.com:3478", "turns:turn.example.com:5349"}, Username: "u", Credential: "p"}},
+		},
+		{name: "JSON with an unknown key", value: `[{"url": "stun:a.example.com"}]`, wantErr: "not a JSON list"},
+		{name: "bad escape", value: "turn:alice:%zz@turn.example.com", wantErr: "invalid credential"},
+		{name: "empty", value: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseICEServers(tt.value)
+			checkErr(t, err, tt.wantErr)
+			if err != nil {
+				return
+			}
+			if !slices.EqualFunc(got, tt.want, func(a, b ICEServer) bool {
+				return slices.Equal(a.URLs, b.URLs) && a.Username == b.Username && a.Credential == b.Credential
+			}) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// checkErr fails the test unless err contains want, or is nil when want is empty.
+func checkErr(t *testing.T, err error, want string) {
+	t.Helper()
+	switch {
+	case want == "" && err != nil:
+		t.Fatalf("unexpected error: %v", err)
+	case want != "" && err == nil:
+		t.Fatalf("no error, want one containing %q", want)
+	case want != "" && !strings.Contains(err.Error(), want):
+		t.Fatalf("error %q doesn't contain %q", err, want)
+	}
+}
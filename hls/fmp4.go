@@ -0,0 +1,209 @@
+package hls
+
+import "encoding/binary"
+
+// The boxes below are the minimum fragmented MP4 (ISO/IEC 14496-12) that HLS players accept:
+// an init segment describing the tracks, then moof+mdat fragments carrying the samples.
+
+// box serializes an ISO BMFF box, children are simply concatenated after the header.
+func box(typ string, children ...[]byte) []byte {
+	size := 8
+	for _, child := range children {
+		size += len(child)
+	}
+	out := make([]byte, 0, size)
+	out = binary.BigEndian.AppendUint32(out, uint32(size))
+	out = append(out, typ...)
+	for _, child := range children {
+		out = append(out, child...)
+	}
+	return out
+}
+
+// fullBox is a box with a version and flags in front of its content.
+func fullBox(typ string, version uint8, flags uint32, children ...[]byte) []byte {
+	header := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags&0xffffff)
+	return box(typ, append([][]byte{header}, children...)...)
+}
+
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func u64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+// unityMatrix is the identity transformation of mvhd and tkhd.
+var unityMatrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+func matrix() []byte {
+	var out []byte
+	for _, v := range unityMatrix {
+		out = binary.BigEndian.AppendUint32(out, v)
+	}
+	return out
+}
+
+// trackConfig is what the init segment needs to know about a track.
+type trackConfig struct {
+	id        uint32
+	video     bool
+	timescale uint32
+
+	// video
+	width, height uint16
+	sps, pps      []byte
+
+	// audio, always Opus
+	channels uint16
+}
+
+// initSegment returns ftyp+moov for the given tracks.
+func initSegment(tracks []*trackConfig) []byte {
+	ftyp := box("ftyp", []byte("iso5"), u32(512), []byte("iso5iso6mp41"))
+
+	mvhd := fullBox("mvhd", 0, 0,
+		u32(0), u32(0), // creation and modification time
+		u32(1000), u32(0), // timescale, duration
+		u32(0x00010000), u16(0x0100), make([]byte, 10), // rate, volume, reserved
+		matrix(), make([]byte, 24), // pre_defined
+		u32(uint32(len(tracks)+1)), // next track ID
+	)
+
+	children := [][]byte{mvhd}
+	var trex [][]byte
+	for _, track := range tracks {
+		children = append(children, trak(track))
+		trex = append(trex, fullBox("trex", 0, 0, u32(track.id), u32(1), u32(0), u32(0), u32(0)))
+	}
+	children = append(children, box("mvex", trex...))
+
+	return append(ftyp, box("moov", children...)...)
+}
+
+func trak(track *trackConfig) []byte {
+	volume := uint16(0x0100)
+	handler, name := "soun", "SoundHandler"
+	mediaHeader := fullBox("smhd", 0, 0, u16(0), u16(0))
+	sampleEntry := opusSampleEntry(track)
+	if track.video {
+		volume = 0
+		handler, name = "vide", "VideoHandler"
+		mediaHeader = fullBox("vmhd", 0, 1, make([]byte, 8))
+		sampleEntry = avc1SampleEntry(track)
+	}
+
+	tkhd := fullBox("tkhd", 0, 3, // enabled and in movie
+		u32(0), u32(0), u32(track.id), u32(0), u32(0), // times, track ID, reserved, duration
+		make([]byte, 8), u16(0), u16(0), u16(volume), u16(0), // reserved, layer, alternate group, volume, reserved
+		matrix(), u32(uint32(track.width)<<16), u32(uint32(track.height)<<16),
+	)
+
+	mdhd := fullBox("mdhd", 0, 0, u32(0), u32(0), u32(track.timescale), u32(0), u16(0x55c4), u16(0)) // language "und"
+	hdlr := fullBox("hdlr", 0, 0, u32(0), []byte(handler), make([]byte, 12), []byte(name+"\x00"))
+	dinf := box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1)))
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, u32(1), sampleEntry),
+		fullBox("stts", 0, 0, u32(0)),
+		fullBox("stsc", 0, 0, u32(0)),
+		fullBox("stsz", 0, 0, u32(0), u32(0)),
+		fullBox("stco", 0, 0, u32(0)),
+	)
+
+	return box("trak", tkhd, box("mdia", mdhd, hdlr, box("minf", mediaHeader, dinf, stbl)))
+}
+
+func avc1SampleEntry(track *trackConfig) []byte {
+	avcC := box("avcC",
+		[]byte{1, track.sps[1], track.sps[2], track.sps[3], 0xff, 0xe1}, // version, profile, compatibility, level, 4 byte lengths, 1 SPS
+		u16(uint16(len(track.sps))), track.sps,
+		[]byte{1}, u16(uint16(len(track.pps))), track.pps,
+	)
+	return box("avc1",
+		make([]byte, 6), u16(1), // reserved, data reference index
+		make([]byte, 16), // pre_defined and reserved
+		u16(track.width), u16(track.height),
+		u32(0x00480000), u32(0x00480000), u32(0), u16(1), // 72 dpi, reserved, frame count
+		make([]byte, 32), u16(0x0018), u16(0xffff), // compressor name, depth, pre_defined
+		avcC,
+	)
+}
+
+// opusSampleEntry follows "Encapsulation of Opus in ISO Base Media File Format".
+func opusSampleEntry(track *trackConfig) []byte {
+	dOps := box("dOps",
+		[]byte{0, byte(track.channels)}, // version, output channel count
+		u16(0), u32(48000), u16(0),      // pre-skip, input sample rate, output gain
+		[]byte{0}, // channel mapping family
+	)
+	return box("Opus",
+		make([]byte, 6), u16(1), // reserved, data reference index
+		make([]byte, 8), u16(track.channels), u16(16), // reserved, channel count, sample size
+		u16(0), u16(0), u32(48000<<16), // pre_defined, reserved, sample rate
+		dOps,
+	)
+}
+
+// sample is one access unit of a track, a video frame or an Opus packet.
+type sample struct {
+	data     []byte
+	dts      uint64 // in the track's timescale
+	duration uint32
+	keyframe bool
+}
+
+const (
+	sampleFlagsSync    = 0x02000000 // depends on nothing
+	sampleFlagsNonSync = 0x01010000 // depends on others, not a sync sample
+)
+
+// fragment returns a moof+mdat carrying the samples of every track, tracks without samples
+// are left out.
+func fragment(sequence uint32, tracks []*trackConfig, samples [][]*sample) []byte {
+	var trafs [][]byte
+	var dataOffsetPositions []int // where each trun's data offset sits inside its traf
+	var mdat [][]byte
+	var dataSizes []int
+
+	for i, track := range tracks {
+		if len(samples[i]) == 0 {
+			continue
+		}
+
+		entries := make([]byte, 0, len(samples[i])*12)
+		size := 0
+		for _, s := range samples[i] {
+			flags := uint32(sampleFlagsNonSync)
+			if s.keyframe || !track.video {
+				flags = sampleFlagsSync
+			}
+			entries = binary.BigEndian.AppendUint32(entries, s.duration)
+			entries = binary.BigEndian.AppendUint32(entries, uint32(len(s.data)))
+			entries = binary.BigEndian.AppendUint32(entries, flags)
+			mdat = append(mdat, s.data)
+			size += len(s.data)
+		}
+
+		tfhd := fullBox("tfhd", 0, 0x020000, u32(track.id)) // default-base-is-moof
+		tfdt := fullBox("tfdt", 1, 0, u64(samples[i][0].dts))
+		// data offset, sample duration, sample size and sample flags present
+		trun := fullBox("trun", 0, 0x000701, u32(uint32(len(samples[i]))), u32(0), entries)
+
+		traf := box("traf", tfhd, tfdt, trun)
+		// box header, tfhd, tfdt, then trun's own header, version and flags, and sample count
+		dataOffsetPositions = append(dataOffsetPositions, 8+len(tfhd)+len(tfdt)+16)
+		trafs = append(trafs, traf)
+		dataSizes = append(dataSizes, size)
+	}
+
+	mfhd := fullBox("mfhd", 0, 0, u32(sequence))
+	moof := box("moof", append([][]byte{mfhd}, trafs...)...)
+
+	// patch in where every traf's samples start, relative to the start of moof
+	offset := len(moof) + 8
+	position := 8 + len(mfhd)
+	for i, traf := range trafs {
+		binary.BigEndian.PutUint32(moof[position+dataOffsetPositions[i]:], uint32(offset))
+		offset += dataSizes[i]
+		position += len(traf)
+	}
+
+	return append(moof, box("mdat", mdat...)...)
+}
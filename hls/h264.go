@@ -0,0 +1,258 @@
+package hls
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	nalTypeIDR = 5
+	nalTypeSPS = 7
+	nalTypePPS = 8
+)
+
+// avccNALUs splits a frame made of 4 byte length prefixed NAL units, the format pion's
+// H264 depacketizer produces with IsAVC set and the one fMP4 samples use.
+func avccNALUs(frame []byte) [][]byte {
+	var nalus [][]byte
+	for len(frame) >= 4 {
+		size := int(binary.BigEndian.Uint32(frame))
+		frame = frame[4:]
+		if size > len(frame) {
+			break
+		}
+		nalus = append(nalus, frame[:size])
+		frame = frame[size:]
+	}
+	return nalus
+}
+
+// bitReader reads the Exp-Golomb coded fields of an SPS.
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+}
+
+var errSPSTooShort = errors.New("SPS is truncated")
+
+func (r *bitReader) bit() (uint, error) {
+	if r.pos >= len(r.data)*8 {
+		return 0, errSPSTooShort
+	}
+	b := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+	r.pos++
+	return uint(b), nil
+}
+
+func (r *bitReader) bits(n int) (uint, error) {
+	var v uint
+	for i := 0; i < n; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+func (r *bitReader) ue() (uint, error) {
+	zeros := 0
+	for {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, errors.New("invalid Exp-Golomb code in SPS")
+		}
+	}
+	v, err := r.bits(zeros)
+	return (1<<zeros - 1) + v, err
+}
+
+func (r *bitReader) se() (int, error) {
+	v, err := r.ue()
+	if v%2 == 1 {
+		return int(v/2 + 1), err
+	}
+	return -int(v / 2), err
+}
+
+// unescapeRBSP removes the emulation prevention bytes of a NAL unit.
+func unescapeRBSP(nalu []byte) []byte {
+	out := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// spsResolution reads the picture size out of an SPS (ITU-T H.264 section 7.3.2.1.1),
+// the init segment has to announce it.
+func spsResolution(sps []byte) (width, height uint16, err error) {
+	r := &bitReader{data: unescapeRBSP(sps)}
+	r.pos = 8 // NAL header
+
+	profile, err := r.bits(8)
+	if err != nil {
+		return 0, 0, err
+	}
+	r.pos += 16                       // constraint flags and level
+	if _, err := r.ue(); err != nil { // seq_parameter_set_id
+		return 0, 0, err
+	}
+
+	chromaFormat := uint(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormat, err = r.ue(); err != nil {
+			return 0, 0, err
+		}
+		if chromaFormat == 3 {
+			r.pos++ // separate_colour_plane_flag
+		}
+		if _, err := r.ue(); err != nil { // bit_depth_luma_minus8
+			return 0, 0, err
+		}
+		if _, err := r.ue(); err != nil { // bit_depth_chroma_minus8
+			return 0, 0, err
+		}
+		r.pos++ // qpprime_y_zero_transform_bypass_flag
+		scalingMatrix, err := r.bit()
+		if err != nil {
+			return 0, 0, err
+		}
+		if scalingMatrix == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				present, err := r.bit()
+				if err != nil {
+					return 0, 0, err
+				}
+				if present == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				if err := skipScalingList(r, size); err != nil {
+					return 0, 0, err
+				}
+			}
+		}
+	}
+
+	if _, err := r.ue(); err != nil { // log2_max_frame_num_minus4
+		return 0, 0, err
+	}
+	pocType, err := r.ue()
+	if err != nil {
+		return 0, 0, err
+	}
+	switch pocType {
+	case 0:
+		if _, err := r.ue(); err != nil { // log2_max_pic_order_cnt_lsb_minus4
+			return 0, 0, err
+		}
+	case 1:
+		r.pos++ // delta_pic_order_always_zero_flag
+		if _, err := r.se(); err != nil {
+			return 0, 0, err
+		}
+		if _, err := r.se(); err != nil {
+			return 0, 0, err
+		}
+		cycle, err := r.ue()
+		if err != nil {
+			return 0, 0, err
+		}
+		for i := uint(0); i < cycle; i++ {
+			if _, err := r.se(); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	if _, err := r.ue(); err != nil { // max_num_ref_frames
+		return 0, 0, err
+	}
+	r.pos++ // gaps_in_frame_num_value_allowed_flag
+
+	widthMbs, err := r.ue()
+	if err != nil {
+		return 0, 0, err
+	}
+	heightMapUnits, err := r.ue()
+	if err != nil {
+		return 0, 0, err
+	}
+	frameMbsOnly, err := r.bit()
+	if err != nil {
+		return 0, 0, err
+	}
+	if frameMbsOnly == 0 {
+		r.pos++ // mb_adaptive_frame_field_flag
+	}
+	r.pos++ // direct_8x8_inference_flag
+
+	w := (widthMbs + 1) * 16
+	h := (2 - frameMbsOnly) * (heightMapUnits + 1) * 16
+
+	cropping, err := r.bit()
+	if err != nil {
+		return 0, 0, err
+	}
+	if cropping == 1 {
+		var crop [4]uint
+		for i := range crop {
+			if crop[i], err = r.ue(); err != nil {
+				return 0, 0, err
+			}
+		}
+		cropUnitX, cropUnitY := uint(1), 2-frameMbsOnly
+		if chromaFormat == 1 || chromaFormat == 2 {
+			cropUnitX = 2
+		}
+		if chromaFormat == 1 {
+			cropUnitY *= 2
+		}
+		w -= (crop[0] + crop[1]) * cropUnitX
+		h -= (crop[2] + crop[3]) * cropUnitY
+	}
+	return uint16(w), uint16(h), nil
+}
+
+func skipScalingList(r *bitReader, size int) error {
+	last, next := 8, 8
+	for i := 0; i < size; i++ {
+		if next != 0 {
+			delta, err := r.se()
+			if err != nil {
+				return err
+			}
+			next = (last + delta + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+	return nil
+}
@@ -0,0 +1,472 @@
+// Package hls turns forwarded RTP into a live HLS stream of fMP4 segments without
+// transcoding, optionally with LL-HLS partial segments. A Muxer keeps the last few segments
+// in memory and serves the playlist and the segments over HTTP.
+package hls
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config tunes the segmenter.
+type Config struct {
+	// SegmentDuration is the target segment length, segments are cut on the first video
+	// keyframe after it so the actual length depends on the publisher's keyframe interval.
+	SegmentDuration time.Duration
+	// PartDuration is the LL-HLS partial segment target, 0 turns LL-HLS off.
+	PartDuration time.Duration
+	// SegmentCount is how many complete segments the playlist keeps.
+	SegmentCount int
+}
+
+// DefaultConfig is regular HLS with 2 second segments.
+func DefaultConfig() Config {
+	return Config{SegmentDuration: 2 * time.Second, SegmentCount: 6}
+}
+
+// DefaultPartDuration is the partial segment target used for LL-HLS.
+const DefaultPartDuration = 200 * time.Millisecond
+
+// lowLatencyPartSegments is how many of the last segments list their parts in an LL-HLS
+// playlist, older ones are only listed whole.
+const lowLatencyPartSegments = 3
+
+// part is a published fragment, its data is never changed so it can be served without m.mu.
+type part struct {
+	data        []byte
+	duration    float64 // seconds
+	independent bool    // starts with a keyframe
+}
+
+type segment struct {
+	sequence int
+	start    uint64 // DTS of its first sample on the leading track
+	parts    []*part
+	duration float64
+	data     []byte // every part back to back, set once the segment is complete
+}
+
+// muxerTrack is the muxer's side of a Track.
+type muxerTrack struct {
+	config  trackConfig
+	pending *sample   // last sample, its duration is known once the next one arrives
+	ready   []*sample // samples waiting for the next fragment
+	closed  bool
+}
+
+// Muxer segments the tracks added to it into one stream of muxed fMP4 segments. When there
+// is a video track it leads: the stream starts on its first keyframe and segments are cut
+// on its keyframes, otherwise the audio track leads and every packet is a cut point.
+type Muxer struct {
+	config  Config
+	started time.Time // origin of the arrival times every track's timeline is placed on
+
+	mu          sync.Mutex
+	tracks      []*muxerTrack
+	leader      int
+	init        []byte // nil until the leading track can describe itself
+	fragments   uint32 // moof sequence number
+	segments    []*segment
+	current     *segment // being filled, nil before the first sample
+	partStart   uint64   // leading track DTS where the next part starts
+	longestPart float64
+	ended       bool
+	updated     chan struct{} // closed and replaced whenever a part is published
+}
+
+// NewMuxer returns a Muxer without tracks, add them before writing any packet.
+func NewMuxer(config Config) *Muxer {
+	if config.SegmentCount < 2 {
+		config.SegmentCount = 2
+	}
+	return &Muxer{config: config, started: time.Now(), updated: make(chan struct{})}
+}
+
+// AddVideoTrack adds an H.264 track.
+func (m *Muxer) AddVideoTrack() *Track {
+	return m.addTrack(trackConfig{video: true, timescale: 90000})
+}
+
+// AddAudioTrack adds an Opus track.
+func (m *Muxer) AddAudioTrack(channels uint16) *Track {
+	if channels == 0 {
+		channels = 2
+	}
+	return m.addTrack(trackConfig{timescale: 48000, channels: channels})
+}
+
+func (m *Muxer) addTrack(config trackConfig) *Track {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	config.id = uint32(len(m.tracks) + 1)
+	m.tracks = append(m.tracks, &muxerTrack{config: config})
+	index := len(m.tracks) - 1
+	if config.video && !m.tracks[m.leader].config.video {
+		m.leader = index
+	}
+	return newTrack(m, index, config.video, config.timescale)
+}
+
+// Ended reports whether the stream is over, the playlist then carries EXT-X-ENDLIST.
+func (m *Muxer) Ended() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ended
+}
+
+func (m *Muxer) seconds(index int, ticks uint64) float64 {
+	return float64(ticks) / float64(m.tracks[index].config.timescale)
+}
+
+// setVideoParameters records the SPS and PPS the init segment needs.
+func (m *Muxer) setVideoParameters(index int, sps, pps []byte) {
+	width, height, err := spsResolution(sps)
+	if err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	config := &m.tracks[index].config
+	config.sps, config.pps = sps, pps
+	config.width, config.height = width, height
+}
+
+// addSample places a sample on its track. Samples arrive in DTS order per track.
+func (m *Muxer) addSample(index int, s *sample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ended {
+		return
+	}
+
+	track := m.tracks[index]
+	if m.current == nil {
+		// everything before the leading track's first keyframe is useless to a player
+		if index != m.leader || !s.keyframe || !m.canStart() {
+			return
+		}
+		configs := make([]*trackConfig, len(m.tracks))
+		for i, t := range m.tracks {
+			configs[i] = &t.config
+		}
+		m.init = initSegment(configs)
+		m.current = &segment{start: s.dts}
+		m.partStart = s.dts
+	}
+
+	var lastDuration uint64
+	if track.pending != nil {
+		if s.dts <= track.pending.dts {
+			// a repeated timestamp, keep the timeline strictly increasing
+			s.dts = track.pending.dts + 1
+		}
+		lastDuration = s.dts - track.pending.dts
+		track.pending.duration = uint32(lastDuration)
+		track.ready = append(track.ready, track.pending)
+	}
+
+	if index == m.leader && track.pending != nil {
+		segmentLength := m.seconds(index, s.dts-m.current.start)
+		// cut a part when the next sample would take it over the target
+		partLength := m.seconds(index, s.dts-m.partStart+lastDuration)
+
+		if s.keyframe && segmentLength >= m.config.SegmentDuration.Seconds() {
+			m.flushPart(s.dts)
+			m.closeSegment(s.dts)
+		} else if m.config.PartDuration > 0 && partLength > m.config.PartDuration.Seconds() {
+			m.flushPart(s.dts)
+		}
+	}
+	track.pending = s
+}
+
+// canStart tells whether the init segment can be written, H.264 needs its SPS and PPS.
+func (m *Muxer) canStart() bool {
+	for _, t := range m.tracks {
+		if t.config.video && (t.config.sps == nil || t.config.pps == nil) {
+			return false
+		}
+	}
+	return true
+}
+
+// flushPart turns every ready sample into a fragment that ends at end on the leading track.
+func (m *Muxer) flushPart(end uint64) {
+	leader := m.tracks[m.leader]
+	if len(leader.ready) == 0 {
+		return
+	}
+
+	configs := make([]*trackConfig, len(m.tracks))
+	samples := make([][]*sample, len(m.tracks))
+	for i, t := range m.tracks {
+		configs[i] = &t.config
+		samples[i] = t.ready
+		t.ready = nil
+	}
+
+	m.fragments++
+	p := &part{
+		data:        fragment(m.fragments, configs, samples),
+		duration:    m.seconds(m.leader, end-m.partStart),
+		independent: samples[m.leader][0].keyframe || !leader.config.video,
+	}
+	m.current.parts = append(m.current.parts, p)
+	m.current.duration += p.duration
+	m.longestPart = math.Max(m.longestPart, p.duration)
+	m.partStart = end
+	m.notify()
+}
+
+// closeSegment completes the current segment and starts the next one at start.
+func (m *Muxer) closeSegment(start uint64) {
+	if len(m.current.parts) > 0 {
+		for _, p := range m.current.parts {
+			m.current.data = append(m.current.data, p.data...)
+		}
+		m.segments = append(m.segments, m.current)
+		if len(m.segments) > m.config.SegmentCount {
+			m.segments = m.segments[len(m.segments)-m.config.SegmentCount:]
+		}
+		m.current = &segment{sequence: m.current.sequence + 1, start: start}
+	}
+	m.notify()
+}
+
+func (m *Muxer) notify() {
+	close(m.updated)
+	m.updated = make(chan struct{})
+}
+
+// closeTrack is called when a track's source is gone. The stream ends with its leading
+// track, or with the last track standing.
+func (m *Muxer) closeTrack(index int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ended {
+		return
+	}
+
+	track := m.tracks[index]
+	track.closed = true
+	if track.pending != nil {
+		// the last sample lasts as long as the one before it
+		track.pending.duration = 1
+		if n := len(track.ready); n > 0 {
+			track.pending.duration = track.ready[n-1].duration
+		}
+		track.ready = append(track.ready, track.pending)
+	}
+
+	open := 0
+	for _, t := range m.tracks {
+		if !t.closed {
+			open++
+		}
+	}
+	if index != m.leader && open > 0 {
+		track.pending = nil
+		return
+	}
+
+	if m.current != nil && m.tracks[m.leader].pending != nil {
+		last := m.tracks[m.leader].pending
+		end := last.dts + uint64(last.duration)
+		m.flushPart(end)
+		m.closeSegment(end)
+	}
+	track.pending = nil
+	m.ended = true
+	m.notify()
+}
+
+// playlist renders the media playlist. m.mu must be held.
+func (m *Muxer) playlist() string {
+	lowLatency := m.config.PartDuration > 0
+
+	targetDuration := m.config.SegmentDuration.Seconds()
+	for _, s := range m.segments {
+		targetDuration = math.Max(targetDuration, s.duration)
+	}
+	partTarget := math.Max(m.config.PartDuration.Seconds(), m.longestPart)
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	if lowLatency {
+		b.WriteString("#EXT-X-VERSION:9\n")
+	} else {
+		b.WriteString("#EXT-X-VERSION:7\n")
+	}
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(targetDuration)))
+	mediaSequence := m.current.sequence
+	if len(m.segments) > 0 {
+		mediaSequence = m.segments[0].sequence
+	}
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", mediaSequence)
+	b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	if lowLatency {
+		fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget)
+		fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget)
+	}
+	b.WriteString("#EXT-X-MAP:URI=\"init.mp4\"\n")
+
+	for i, s := range m.segments {
+		if lowLatency && i >= len(m.segments)-lowLatencyPartSegments {
+			writeParts(&b, s)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\nseg%d.m4s\n", s.duration, s.sequence)
+	}
+
+	if m.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	} else if lowLatency {
+		writeParts(&b, m.current)
+		fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part%d.%d.m4s\"\n", m.current.sequence, len(m.current.parts))
+	}
+	return b.String()
+}
+
+func writeParts(b *strings.Builder, s *segment) {
+	for i, p := range s.parts {
+		fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.3f,URI=\"part%d.%d.m4s\"", p.duration, s.sequence, i)
+		if p.independent {
+			b.WriteString(",INDEPENDENT=YES")
+		}
+		b.WriteString("\n")
+	}
+}
+
+// segment returns a segment of the window, complete or not, or nil. m.mu must be held.
+func (m *Muxer) segment(sequence int) *segment {
+	if m.current != nil && m.current.sequence == sequence {
+		return m.current
+	}
+	for _, s := range m.segments {
+		if s.sequence == sequence {
+			return s
+		}
+	}
+	return nil
+}
+
+// hasSegment tells whether a segment is complete, or the stream is over. m.mu must be held.
+func (m *Muxer) hasSegment(sequence int) bool {
+	return m.ended || (m.current != nil && sequence < m.current.sequence)
+}
+
+// hasPart tells whether a part exists, or was skipped over because its segment is complete.
+// m.mu must be held.
+func (m *Muxer) hasPart(sequence, index int) bool {
+	if m.ended || m.current == nil {
+		return m.ended
+	}
+	if sequence < m.current.sequence {
+		return true
+	}
+	return sequence == m.current.sequence && index < len(m.current.parts)
+}
+
+// waitFor blocks until ready returns true, the timeout expires or the request goes away.
+// m.mu is held when it is called and when it returns.
+func (m *Muxer) waitFor(ctx context.Context, timeout time.Duration, ready func() bool) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for !ready() {
+		updated := m.updated
+		m.mu.Unlock()
+		select {
+		case <-updated:
+		case <-timer.C:
+			m.mu.Lock()
+			return ready()
+		case <-ctx.Done():
+			m.mu.Lock()
+			return false
+		}
+		m.mu.Lock()
+	}
+	return true
+}
+
+// ServeHTTP serves index.m3u8, init.mp4, seg<N>.m4s and part<N>.<I>.m4s, whatever the
+// path in front of them. Playlist requests with _HLS_msn (and _HLS_part) block until that
+// segment (or part) exists, and so does the part announced by the preload hint.
+func (m *Muxer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	// the body is written without m.mu, a slow viewer must not hold up the segmenter
+	body, contentType, found := m.response(r)
+	switch {
+	case !found && body != nil:
+		http.Error(w, string(body), http.StatusNotFound)
+	case !found:
+		http.NotFound(w, r)
+	default:
+		w.Header().Set("Content-Type", contentType)
+		if contentType == playlistType {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		_, _ = w.Write(body)
+	}
+}
+
+const playlistType = "application/vnd.apple.mpegurl"
+
+// response looks up the body of a request, waiting for it when it is a blocking playlist
+// or part request. found is false for a 404, with a message in body when there is one. The
+// body is the muxer's own and must not be changed.
+func (m *Muxer) response(r *http.Request) (body []byte, contentType string, found bool) {
+	name := path.Base(r.URL.Path)
+	timeout := 3 * m.config.SegmentDuration
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch {
+	case name == "index.m3u8":
+		if !m.waitFor(r.Context(), timeout, func() bool { return m.current != nil && (len(m.current.parts) > 0 || len(m.segments) > 0) }) {
+			return []byte("stream not started yet"), "", false
+		}
+		if msn, err := strconv.Atoi(r.URL.Query().Get("_HLS_msn")); err == nil {
+			// without a part the whole segment has to be complete
+			ready := func() bool { return m.hasSegment(msn) }
+			if partIndex, err := strconv.Atoi(r.URL.Query().Get("_HLS_part")); err == nil {
+				ready = func() bool { return m.hasPart(msn, partIndex) }
+			}
+			m.waitFor(r.Context(), timeout, ready)
+		}
+		return []byte(m.playlist()), playlistType, true
+
+	case name == "init.mp4":
+		return m.init, "video/mp4", m.init != nil
+
+	case strings.HasPrefix(name, "seg") && strings.HasSuffix(name, ".m4s"):
+		sequence, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "seg"), ".m4s"))
+		s := m.segment(sequence)
+		if err != nil || s == nil || s == m.current {
+			return nil, "", false
+		}
+		return s.data, "video/mp4", true
+
+	case strings.HasPrefix(name, "part") && strings.HasSuffix(name, ".m4s"):
+		var sequence, index int
+		if _, err := fmt.Sscanf(name, "part%d.%d.m4s", &sequence, &index); err != nil {
+			return nil, "", false
+		}
+		m.waitFor(r.Context(), timeout, func() bool { return m.hasPart(sequence, index) })
+		s := m.segment(sequence)
+		if s == nil || index >= len(s.parts) {
+			return nil, "", false
+		}
+		return s.parts[index].data, "video/mp4", true
+	}
+	return nil, "", false
+}
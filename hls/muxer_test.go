@@ -0,0 +1,270 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const frameTicks = 3000 // 30 fps at 90kHz
+
+// newVideoMuxer returns a muxer with one video track whose parameter sets are known, so it
+// starts on the first keyframe.
+func newVideoMuxer(config Config) *Muxer {
+	m := NewMuxer(config)
+	m.AddVideoTrack()
+	m.tracks[0].config.sps = []byte{0x67, 0x42, 0xc0, 0x1e}
+	m.tracks[0].config.pps = []byte{0x68, 0xce, 0x3c, 0x80}
+	return m
+}
+
+// writeFrames adds the frames first to last-1, every keyframeEvery'th one a keyframe.
+func writeFrames(m *Muxer, first, last, keyframeEvery int) {
+	for i := first; i < last; i++ {
+		m.addSample(0, &sample{data: []byte{0, 0, 0, 1, 0x65}, dts: uint64(i * frameTicks), keyframe: i%keyframeEvery == 0})
+	}
+}
+
+func TestMuxerSegments(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        Config
+		keyframeEvery int
+		frames        int
+		wantDurations []float64 // of the complete segments, in seconds
+		wantParts     int       // parts of every complete segment
+	}{
+		{
+			name:          "cut on the first keyframe after the target",
+			config:        Config{SegmentDuration: time.Second, SegmentCount: 6},
+			keyframeEvery: 15,
+			frames:        91,
+			wantDurations: []float64{1, 1, 1},
+			wantParts:     1,
+		},
+		{
+			name:          "long keyframe interval makes long segments",
+			config:        Config{SegmentDuration: time.Second, SegmentCount: 6},
+			keyframeEvery: 40,
+			frames:        81,
+			wantDurations: []float64{40.0 / 30, 40.0 / 30},
+			wantParts:     1,
+		},
+		{
+			name:          "window keeps the last segments",
+			config:        Config{SegmentDuration: time.Second, SegmentCount: 2},
+			keyframeEvery: 30,
+			frames:        151,
+			wantDurations: []float64{1, 1},
+			wantParts:     1,
+		},
+		{
+			name:          "parts are cut before they exceed the target",
+			config:        Config{SegmentDuration: time.Second, PartDuration: 200 * time.Millisecond, SegmentCount: 6},
+			keyframeEvery: 30,
+			frames:        61,
+			wantDurations: []float64{1, 1},
+			wantParts:     5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newVideoMuxer(tt.config)
+			writeFrames(m, 0, tt.frames, tt.keyframeEvery)
+
+			if len(m.segments) != len(tt.wantDurations) {
+				t.Fatalf("%d segments, want %d", len(m.segments), len(tt.wantDurations))
+			}
+			for i, s := range m.segments {
+				if math.Abs(s.duration-tt.wantDurations[i]) > 1e-9 {
+					t.Errorf("segment %d lasts %.3fs, want %.3fs", s.sequence, s.duration, tt.wantDurations[i])
+				}
+				if len(s.parts) != tt.wantParts {
+					t.Errorf("segment %d has %d parts, want %d", s.sequence, len(s.parts), tt.wantParts)
+				}
+				for j, p := range s.parts {
+					if p.independent != (j == 0) {
+						t.Errorf("segment %d part %d independent = %v", s.sequence, j, p.independent)
+					}
+				}
+				if want := joinedParts(s); string(s.data) != string(want) {
+					t.Errorf("segment %d data isn't its parts", s.sequence)
+				}
+			}
+		})
+	}
+}
+
+func joinedParts(s *segment) []byte {
+	var data []byte
+	for _, p := range s.parts {
+		data = append(data, p.data...)
+	}
+	return data
+}
+
+func TestMuxerPlaylist(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		end     bool
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "regular",
+			config:  Config{SegmentDuration: time.Second, SegmentCount: 2},
+			want:    []string{"#EXT-X-VERSION:7", "#EXT-X-MEDIA-SEQUENCE:1\n", "#EXTINF:1.000,\nseg1.m4s", "seg2.m4s", "#EXT-X-MAP:URI=\"init.mp4\""},
+			notWant: []string{"seg0.m4s", "seg3.m4s", "#EXT-X-PART", "#EXT-X-ENDLIST"},
+		},
+		{
+			name:   "low latency",
+			config: Config{SegmentDuration: time.Second, PartDuration: 200 * time.Millisecond, SegmentCount: 6},
+			want: []string{"#EXT-X-VERSION:9", "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES", "#EXT-X-PART-INF:PART-TARGET=0.200",
+				`#EXT-X-PART:DURATION=0.200,URI="part0.0.m4s",INDEPENDENT=YES`, `URI="part0.1.m4s"` + "\n",
+				`#EXT-X-PRELOAD-HINT:TYPE=PART,URI="part3.0.m4s"`},
+		},
+		{
+			name:    "ended",
+			config:  Config{SegmentDuration: time.Second, PartDuration: 200 * time.Millisecond, SegmentCount: 6},
+			end:     true,
+			want:    []string{"seg3.m4s", "#EXT-X-ENDLIST"},
+			notWant: []string{"#EXT-X-PRELOAD-HINT"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newVideoMuxer(tt.config)
+			writeFrames(m, 0, 91, 30)
+			if tt.end {
+				m.closeTrack(0)
+			}
+
+			body, status := get(t, m, "/hls/room/index.m3u8")
+			if status != http.StatusOK {
+				t.Fatalf("status %d", status)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("playlist lacks %q:\n%s", want, body)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(body, notWant) {
+					t.Errorf("playlist has %q:\n%s", notWant, body)
+				}
+			}
+		})
+	}
+}
+
+func TestMuxerFiles(t *testing.T) {
+	m := newVideoMuxer(Config{SegmentDuration: time.Second, PartDuration: 200 * time.Millisecond, SegmentCount: 2})
+	writeFrames(m, 0, 91, 30)
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		want       []byte
+	}{
+		{path: "init.mp4", wantStatus: http.StatusOK, want: m.init},
+		{path: "seg2.m4s", wantStatus: http.StatusOK, want: m.segments[1].data},
+		{path: "seg0.m4s", wantStatus: http.StatusNotFound},    // out of the window
+		{path: "seg3.m4s", wantStatus: http.StatusNotFound},    // still being filled
+		{path: "part3.0.m4s", wantStatus: http.StatusNotFound}, // nothing of it yet, the request timed out
+		{path: "part2.4.m4s", wantStatus: http.StatusOK, want: m.segments[1].parts[4].data},
+		{path: "part2.5.m4s", wantStatus: http.StatusNotFound},
+		{path: "other.ts", wantStatus: http.StatusNotFound},
+	}
+	m.config.SegmentDuration = 10 * time.Millisecond // blocking requests time out quickly
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			body, status := get(t, m, "/hls/room/"+tt.path)
+			if status != tt.wantStatus {
+				t.Fatalf("status %d, want %d", status, tt.wantStatus)
+			}
+			if tt.want != nil && body != string(tt.want) {
+				t.Errorf("got %d bytes, want %d", len(body), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestMuxerBlockingReload(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		until int    // frames written before the request can be answered
+		want  string // in the answer
+	}{
+		{name: "whole segment", query: "_HLS_msn=1", until: 61, want: "seg1.m4s"},
+		{name: "part", query: "_HLS_msn=1&_HLS_part=2", until: 49, want: `part1.2.m4s`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newVideoMuxer(Config{SegmentDuration: time.Second, PartDuration: 200 * time.Millisecond, SegmentCount: 6})
+			writeFrames(m, 0, 31, 30)
+
+			answered := make(chan string, 1)
+			go func() {
+				body, _ := get(t, m, "/hls/room/index.m3u8?"+tt.query)
+				answered <- body
+			}()
+
+			// half the frames don't get there yet
+			writeFrames(m, 31, 31+(tt.until-31)/2, 30)
+			select {
+			case body := <-answered:
+				t.Fatalf("answered before %s existed:\n%s", tt.want, body)
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			writeFrames(m, 31+(tt.until-31)/2, tt.until, 30)
+			select {
+			case body := <-answered:
+				if !strings.Contains(body, tt.want) {
+					t.Errorf("playlist lacks %q:\n%s", tt.want, body)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("still blocked")
+			}
+		})
+	}
+}
+
+func TestMuxerRequestGoesAway(t *testing.T) {
+	m := newVideoMuxer(Config{SegmentDuration: time.Minute, SegmentCount: 6})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r := httptest.NewRequest(http.MethodGet, "/hls/room/index.m3u8", nil).WithContext(ctx)
+		m.ServeHTTP(httptest.NewRecorder(), r)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("request still waits for the stream")
+	}
+}
+
+func get(t *testing.T, m *Muxer, target string) (string, int) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	body, err := io.ReadAll(w.Result().Body)
+	if err != nil {
+		panic(fmt.Sprint("reading the response: ", err))
+	}
+	return string(body), w.Code
+}
@@ -0,0 +1,169 @@
+package hls
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/samyak112/monoport/recorder"
+)
+
+// Track feeds the RTP packets of one H.264 or Opus track into its Muxer. Packets are put
+// back in order, video is assembled into frames, and RTP timestamps are placed on the
+// muxer's timeline so tracks from different sources line up by arrival time.
+type Track struct {
+	muxer     *Muxer
+	index     int
+	video     bool
+	timescale uint32
+
+	mu     sync.Mutex
+	jitter *recorder.JitterBuffer
+	closed bool
+
+	// video frame assembly, the way the recorder does it
+	depacketizer *codecs.H264Packet
+	frame        []byte
+	frameTS      uint32
+	inFrame      bool
+	broken       bool // the frame being assembled lost a packet
+	waitKeyframe bool
+
+	// timeline
+	started bool
+	offset  uint64 // DTS of the first sample, from its arrival time
+	lastTS  uint32
+	elapsed uint64 // RTP ticks since the first sample, unwrapped
+}
+
+func newTrack(muxer *Muxer, index int, video bool, timescale uint32) *Track {
+	return &Track{
+		muxer:        muxer,
+		index:        index,
+		video:        video,
+		timescale:    timescale,
+		jitter:       recorder.NewJitterBuffer(),
+		depacketizer: &codecs.H264Packet{IsAVC: true},
+		waitKeyframe: true,
+	}
+}
+
+// WriteRTP takes a forwarded packet, keyframe tells whether it starts a keyframe.
+func (t *Track) WriteRTP(pkt *rtp.Packet, keyframe bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	for _, p := range t.jitter.Push(pkt, keyframe) {
+		t.writePacket(p)
+	}
+}
+
+// Close drains the packets still held back and tells the muxer the track is over.
+func (t *Track) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	for _, p := range t.jitter.Flush() {
+		t.writePacket(p)
+	}
+	t.closed = true
+	t.muxer.closeTrack(t.index)
+	return nil
+}
+
+func (t *Track) writePacket(p recorder.BufferedPacket) {
+	if !t.video {
+		// an Opus packet is a sample of its own, a lost one just plays back as silence
+		if len(p.Packet.Payload) > 0 {
+			t.writeSample(append([]byte(nil), p.Packet.Payload...), p.Packet.Timestamp, true)
+		}
+		return
+	}
+
+	if p.Lost > 0 {
+		t.waitKeyframe = true
+		t.broken = true
+		t.depacketizer = &codecs.H264Packet{IsAVC: true}
+	}
+
+	if t.inFrame && p.Packet.Timestamp != t.frameTS {
+		// the previous frame never saw its marker, its last packet must be gone
+		t.inFrame = false
+		t.waitKeyframe = true
+	}
+	if !t.inFrame {
+		if t.waitKeyframe && !p.Keyframe {
+			return
+		}
+		t.waitKeyframe = false
+		t.inFrame = true
+		t.broken = false
+		t.frame = nil
+		t.frameTS = p.Packet.Timestamp
+	}
+
+	data, err := t.depacketizer.Unmarshal(p.Packet.Payload)
+	if err != nil {
+		t.broken = true
+	}
+	t.frame = append(t.frame, data...)
+
+	if !p.Packet.Marker {
+		return
+	}
+	t.inFrame = false
+	if t.broken || len(t.frame) == 0 {
+		t.waitKeyframe = true
+		return
+	}
+	t.writeFrame(t.frame)
+}
+
+// writeFrame strips the parameter sets out of a frame, they go in the init segment, and
+// hands the rest to the muxer.
+func (t *Track) writeFrame(frame []byte) {
+	var sps, pps []byte
+	var sample []byte
+	keyframe := false
+	for _, nalu := range avccNALUs(frame) {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case nalTypeSPS:
+			sps = append([]byte(nil), nalu...)
+			continue
+		case nalTypePPS:
+			pps = append([]byte(nil), nalu...)
+			continue
+		case nalTypeIDR:
+			keyframe = true
+		}
+		sample = append(sample, byte(len(nalu)>>24), byte(len(nalu)>>16), byte(len(nalu)>>8), byte(len(nalu)))
+		sample = append(sample, nalu...)
+	}
+	if sps != nil && pps != nil {
+		t.muxer.setVideoParameters(t.index, sps, pps)
+	}
+	if len(sample) > 0 {
+		t.writeSample(sample, t.frameTS, keyframe)
+	}
+}
+
+// writeSample places a sample on the muxer's timeline: the first one by how long after the
+// muxer's creation it arrived, the following ones by their RTP timestamp distance.
+func (t *Track) writeSample(data []byte, timestamp uint32, keyframe bool) {
+	if !t.started {
+		t.started = true
+		t.offset = uint64(time.Since(t.muxer.started).Seconds() * float64(t.timescale))
+	} else if delta := int32(timestamp - t.lastTS); delta > 0 {
+		t.elapsed += uint64(delta)
+	}
+	t.lastTS = timestamp
+	t.muxer.addSample(t.index, &sample{data: data, dts: t.offset + t.elapsed, keyframe: keyframe})
+}
@@ -2,20 +2,53 @@ package logger
 
 import (
 	"fmt"
+	"github.com/pion/logging"
 	"log"
 )
 
 // SimpleLogger implements LeveledLogger by printing to standard log
-type SimpleLogger struct{}
+type SimpleLogger struct {
+	// Level is the most verbose level printed, the zero value prints nothing
+	Level logging.LogLevel
+}
+
+// Factory hands out SimpleLoggers to every pion component, so they all log at one level.
+type Factory struct {
+	Level logging.LogLevel
+}
+
+// NewLogger implements logging.LoggerFactory.
+func (f Factory) NewLogger(scope string) logging.LeveledLogger {
+	return &SimpleLogger{Level: f.Level}
+}
+
+var levels = map[string]logging.LogLevel{
+	"ERROR": logging.LogLevelError,
+	"WARN":  logging.LogLevelWarn,
+	"INFO":  logging.LogLevelInfo,
+	"DEBUG": logging.LogLevelDebug,
+	"TRACE": logging.LogLevelTrace,
+}
+
+// enabled tells whether messages of a level are printed
+func (l *SimpleLogger) enabled(level string) bool {
+	return levels[level] <= l.Level
+}
 
 // helper to print message with prefix + static message appended
 func (l *SimpleLogger) log(level, msg string) {
+	if !l.enabled(level) {
+		return
+	}
 	staticMsg := " [this is from custom logger]"
 	log.Printf("[%s] %s%s", level, msg, staticMsg)
 }
 
 // helper to print formatted message with prefix + static message appended
 func (l *SimpleLogger) logf(level, format string, args ...interface{}) {
+	if !l.enabled(level) {
+		return
+	}
 	// Format the original message
 	msg := fmt.Sprintf(format, args...)
 	// Append static message
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+	"github.com/samyak112/monoport/auth"
+	"github.com/samyak112/monoport/config"
+	"github.com/samyak112/monoport/logger"
+	"github.com/samyak112/monoport/metrics"
+	"github.com/samyak112/monoport/publicip"
 	"github.com/samyak112/monoport/sfu"
 	"github.com/samyak112/monoport/signaling"
 	"github.com/samyak112/monoport/transport"
 	"log"
 	"net"
 	"net/http"
+	"os"
 )
 
 func main() {
@@ -15,14 +25,31 @@ func main() {
 	If they weren’t pointers, we’d end up with copies, and each one would have its own mutex,
 	which means locking wouldn’t work properly — they’d all be locking different instances. */
 
-	packetChannel := make(chan transport.PacketInfo, 1024)
-	signalingChannel := make(chan *transport.SignalMessage, 5)
+	// defaults, then the YAML file, then environment variables, then flags
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+
+	packetChannel := make(chan transport.PacketInfo, cfg.Channels.Packets)
+	signalingChannel := make(chan *transport.SignalMessage, cfg.Channels.Signaling)
 
-	// returns a *net.UDPAddr struct representing the UDP network address, using the network type and address
-	udpAddr, _ := net.ResolveUDPAddr("udp", ":5000")
+	// returns a *net.UDPAddr struct representing the UDP network address, using the network type and address.
+	// with udp4 and udp6 enabled the network is "udp", a wildcard address then gives one dual-stack
+	// socket and IPv4 peers show up on it as IPv4-mapped IPv6 addresses
+	udpAddr, err := net.ResolveUDPAddr(cfg.UDPNetwork(), cfg.UDP.Listen)
+	if err != nil {
+		log.Fatal("Invalid UDP address: ", err)
+	}
 
 	// using udpAddr to bind the UDP socket or send packets to the given address.
-	udpConn, _ := net.ListenUDP("udp", udpAddr)
+	udpConn, err := net.ListenUDP(cfg.UDPNetwork(), udpAddr)
+	if err != nil {
+		log.Fatal("Failed to listen on UDP: ", err)
+	}
 
 	// custom implementation of net.Packetconn so that i can channel the packets back to the main thread
 	// instead of pion having the full access of the port
@@ -33,7 +60,51 @@ func main() {
 	// this is done so that I can multiplex my stun server and sfu server
 	// and channel packets from pion which were meant for my stun server
 	// back to the stun server
-	webRtcApi, iceUDPMux := sfu_server.CreateCustomUDPWebRTCAPI(myConn)
+	pionLogLevel, _ := cfg.Log.PionLevel() // validated by config.Load
+
+	// without announced IPs the public IP is discovered, so the host candidates and the
+	// stun: URL of our own STUN server point at an address clients can reach
+	var discovery []publicip.Source
+	if len(cfg.ICE.AnnouncedIPs) == 0 && cfg.ICE.PublicIP.Discover {
+		discovery = publicIPSources(cfg)
+		ip, source, err := publicip.Discover(context.Background(), discovery)
+		if err != nil {
+			log.Println("Announcing the addresses of the interfaces:", err)
+		} else {
+			log.Printf("Discovered public IP %s (found by %s)", ip, source)
+			cfg.ICE.AnnouncedIPs = []string{ip.String()}
+		}
+	}
+
+	// NACK, RTCP reports, TWCC and bandwidth estimation come from the config, custom interceptors can be added to it
+	apiConfig := sfu_server.DefaultAPIConfig()
+	apiConfig.Interceptors = cfg.Interceptors.InterceptorConfig()
+	apiConfig.AnnouncedIPs = cfg.ICE.AnnouncedIPs
+	apiConfig.NetworkTypes = cfg.WebRTCNetworkTypes()
+	apiConfig.Codecs = cfg.Codecs
+	apiConfig.LogLevel = pionLogLevel
+
+	// the HTTP listener is opened this early because ICE-TCP may share it, connections
+	// starting with a framed STUN request are then handed to pion's TCP mux instead
+	httpListener, err := net.Listen("tcp", cfg.HTTP.Listen)
+	if err != nil {
+		log.Fatal("Failed to listen on HTTP: ", err)
+	}
+	if cfg.ICETCP() {
+		var iceTCPListener net.Listener
+		if cfg.ICE.TCPListen == "" {
+			demux := transport.NewTCPDemux(httpListener)
+			httpListener, iceTCPListener = demux.HTTP(), demux.ICE()
+		} else if iceTCPListener, err = net.Listen("tcp", cfg.ICE.TCPListen); err != nil {
+			log.Fatal("Failed to listen on ICE-TCP: ", err)
+		}
+		apiConfig.TCPMux = webrtc.NewICETCPMux(&logger.SimpleLogger{Level: pionLogLevel}, iceTCPListener, 8)
+		log.Println("ICE-TCP on", iceTCPListener.Addr())
+	}
+	webRtcApi, iceUDPMux, err := sfu_server.CreateCustomUDPWebRTCAPI(myConn, apiConfig)
+	if err != nil {
+		log.Fatal("Failed to create WebRTC API: ", err)
+	}
 
 	//passing same signalingChannel in both sfu and signaling struct creation
 	// so that i can send sdp offers and answers and ice candidates information to the channel from one struct and it can be
@@ -42,11 +113,59 @@ func main() {
 
 	// initializing an instance of SFU
 	sfu := sfu_server.NewSFU(webRtcApi, signalingChannel)
+	sfu.EnableBandwidthEstimation(apiConfig.Interceptors.BandwidthEstimation)
+	sfu.SetICEServers(cfg.WebRTCICEServers())
+
+	// the announced IP is baked into the API, PeerConnections created after a change get
+	// one built for the new address while existing ones keep their candidates
+	if discovery != nil && cfg.ICE.PublicIP.Interval > 0 {
+		var current net.IP
+		if len(cfg.ICE.AnnouncedIPs) > 0 {
+			current = net.ParseIP(cfg.ICE.AnnouncedIPs[0])
+		}
+		go publicip.Watch(context.Background(), discovery, cfg.ICE.PublicIP.Interval, current, func(ip net.IP) {
+			cfg.ICE.AnnouncedIPs = []string{ip.String()}
+			apiConfig.AnnouncedIPs = cfg.ICE.AnnouncedIPs
+			api, err := sfu_server.NewWebRTCAPI(iceUDPMux, apiConfig)
+			if err != nil {
+				log.Println("Failed to rebuild the WebRTC API for the new public IP:", err)
+				return
+			}
+			sfu.SetAPI(api)
+			sfu.SetICEServers(cfg.WebRTCICEServers())
+		})
+	}
+
+	if cfg.Recording.Dir != "" {
+		sfu.SetRecordingDir(cfg.Recording.Dir)
+	}
+	if err := sfu.SetRecordingLimit(cfg.Recording.Max); err != nil {
+		log.Fatal(err)
+	}
+	if err := sfu.SetRTPIngestPorts(cfg.RTPIngest.PortMin, cfg.RTPIngest.PortMax); err != nil {
+		log.Fatal(err)
+	}
+	if err := sfu.SetRTPIngestLimit(cfg.RTPIngest.Max); err != nil {
+		log.Fatal(err)
+	}
+
+	// access tokens of /sdp websockets are verified with an HMAC secret or a JWKS file
+	verifier, err := auth.NewVerifier(cfg.Auth.JWTSecret, cfg.Auth.JWKSFile)
+	if err != nil {
+		log.Fatal("Failed to load the access token keys: ", err)
+	}
+	if verifier == nil {
+		log.Println("No access token keys are configured, /sdp websockets are not authenticated")
+	} else {
+		sfu.RequireAuthorization()
+	}
 
 	signaling := &ws.Signal{
 		PeerMap:           make(map[string]*websocket.Conn),
 		UfragMap:          make(map[string]*websocket.Conn),
 		SignalChannelRecv: signalingChannel,
+		Verifier:          verifier,
+		AllowedOrigins:    cfg.HTTP.AllowedOrigins,
 	}
 
 	// running this function here because this is the function which will act as the receiving end
@@ -69,19 +188,115 @@ func main() {
 		ws.HandleSDP(w, r, sfu, signaling)
 	})
 
+	// WHIP ingest, encoders like OBS publish into a room over plain HTTP
+	http.HandleFunc("POST /whip", func(w http.ResponseWriter, r *http.Request) {
+		ws.HandleWHIP(w, r, sfu, signaling)
+	})
+	http.HandleFunc("POST /whip/{room}", func(w http.ResponseWriter, r *http.Request) {
+		ws.HandleWHIP(w, r, sfu, signaling)
+	})
+	http.HandleFunc("DELETE "+ws.WHIPResourcePath+"{id}", func(w http.ResponseWriter, r *http.Request) {
+		ws.HandleWHIPResource(w, r, sfu, signaling)
+	})
+	http.HandleFunc("PATCH "+ws.WHIPResourcePath+"{id}", func(w http.ResponseWriter, r *http.Request) {
+		ws.HandleWHIPResource(w, r, sfu, signaling)
+	})
+	http.HandleFunc("OPTIONS /whip", ws.HandleCORSPreflight)
+	http.HandleFunc("OPTIONS /whip/", ws.HandleCORSPreflight)
+
+	// WHEP playback, players pull a room's tracks over plain HTTP
+	http.HandleFunc("POST /whep", func(w http.ResponseWriter, r *http.Request) {
+		ws.HandleWHEP(w, r, sfu, signaling)
+	})
+	http.HandleFunc("POST /whep/{room}", func(w http.ResponseWriter, r *http.Request) {
+		ws.HandleWHEP(w, r, sfu, signaling)
+	})
+	http.HandleFunc("DELETE "+ws.WHEPResourcePath+"{id}", func(w http.ResponseWriter, r *http.Request) {
+		ws.HandleWHEPResource(w, r, sfu, signaling)
+	})
+	http.HandleFunc("PATCH "+ws.WHEPResourcePath+"{id}", func(w http.ResponseWriter, r *http.Request) {
+		ws.HandleWHEPResource(w, r, sfu, signaling)
+	})
+	http.HandleFunc("OPTIONS /whep", ws.HandleCORSPreflight)
+	http.HandleFunc("OPTIONS /whep/", ws.HandleCORSPreflight)
+
+	// HLS output, viewers play /hls/{room}/index.m3u8 with any HLS player. Streams are
+	// started and stopped through the admin API
+	http.HandleFunc("GET /hls/{room}/{file}", func(w http.ResponseWriter, r *http.Request) {
+		ws.HandleHLS(w, r, sfu)
+	})
+
+	// admin API, only served when a bearer token is configured
+	if adminToken := cfg.Auth.AdminToken; adminToken != "" {
+		admin := func(handler func(http.ResponseWriter, *http.Request, *sfu_server.SFU)) http.HandlerFunc {
+			return ws.RequireBearerToken(adminToken, func(w http.ResponseWriter, r *http.Request) {
+				handler(w, r, sfu)
+			})
+		}
+		http.HandleFunc("GET /admin/rooms", admin(ws.HandleAdminRooms))
+		http.HandleFunc("GET /admin/rooms/{room}", admin(ws.HandleAdminRoom))
+		http.HandleFunc("DELETE /admin/rooms/{room}", admin(ws.HandleAdminRoom))
+		http.HandleFunc("GET /admin/peers", admin(ws.HandleAdminPeers))
+		http.HandleFunc("GET /admin/peers/{peer}", admin(ws.HandleAdminPeer))
+		http.HandleFunc("DELETE /admin/peers/{peer}", admin(ws.HandleAdminPeer))
+		http.HandleFunc("GET /admin/tracks", admin(ws.HandleAdminTracks))
+		http.HandleFunc("DELETE /admin/tracks/{track}", admin(ws.HandleAdminTrack))
+		http.HandleFunc("POST /admin/tracks/{track}/mute", admin(ws.HandleAdminMuteTrack))
+		http.HandleFunc("POST /admin/tracks/{track}/unmute", admin(ws.HandleAdminMuteTrack))
+		http.HandleFunc("PUT /admin/rooms/{room}/bans/{peer}", admin(ws.HandleAdminBan))
+		http.HandleFunc("DELETE /admin/rooms/{room}/bans/{peer}", admin(ws.HandleAdminBan))
+		http.HandleFunc("PUT /admin/peers/{peer}/moderator", admin(ws.HandleAdminModerator))
+		http.HandleFunc("DELETE /admin/peers/{peer}/moderator", admin(ws.HandleAdminModerator))
+
+		// plain RTP ingest, ffmpeg or GStreamer send unencrypted RTP to the port this hands
+		// out. The port takes RTP from anyone, so only admins hand them out
+		http.HandleFunc("POST /rtp-ingest", admin(ws.HandleStartRTPIngest))
+		http.HandleFunc("POST /rtp-ingest/{room}", admin(ws.HandleStartRTPIngest))
+		http.HandleFunc("DELETE /rtp-ingest/{id}", admin(ws.HandleStopRTPIngest))
+
+		// HLS streams of a room, playback stays public
+		http.HandleFunc("POST /hls/{room}", admin(ws.HandleStartHLS))
+		http.HandleFunc("DELETE /hls/{room}", admin(ws.HandleStopHLS))
+
+		// per stream statistics with a one minute history, they name every peer and track
+		// so they are for admins only
+		http.HandleFunc("GET /stats", admin(ws.HandleStats))
+		http.HandleFunc("GET /stats/peers/{peer}", admin(ws.HandleStats))
+		http.HandleFunc("GET /stats/tracks/{track}", admin(ws.HandleStats))
+	} else {
+		log.Println("No admin token is configured, the admin API, plain RTP ingest, starting HLS streams and statistics are off")
+	}
+
+	// STUN and TURN servers for the client's RTCConfiguration
+	http.HandleFunc("GET /ice-servers", func(w http.ResponseWriter, r *http.Request) {
+		ws.HandleICEServers(w, r, sfu)
+	})
+
+	// Prometheus metrics
+	http.Handle("GET /metrics", metrics.Handler())
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain")
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("OK\n"))
 	})
 
-	log.Println("Listening on :8000")
-	http.ListenAndServe("0.0.0.0:8000", nil)
+	log.Println("Listening on", httpListener.Addr())
+	if err := http.Serve(httpListener, nil); err != nil {
+		log.Fatal(err)
+	}
 
 }
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+// publicIPSources returns the sources the public IP is discovered with, in the order they
+// are tried.
+func publicIPSources(cfg *config.Config) []publicip.Source {
+	sources := []publicip.Source{publicip.Interfaces()}
+	if cfg.ICE.PublicIP.CloudMetadata {
+		sources = append(sources, publicip.CloudMetadata(publicip.MetadataClient())...)
+	}
+	for _, uri := range cfg.PublicIPSTUNServers() {
+		sources = append(sources, publicip.STUN(uri))
+	}
+	return sources
 }
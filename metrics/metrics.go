@@ -0,0 +1,174 @@
+// Package metrics exposes counters and gauges in the Prometheus text format (version 0.0.4).
+// It only covers what monoport needs: counters with at most one label, and gauges whose
+// values are read when /metrics is scraped.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// collector is a metric family the registry can write out.
+type collector interface {
+	name() string
+	write(w io.Writer)
+}
+
+var (
+	registryLock sync.Mutex
+	registry     = make(map[string]collector)
+)
+
+// register adds a family to the registry, a family registered again under the same name
+// replaces the previous one.
+func register(c collector) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry[c.name()] = c
+}
+
+func writeHeader(w io.Writer, name, help, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func formatLabel(label, value string) string {
+	if label == "" {
+		return ""
+	}
+	return "{" + label + "=" + strconv.Quote(value) + "}"
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	v atomic.Uint64
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() { c.v.Add(1) }
+
+// Add adds n to the counter.
+func (c *Counter) Add(n uint64) { c.v.Add(n) }
+
+// CounterVec is a family of counters split by one label.
+type CounterVec struct {
+	metricName string
+	help       string
+	label      string
+
+	mu       sync.RWMutex
+	counters map[string]*Counter
+}
+
+// NewCounter registers a counter without labels.
+func NewCounter(name, help string) *Counter {
+	return NewCounterVec(name, help, "").With("")
+}
+
+// NewCounterVec registers a family of counters, label is the name of the label that tells
+// them apart.
+func NewCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{metricName: name, help: help, label: label, counters: make(map[string]*Counter)}
+	register(c)
+	return c
+}
+
+// With returns the counter for a label value, creating it on first use.
+func (c *CounterVec) With(value string) *Counter {
+	c.mu.RLock()
+	counter, ok := c.counters[value]
+	c.mu.RUnlock()
+	if ok {
+		return counter
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if counter, ok = c.counters[value]; !ok {
+		counter = &Counter{}
+		c.counters[value] = counter
+	}
+	return counter
+}
+
+func (c *CounterVec) name() string { return c.metricName }
+
+func (c *CounterVec) write(w io.Writer) {
+	writeHeader(w, c.metricName, c.help, "counter")
+	c.mu.RLock()
+	values := make([]string, 0, len(c.counters))
+	for value := range c.counters {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s%s %d\n", c.metricName, formatLabel(c.label, value), c.counters[value].v.Load())
+	}
+	c.mu.RUnlock()
+}
+
+// gaugeFunc is a family of gauges read by a callback at scrape time.
+type gaugeFunc struct {
+	metricName string
+	help       string
+	label      string
+	values     func() map[string]float64
+}
+
+// NewGaugeFunc registers a gauge whose value is read from value at scrape time.
+func NewGaugeFunc(name, help string, value func() float64) {
+	register(&gaugeFunc{metricName: name, help: help, values: func() map[string]float64 {
+		return map[string]float64{"": value()}
+	}})
+}
+
+// NewGaugeVecFunc registers a family of gauges split by one label, values returns the
+// value of every label value at scrape time.
+func NewGaugeVecFunc(name, help, label string, values func() map[string]float64) {
+	register(&gaugeFunc{metricName: name, help: help, label: label, values: values})
+}
+
+func (g *gaugeFunc) name() string { return g.metricName }
+
+func (g *gaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.metricName, g.help, "gauge")
+	values := g.values()
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", g.metricName, formatLabel(g.label, key), strconv.FormatFloat(values[key], 'g', -1, 64))
+	}
+}
+
+// WriteTo writes every registered family, sorted by name.
+func WriteTo(w io.Writer) {
+	registryLock.Lock()
+	collectors := make([]collector, 0, len(registry))
+	for _, c := range registry {
+		collectors = append(collectors, c)
+	}
+	registryLock.Unlock()
+
+	sort.Slice(collectors, func(i, j int) bool { return collectors[i].name() < collectors[j].name() })
+	var b strings.Builder
+	for _, c := range collectors {
+		c.write(&b)
+	}
+	_, _ = io.WriteString(w, b.String())
+}
+
+// Handler serves the registered metrics to Prometheus.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteTo(w)
+	})
+}
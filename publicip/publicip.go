@@ -0,0 +1,96 @@
+// Package publicip finds the public IPv4 address of the host monoport runs on, so it can be
+// announced in ICE candidates without being configured. Sources are tried in order: an
+// address on one of the host's interfaces, cloud metadata endpoints, then STUN servers.
+package publicip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// lookupTimeout bounds every source, metadata endpoints of other clouds just never answer.
+const lookupTimeout = 2 * time.Second
+
+// ErrNotFound is returned when no source found a public address.
+var ErrNotFound = errors.New("no public IP found")
+
+// Source is one way of finding the public IPv4 address of the host.
+type Source interface {
+	Name() string
+	Lookup(ctx context.Context) (net.IP, error)
+}
+
+// Discover asks every source in order and returns the first public address found, along
+// with the name of the source that found it.
+func Discover(ctx context.Context, sources []Source) (net.IP, string, error) {
+	var errs []error
+	for _, source := range sources {
+		lookupCtx, cancel := context.WithTimeout(ctx, lookupTimeout)
+		ip, err := source.Lookup(lookupCtx)
+		cancel()
+		if err == nil && !isPublic(ip) {
+			err = fmt.Errorf("%s is not a public IPv4 address", ip)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", source.Name(), err))
+			continue
+		}
+		return ip.To4(), source.Name(), nil
+	}
+	return nil, "", fmt.Errorf("%w: %w", ErrNotFound, errors.Join(errs...))
+}
+
+// Watch runs Discover every interval until ctx is done and calls onChange when the address
+// differs from current. A round in which no source answers keeps the last address.
+func Watch(ctx context.Context, sources []Source, interval time.Duration, current net.IP, onChange func(net.IP)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ip, source, err := Discover(ctx, sources)
+		if err != nil {
+			log.Printf("Public IP check failed, keeping %s: %v", current, err)
+			continue
+		}
+		if ip.Equal(current) {
+			continue
+		}
+		log.Printf("Public IP changed from %s to %s (found by %s)", current, ip, source)
+		current = ip
+		onChange(ip)
+	}
+}
+
+// isPublic reports whether ip is an IPv4 address reachable from the internet.
+func isPublic(ip net.IP) bool {
+	ip = ip.To4()
+	if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, block := range nonPublicBlocks {
+		if block.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// nonPublicBlocks are ranges net.IP.IsPrivate doesn't cover but that are never routed on
+// the internet: carrier-grade NAT (RFC 6598), benchmarking (RFC 2544) and documentation
+// (RFC 5737).
+var nonPublicBlocks = []*net.IPNet{
+	{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)},
+	{IP: net.IPv4(198, 18, 0, 0), Mask: net.CIDRMask(15, 32)},
+	{IP: net.IPv4(192, 0, 2, 0), Mask: net.CIDRMask(24, 32)},
+	{IP: net.IPv4(198, 51, 100, 0), Mask: net.CIDRMask(24, 32)},
+	{IP: net.IPv4(203, 0, 113, 0), Mask: net.CIDRMask(24, 32)},
+}
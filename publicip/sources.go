@@ -0,0 +1,202 @@
+package publicip
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+// interfaceSource finds a public address assigned to one of the host's interfaces, which
+// is the case on bare metal and on clouds without 1:1 NAT.
+type interfaceSource struct {
+	addrs func() ([]net.Addr, error)
+}
+
+// Interfaces returns a Source that scans the host's interfaces.
+func Interfaces() Source {
+	return interfaceSource{addrs: net.InterfaceAddrs}
+}
+
+func (interfaceSource) Name() string { return "interfaces" }
+
+func (s interfaceSource) Lookup(ctx context.Context) (net.IP, error) {
+	addrs, err := s.addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && isPublic(ipNet.IP) {
+			return ipNet.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("no interface has a public IPv4 address")
+}
+
+// stunSource asks a STUN server which address our binding request came from.
+type stunSource struct {
+	uri string
+}
+
+// STUN returns a Source that sends a binding request to a stun: URI.
+func STUN(uri string) Source {
+	return stunSource{uri: uri}
+}
+
+func (s stunSource) Name() string { return s.uri }
+
+func (s stunSource) Lookup(ctx context.Context) (net.IP, error) {
+	uri, err := stun.ParseURI(s.uri)
+	if err != nil {
+		return nil, err
+	}
+	if uri.Scheme != stun.SchemeTypeSTUN {
+		return nil, fmt.Errorf("not a stun: URI")
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp4", net.JoinHostPort(uri.Host, strconv.Itoa(uri.Port)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	request := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	if _, err := conn.Write(request.Raw); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		response := &stun.Message{Raw: append([]byte(nil), buf[:n]...)}
+		if err := response.Decode(); err != nil || response.TransactionID != request.TransactionID {
+			continue // not the answer to our request
+		}
+		var mapped stun.XORMappedAddress
+		if err := mapped.GetFrom(response); err != nil {
+			return nil, fmt.Errorf("no XOR-MAPPED-ADDRESS in the response: %w", err)
+		}
+		return mapped.IP, nil
+	}
+}
+
+// HTTPClient sends the requests of metadata sources, *http.Client satisfies it and tests
+// can stub it.
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// metadataSource reads the public address from a cloud's instance metadata endpoint.
+type metadataSource struct {
+	name   string
+	client HTTPClient
+	// request builds the request for the address, it may need requests of its own first
+	request func(ctx context.Context, client HTTPClient) (*http.Request, error)
+}
+
+// MetadataClient returns the client for CloudMetadata. The endpoints are link-local, so it
+// never goes through a proxy set in HTTP_PROXY and the like, which would get to see the
+// requests and could answer them.
+func MetadataClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{Proxy: nil},
+		Timeout:   lookupTimeout,
+	}
+}
+
+// CloudMetadata returns Sources for the metadata endpoints of Google Cloud, AWS and Azure.
+func CloudMetadata(client HTTPClient) []Source {
+	return []Source{
+		metadataSource{name: "gcp-metadata", client: client, request: gcpRequest},
+		metadataSource{name: "aws-metadata", client: client, request: awsRequest},
+		metadataSource{name: "azure-metadata", client: client, request: azureRequest},
+	}
+}
+
+func (s metadataSource) Name() string { return s.name }
+
+func (s metadataSource) Lookup(ctx context.Context) (net.IP, error) {
+	req, err := s.request(ctx, s.client)
+	if err != nil {
+		return nil, err
+	}
+	body, err := doRequest(s.client, req)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(body))
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address", body)
+	}
+	return ip, nil
+}
+
+func gcpRequest(ctx context.Context, _ HTTPClient) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"http://metadata.google.internal/computeMetadata/v1/instance/network-interfaces/0/access-configs/0/external-ip", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	return req, nil
+}
+
+// awsRequest fetches an IMDSv2 session token first, instances may refuse IMDSv1.
+func awsRequest(ctx context.Context, client HTTPClient) (*http.Request, error) {
+	tokenReq, err := http.NewRequestWithContext(ctx, http.MethodPut, "http://169.254.169.254/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	tokenReq.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(int(time.Minute/time.Second)))
+	token, err := doRequest(client, tokenReq)
+	if err != nil {
+		return nil, fmt.Errorf("getting a session token: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://169.254.169.254/latest/meta-data/public-ipv4", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	return req, nil
+}
+
+func azureRequest(ctx context.Context, _ HTTPClient) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"http://169.254.169.254/metadata/instance/network/interface/0/ipv4/ipAddress/0/publicIpAddress?api-version=2021-02-01&format=text", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+	return req, nil
+}
+
+// doRequest sends a metadata request and returns the body of a 200 response.
+func doRequest(client HTTPClient, req *http.Request) (string, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s answered %s", req.URL.Host, resp.Status)
+	}
+	return string(body), nil
+}
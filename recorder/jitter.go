@@ -0,0 +1,93 @@
+package recorder
+
+import "github.com/pion/rtp"
+
+// jitterBufferSize is how many packets may be held back waiting for a missing one. At the
+// packet rates of HD video that is a few hundred milliseconds, enough for NACKed packets
+// to arrive, while audio at 50 packets per second waits a bit longer which costs nothing
+// in a recording.
+const jitterBufferSize = 128
+
+// BufferedPacket is a packet released by the jitter buffer.
+type BufferedPacket struct {
+	Packet   *rtp.Packet
+	Keyframe bool // starts a keyframe, as decided by the SFU when it read the packet
+	Lost     int  // packets given up on right before this one
+}
+
+// JitterBuffer puts packets back in sequence number order. A missing packet holds back
+// everything after it until either it arrives or the buffer is full, then it is given up on.
+// It is also used by the HLS muxer, which has the same need for ordered packets.
+type JitterBuffer struct {
+	packets map[uint16]BufferedPacket
+	next    uint16 // sequence number of the next packet to release
+	started bool
+}
+
+// NewJitterBuffer returns an empty JitterBuffer, it starts at the first packet pushed.
+func NewJitterBuffer() *JitterBuffer {
+	return &JitterBuffer{packets: make(map[uint16]BufferedPacket)}
+}
+
+// Push adds a packet and returns the packets that can now be released in order.
+func (b *JitterBuffer) Push(pkt *rtp.Packet, keyframe bool) []BufferedPacket {
+	seq := pkt.SequenceNumber
+	if !b.started {
+		b.started = true
+		b.next = seq
+	}
+
+	// already released or given up on
+	if seq-b.next >= 0x8000 {
+		return nil
+	}
+	if _, ok := b.packets[seq]; ok {
+		return nil
+	}
+	b.packets[seq] = BufferedPacket{Packet: pkt, Keyframe: keyframe}
+
+	lost := 0
+	if len(b.packets) > jitterBufferSize {
+		// give up on whatever is missing in front of the oldest packet we hold
+		for {
+			if _, ok := b.packets[b.next]; ok {
+				break
+			}
+			b.next++
+			lost++
+		}
+	}
+	return b.release(lost)
+}
+
+// Flush releases every packet still held, in order, when the stream stops.
+func (b *JitterBuffer) Flush() []BufferedPacket {
+	var ordered []BufferedPacket
+	lost := 0
+	for len(b.packets) > 0 {
+		if _, ok := b.packets[b.next]; !ok {
+			b.next++
+			lost++
+			continue
+		}
+		ordered = append(ordered, b.release(lost)...)
+		lost = 0
+	}
+	return ordered
+}
+
+// release pops consecutive packets starting at next, lost is attributed to the first one.
+func (b *JitterBuffer) release(lost int) []BufferedPacket {
+	var ordered []BufferedPacket
+	for {
+		buffered, ok := b.packets[b.next]
+		if !ok {
+			return ordered
+		}
+		delete(b.packets, b.next)
+		buffered.Lost = lost
+		lost = 0
+		ordered = append(ordered, buffered)
+		b.next++
+	}
+}
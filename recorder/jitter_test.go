@@ -0,0 +1,96 @@
+package recorder
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+// released is a released packet as the tests expect it.
+type released struct {
+	seq  uint16
+	lost int
+}
+
+func releasedOf(packets []BufferedPacket) []released {
+	var out []released
+	for _, p := range packets {
+		out = append(out, released{seq: p.Packet.SequenceNumber, lost: p.Lost})
+	}
+	return out
+}
+
+// seqRange returns the sequence numbers from first to last, wrapping around.
+func seqRange(first, last uint16) []uint16 {
+	var seqs []uint16
+	for seq := first; ; seq++ {
+		seqs = append(seqs, seq)
+		if seq == last {
+			return seqs
+		}
+	}
+}
+
+func TestJitterBuffer(t *testing.T) {
+	tests := []struct {
+		name      string
+		pushed    []uint16
+		want      []released // released by the pushes, in order
+		wantFlush []released
+	}{
+		{
+			name:   "in order",
+			pushed: []uint16{10, 11, 12},
+			want:   []released{{seq: 10}, {seq: 11}, {seq: 12}},
+		},
+		{
+			name:   "reordered",
+			pushed: []uint16{10, 12, 13, 11},
+			want:   []released{{seq: 10}, {seq: 11}, {seq: 12}, {seq: 13}},
+		},
+		{
+			name:   "duplicates and late packets are dropped",
+			pushed: []uint16{10, 11, 11, 10, 12},
+			want:   []released{{seq: 10}, {seq: 11}, {seq: 12}},
+		},
+		{
+			name:   "reordered across wraparound",
+			pushed: []uint16{65534, 0, 65535, 1},
+			want:   []released{{seq: 65534}, {seq: 65535}, {seq: 0}, {seq: 1}},
+		},
+		{
+			name:      "gap is held until flushed",
+			pushed:    []uint16{10, 12, 15},
+			want:      []released{{seq: 10}},
+			wantFlush: []released{{seq: 12, lost: 1}, {seq: 15, lost: 2}},
+		},
+		{
+			name:   "gap is given up on once the buffer is full",
+			pushed: append([]uint16{10}, seqRange(13, 13+jitterBufferSize)...),
+			want: func() []released {
+				out := []released{{seq: 10}, {seq: 13, lost: 2}}
+				for _, seq := range seqRange(14, 13+jitterBufferSize) {
+					out = append(out, released{seq: seq})
+				}
+				return out
+			}(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewJitterBuffer()
+			var got []released
+			for _, seq := range tt.pushed {
+				got = append(got, releasedOf(b.Push(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq}}, false))...)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("released %v, want %v", got, tt.want)
+			}
+			if flushed := releasedOf(b.Flush()); !slices.Equal(flushed, tt.wantFlush) {
+				t.Errorf("flushed %v, want %v", flushed, tt.wantFlush)
+			}
+		})
+	}
+}
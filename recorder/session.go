@@ -0,0 +1,213 @@
+// Package recorder writes published tracks to disk. A Session is one recording, every track
+// in it gets its own file, and a manifest.json describes how to line the files up again.
+package recorder
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// Manifest is written as manifest.json next to the media files when a session stops.
+type Manifest struct {
+	ID        string          `json:"id"`
+	RoomID    string          `json:"roomId"`
+	StartedAt time.Time       `json:"startedAt"`
+	StoppedAt time.Time       `json:"stoppedAt"`
+	Tracks    []TrackManifest `json:"tracks"`
+}
+
+// TrackManifest describes one recorded track. Offsets are relative to the session start,
+// a track that was published later simply starts with a larger StartOffsetMs.
+type TrackManifest struct {
+	TrackID       string `json:"trackId"`
+	PeerID        string `json:"peerId"`
+	Kind          string `json:"kind"`
+	MimeType      string `json:"mimeType"`
+	ClockRate     uint32 `json:"clockRate"`
+	File          string `json:"file"`
+	StartOffsetMs int64  `json:"startOffsetMs"` // when the first packet was written
+	EndOffsetMs   int64  `json:"endOffsetMs"`   // when the track stopped being recorded
+	FirstRTPTime  uint32 `json:"firstRtpTimestamp"`
+	Packets       uint64 `json:"packets"`
+	LostPackets   uint64 `json:"lostPackets"`
+}
+
+// Session is a recording of any number of tracks into one directory.
+type Session struct {
+	id     string
+	roomID string
+	dir    string
+
+	mu        sync.Mutex
+	startedAt time.Time
+	tracks    []*Track
+	closed    bool
+}
+
+// NewSession creates the directory of a recording, dir/id. id has to be a plain file name,
+// see SafeName.
+func NewSession(dir, id, roomID string) (*Session, error) {
+	if id == "" || id == "." || id == ".." || SafeName(id) != id {
+		return nil, fmt.Errorf("recording ID %q is not a safe directory name", id)
+	}
+	sessionDir := filepath.Join(dir, id)
+	if rel, err := filepath.Rel(dir, sessionDir); err != nil || rel != id {
+		return nil, fmt.Errorf("recording directory %s is outside of %s", sessionDir, dir)
+	}
+	if err := os.MkdirAll(sessionDir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating recording directory: %w", err)
+	}
+	return &Session{
+		id:        id,
+		roomID:    roomID,
+		dir:       sessionDir,
+		startedAt: time.Now(),
+	}, nil
+}
+
+// ID returns the recording ID.
+func (s *Session) ID() string { return s.id }
+
+// Dir returns the directory the recording is written to.
+func (s *Session) Dir() string { return s.dir }
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// SafeName replaces everything but letters, digits, dots, dashes and underscores in s, so
+// client supplied IDs can be used in file names.
+func SafeName(s string) string {
+	return unsafeFileChars.ReplaceAllString(s, "_")
+}
+
+// AddTrack starts recording a track into its own file.
+func (s *Session) AddTrack(trackID, peerID string, kind webrtc.RTPCodecType, codec webrtc.RTPCodecCapability) (*Track, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, fmt.Errorf("recording %s is stopped", s.id)
+	}
+
+	// track IDs come from browsers and may contain anything, e.g. braces around a UUID
+	name := SafeName(trackID)
+	writer, extension, err := newMediaWriter(filepath.Join(s.dir, name), codec)
+	if err != nil {
+		return nil, err
+	}
+
+	track := &Track{
+		session: s,
+		writer:  writer,
+		jitter:  NewJitterBuffer(),
+		manifest: TrackManifest{
+			TrackID:   trackID,
+			PeerID:    peerID,
+			Kind:      kind.String(),
+			MimeType:  codec.MimeType,
+			ClockRate: codec.ClockRate,
+			File:      name + extension,
+		},
+	}
+	s.tracks = append(s.tracks, track)
+	return track, nil
+}
+
+// Close stops every track still recording and writes the manifest.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	tracks := append([]*Track(nil), s.tracks...)
+	s.mu.Unlock()
+
+	manifest := Manifest{
+		ID:        s.id,
+		RoomID:    s.roomID,
+		StartedAt: s.startedAt,
+		StoppedAt: time.Now(),
+		Tracks:    make([]TrackManifest, 0, len(tracks)),
+	}
+	for _, track := range tracks {
+		if err := track.Close(); err != nil {
+			log.Printf("Recording %s: failed to close track %s: %v", s.id, track.manifest.TrackID, err)
+		}
+		manifest.Tracks = append(manifest.Tracks, track.snapshot())
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.dir, "manifest.json"), data, 0o644)
+}
+
+// Track records a single track of a session. WriteRTP and Close may be called from different goroutines.
+type Track struct {
+	session *Session
+
+	mu       sync.Mutex
+	writer   mediaWriter
+	jitter   *JitterBuffer
+	manifest TrackManifest
+	started  bool
+	closed   bool
+}
+
+// WriteRTP records a packet, keyframe tells whether it starts a keyframe.
+func (t *Track) WriteRTP(pkt *rtp.Packet, keyframe bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+
+	if !t.started {
+		t.started = true
+		t.manifest.StartOffsetMs = time.Since(t.session.startedAt).Milliseconds()
+		t.manifest.FirstRTPTime = pkt.Timestamp
+	}
+	// packets read by the SFU are never modified after the fact, holding on to them is safe
+	t.writePackets(t.jitter.Push(pkt, keyframe))
+}
+
+func (t *Track) writePackets(packets []BufferedPacket) {
+	for _, buffered := range packets {
+		t.manifest.Packets++
+		t.manifest.LostPackets += uint64(buffered.Lost)
+		if err := t.writer.writePacket(buffered); err != nil {
+			log.Printf("Recording %s: failed to write packet of track %s: %v", t.session.id, t.manifest.TrackID, err)
+		}
+	}
+}
+
+// Close flushes what the jitter buffer still holds and closes the file, the track stays in
+// the session's manifest.
+func (t *Track) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+
+	t.writePackets(t.jitter.Flush())
+	t.manifest.EndOffsetMs = time.Since(t.session.startedAt).Milliseconds()
+	return t.writer.close()
+}
+
+func (t *Track) snapshot() TrackManifest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.manifest
+}
@@ -0,0 +1,214 @@
+package recorder
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+)
+
+// mediaWriter turns the ordered packets of one track into a media file.
+type mediaWriter interface {
+	writePacket(p BufferedPacket) error
+	close() error
+}
+
+// newMediaWriter picks the container for a codec and returns the file extension it uses.
+func newMediaWriter(path string, codec webrtc.RTPCodecCapability) (mediaWriter, string, error) {
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		channels := codec.Channels
+		if channels == 0 {
+			channels = 2
+		}
+		writer, err := oggwriter.New(path+".ogg", codec.ClockRate, channels)
+		if err != nil {
+			return nil, "", err
+		}
+		return &oggMediaWriter{writer: writer}, ".ogg", nil
+
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return newIVFMediaWriter(path, "VP80", func() rtp.Depacketizer { return &codecs.VP8Packet{} })
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return newIVFMediaWriter(path, "VP90", func() rtp.Depacketizer { return &codecs.VP9Packet{} })
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		return newIVFMediaWriter(path, "AV01", func() rtp.Depacketizer { return &codecs.AV1Depacketizer{} })
+
+	case strings.ToLower(webrtc.MimeTypeH264):
+		file, err := os.Create(path + ".h264")
+		if err != nil {
+			return nil, "", err
+		}
+		// Annex-B has no container, frames are simply written one after the other
+		writeFrame := func(frame []byte, _ uint32) error {
+			_, err := file.Write(frame)
+			return err
+		}
+		return newVideoWriter(func() rtp.Depacketizer { return &codecs.H264Packet{} }, writeFrame, file), ".h264", nil
+	}
+	return nil, "", fmt.Errorf("recording %s is not supported", codec.MimeType)
+}
+
+// oggMediaWriter writes Opus into an Ogg container. Lost packets need no special care,
+// Ogg positions come from the RTP timestamps so a gap just plays back as silence.
+type oggMediaWriter struct {
+	writer *oggwriter.OggWriter
+}
+
+func (w *oggMediaWriter) writePacket(p BufferedPacket) error {
+	return w.writer.WriteRTP(p.Packet)
+}
+
+func (w *oggMediaWriter) close() error {
+	return w.writer.Close()
+}
+
+// videoWriter assembles depacketized frames and hands complete ones to writeFrame. After a
+// loss every frame is dropped until the next keyframe, frames referencing a broken one
+// would only decode into garbage.
+type videoWriter struct {
+	newDepacketizer func() rtp.Depacketizer
+	writeFrame      func(frame []byte, timestamp uint32) error
+	file            io.Closer
+
+	depacketizer rtp.Depacketizer
+	frame        []byte
+	frameTS      uint32
+	inFrame      bool
+	broken       bool // the frame being assembled lost a packet
+	waitKeyframe bool
+}
+
+func newVideoWriter(newDepacketizer func() rtp.Depacketizer, writeFrame func([]byte, uint32) error, file io.Closer) *videoWriter {
+	return &videoWriter{
+		newDepacketizer: newDepacketizer,
+		writeFrame:      writeFrame,
+		file:            file,
+		depacketizer:    newDepacketizer(),
+		waitKeyframe:    true, // a recording can't start in the middle of a GOP
+	}
+}
+
+func (w *videoWriter) writePacket(p BufferedPacket) error {
+	if p.Lost > 0 {
+		w.waitKeyframe = true
+		w.broken = true
+		// depacketizers keep fragments of the frame in progress, those are useless now
+		w.depacketizer = w.newDepacketizer()
+	}
+
+	if w.inFrame && p.Packet.Timestamp != w.frameTS {
+		// the previous frame never saw its marker, its last packet must be gone
+		w.inFrame = false
+		w.waitKeyframe = true
+	}
+	if !w.inFrame {
+		if w.waitKeyframe && !p.Keyframe {
+			return nil
+		}
+		w.waitKeyframe = false
+		w.inFrame = true
+		w.broken = false
+		w.frame = w.frame[:0]
+		w.frameTS = p.Packet.Timestamp
+	}
+
+	data, err := w.depacketizer.Unmarshal(p.Packet.Payload)
+	if err != nil {
+		w.broken = true
+	}
+	w.frame = append(w.frame, data...)
+
+	if !p.Packet.Marker {
+		return nil
+	}
+	w.inFrame = false
+	if w.broken || len(w.frame) == 0 {
+		w.waitKeyframe = true
+		return nil
+	}
+	return w.writeFrame(w.frame, w.frameTS)
+}
+
+func (w *videoWriter) close() error {
+	return w.file.Close()
+}
+
+// ivfWriter is an IVF container, the format libvpx tools use for VP8, VP9 and AV1.
+// Timestamps are kept in the 90kHz RTP clock instead of a frame counter, so variable
+// frame rates and dropped frames play back at the right speed.
+type ivfWriter struct {
+	file       *os.File
+	frames     uint32
+	started    bool
+	lastTS     uint32
+	elapsedRTP uint64 // RTP ticks since the first frame, unwrapped
+}
+
+const (
+	ivfHeaderSize      = 32
+	ivfFrameHeaderSize = 12
+	videoClockRate     = 90000
+)
+
+func newIVFMediaWriter(path, fourcc string, newDepacketizer func() rtp.Depacketizer) (mediaWriter, string, error) {
+	file, err := os.Create(path + ".ivf")
+	if err != nil {
+		return nil, "", err
+	}
+
+	header := make([]byte, ivfHeaderSize)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[4:], 0) // version
+	binary.LittleEndian.PutUint16(header[6:], ivfHeaderSize)
+	copy(header[8:], fourcc)
+	// width and height are left at 0, decoders read the real ones from the bitstream
+	binary.LittleEndian.PutUint32(header[16:], videoClockRate) // timebase denominator
+	binary.LittleEndian.PutUint32(header[20:], 1)              // timebase numerator
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return nil, "", err
+	}
+
+	ivf := &ivfWriter{file: file}
+	return newVideoWriter(newDepacketizer, ivf.writeFrame, ivf), ".ivf", nil
+}
+
+func (w *ivfWriter) writeFrame(frame []byte, timestamp uint32) error {
+	if !w.started {
+		w.started = true
+		w.lastTS = timestamp
+	}
+	// RTP timestamps wrap every 13 hours at 90kHz, a signed difference survives that
+	w.elapsedRTP += uint64(int64(int32(timestamp - w.lastTS)))
+	w.lastTS = timestamp
+
+	header := make([]byte, ivfFrameHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(frame)))
+	binary.LittleEndian.PutUint64(header[4:], w.elapsedRTP)
+	if _, err := w.file.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.file.Write(frame); err != nil {
+		return err
+	}
+	w.frames++
+	return nil
+}
+
+// Close fills in the frame count of the header and closes the file.
+func (w *ivfWriter) Close() error {
+	count := make([]byte, 4)
+	binary.LittleEndian.PutUint32(count, w.frames)
+	if _, err := w.file.WriteAt(count, 24); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
@@ -0,0 +1,146 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestIVFHeaders(t *testing.T) {
+	tests := []struct {
+		name      string
+		mimeType  string
+		fourcc    string
+		frameTS   []uint32
+		wantTimes []uint64
+	}{
+		{name: "VP8", mimeType: webrtc.MimeTypeVP8, fourcc: "VP80", frameTS: []uint32{1000, 4000, 7000}, wantTimes: []uint64{0, 3000, 6000}},
+		{name: "VP8 timestamps wrap around", mimeType: webrtc.MimeTypeVP8, fourcc: "VP80", frameTS: []uint32{4294966000, 1704}, wantTimes: []uint64{0, 3000}},
+		{name: "VP9", mimeType: webrtc.MimeTypeVP9, fourcc: "VP90", frameTS: []uint32{0}, wantTimes: []uint64{0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "track")
+			writer, ext, err := newMediaWriter(path, webrtc.RTPCodecCapability{MimeType: tt.mimeType, ClockRate: 90000})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ext != ".ivf" {
+				t.Fatalf("extension %q, want .ivf", ext)
+			}
+			payload := vp8KeyframePayload
+			if tt.mimeType == webrtc.MimeTypeVP9 {
+				payload = vp9KeyframePayload
+			}
+			for i, ts := range tt.frameTS {
+				pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: uint16(i), Timestamp: ts, Marker: true}, Payload: payload}
+				if err := writer.writePacket(BufferedPacket{Packet: pkt, Keyframe: true}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writer.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(path + ".ivf")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) < ivfHeaderSize {
+				t.Fatalf("file is %d bytes", len(data))
+			}
+			header := data[:ivfHeaderSize]
+			if string(header[0:4]) != "DKIF" || string(header[8:12]) != tt.fourcc {
+				t.Errorf("header starts %q with fourcc %q, want DKIF and %q", header[0:4], header[8:12], tt.fourcc)
+			}
+			if size := binary.LittleEndian.Uint16(header[6:]); size != ivfHeaderSize {
+				t.Errorf("header size %d, want %d", size, ivfHeaderSize)
+			}
+			if den, num := binary.LittleEndian.Uint32(header[16:]), binary.LittleEndian.Uint32(header[20:]); den != 90000 || num != 1 {
+				t.Errorf("timebase %d/%d, want 1/90000", num, den)
+			}
+			if frames := binary.LittleEndian.Uint32(header[24:]); frames != uint32(len(tt.wantTimes)) {
+				t.Errorf("frame count %d, want %d", frames, len(tt.wantTimes))
+			}
+
+			rest := data[ivfHeaderSize:]
+			for i, want := range tt.wantTimes {
+				if len(rest) < ivfFrameHeaderSize {
+					t.Fatalf("frame %d is missing", i)
+				}
+				size := binary.LittleEndian.Uint32(rest[0:])
+				if got := binary.LittleEndian.Uint64(rest[4:]); got != want {
+					t.Errorf("frame %d at %d, want %d", i, got, want)
+				}
+				rest = rest[ivfFrameHeaderSize+int(size):]
+			}
+			if len(rest) != 0 {
+				t.Errorf("%d bytes after the last frame", len(rest))
+			}
+		})
+	}
+}
+
+func TestOggHeader(t *testing.T) {
+	tests := []struct {
+		name         string
+		channels     uint16
+		wantChannels byte
+	}{
+		{name: "stereo by default", channels: 0, wantChannels: 2},
+		{name: "mono", channels: 1, wantChannels: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "track")
+			writer, ext, err := newMediaWriter(path, webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: tt.channels})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ext != ".ogg" {
+				t.Fatalf("extension %q, want .ogg", ext)
+			}
+			pkt := &rtp.Packet{Header: rtp.Header{Timestamp: 960}, Payload: []byte{0xfc, 0xff, 0xfe}}
+			if err := writer.writePacket(BufferedPacket{Packet: pkt}); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(path + ".ogg")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(data, []byte("OggS")) {
+				t.Fatalf("file doesn't start with an Ogg page")
+			}
+			i := bytes.Index(data, []byte("OpusHead"))
+			if i < 0 || len(data) < i+16 {
+				t.Fatalf("no OpusHead")
+			}
+			head := data[i:]
+			if head[9] != tt.wantChannels {
+				t.Errorf("%d channels, want %d", head[9], tt.wantChannels)
+			}
+			if rate := binary.LittleEndian.Uint32(head[12:]); rate != 48000 {
+				t.Errorf("sample rate %d, want 48000", rate)
+			}
+		})
+	}
+}
+
+// vp8KeyframePayload is a VP8 payload descriptor starting a partition, followed by the
+// start of a keyframe.
+var vp8KeyframePayload = []byte{0x10, 0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a}
+
+// vp9KeyframePayload is a VP9 payload descriptor with both the start and end of a frame,
+// followed by a little frame data.
+var vp9KeyframePayload = []byte{0x0c, 0x82, 0x49, 0x83, 0x42}
@@ -0,0 +1,284 @@
+package sfu_server
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+// AdminRoom describes a room to operators.
+type AdminRoom struct {
+	ID            string       `json:"id"`
+	Peers         []string     `json:"peers"`
+	Tracks        []AdminTrack `json:"tracks"`
+	Ingests       int          `json:"ingests"` // plain RTP ingests publishing into the room
+	AutoSubscribe bool         `json:"autoSubscribe"`
+	LastN         int          `json:"lastN"`
+}
+
+// AdminTrack describes a published track to operators.
+type AdminTrack struct {
+	TrackID     string   `json:"trackId"`
+	RoomID      string   `json:"roomId"`
+	PublisherID string   `json:"publisherId"`
+	Kind        string   `json:"kind"`
+	MimeType    string   `json:"mimeType"`
+	Layers      []string `json:"layers"`
+	Subscribers []string `json:"subscribers"`
+}
+
+// AdminPeer describes a peer and the state of its PeerConnection to operators.
+type AdminPeer struct {
+	ID                    string              `json:"id"`
+	RoomID                string              `json:"roomId"`
+	Signaling             string              `json:"signaling"` // "websocket", or "http" for WHIP and WHEP
+	ConnectionState       string              `json:"connectionState"`
+	ICEConnectionState    string              `json:"iceConnectionState"`
+	SignalingState        string              `json:"signalingState"`
+	SelectedCandidatePair *AdminCandidatePair `json:"selectedCandidatePair,omitempty"` // nil until ICE picked one
+	Published             []string            `json:"published"`
+	Subscribed            []string            `json:"subscribed"`
+}
+
+// AdminCandidatePair is the ICE candidate pair a peer's media flows over.
+type AdminCandidatePair struct {
+	Local  AdminCandidate `json:"local"`
+	Remote AdminCandidate `json:"remote"`
+}
+
+// AdminCandidate is one side of an AdminCandidatePair.
+type AdminCandidate struct {
+	Address  string `json:"address"`
+	Port     uint16 `json:"port"`
+	Protocol string `json:"protocol"`
+	Type     string `json:"type"` // host, srflx, prflx or relay
+}
+
+// Rooms lists every room, sorted by ID.
+func (s *SFU) Rooms() []AdminRoom {
+	rooms := s.roomList()
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].id < rooms[j].id })
+
+	result := make([]AdminRoom, 0, len(rooms))
+	for _, room := range rooms {
+		result = append(result, s.adminRoom(room))
+	}
+	return result
+}
+
+// Room describes a single room.
+func (s *SFU) Room(roomID string) (AdminRoom, error) {
+	s.roomsLock.RLock()
+	room, ok := s.rooms[roomID]
+	s.roomsLock.RUnlock()
+	if !ok {
+		return AdminRoom{}, fmt.Errorf("unknown room %s", roomID)
+	}
+	return s.adminRoom(room), nil
+}
+
+func (s *SFU) adminRoom(room *Room) AdminRoom {
+	info := AdminRoom{
+		ID:            room.id,
+		Peers:         []string{},
+		Tracks:        room.adminTracks(),
+		AutoSubscribe: room.autoSubscribe.Load(),
+		LastN:         int(room.lastN.Load()),
+	}
+
+	room.peersLock.RLock()
+	for peerID := range room.peers {
+		info.Peers = append(info.Peers, peerID)
+	}
+	room.peersLock.RUnlock()
+	sort.Strings(info.Peers)
+
+	s.roomsLock.RLock()
+	info.Ingests = room.ingests
+	s.roomsLock.RUnlock()
+	return info
+}
+
+// adminTracks describes the tracks of a room, sorted by ID.
+func (r *Room) adminTracks() []AdminTrack {
+	r.trackLock.RLock()
+	tracks := make([]AdminTrack, 0, len(r.trackLocals))
+	for _, track := range r.trackLocals {
+		info := AdminTrack{
+			TrackID:     track.id,
+			RoomID:      r.id,
+			PublisherID: track.publisherID,
+			Kind:        track.kind.String(),
+			MimeType:    track.codec.MimeType,
+			Layers:      track.Layers(),
+			Subscribers: []string{},
+		}
+		for _, downTrack := range track.allDownTracks() {
+			info.Subscribers = append(info.Subscribers, downTrack.subscriber.id)
+		}
+		sort.Strings(info.Subscribers)
+		tracks = append(tracks, info)
+	}
+	r.trackLock.RUnlock()
+
+	sort.Slice(tracks, func(i, j int) bool { return tracks[i].TrackID < tracks[j].TrackID })
+	return tracks
+}
+
+// Tracks lists the tracks of every room.
+func (s *SFU) Tracks() []AdminTrack {
+	tracks := []AdminTrack{}
+	for _, room := range s.Rooms() {
+		tracks = append(tracks, room.Tracks...)
+	}
+	return tracks
+}
+
+// Peers lists every peer, sorted by ID.
+func (s *SFU) Peers() []AdminPeer {
+	s.peersLock.RLock()
+	peers := make([]*PeerConnectionState, 0, len(s.peers))
+	for _, pcs := range s.peers {
+		peers = append(peers, pcs)
+	}
+	s.peersLock.RUnlock()
+	sort.Slice(peers, func(i, j int) bool { return peers[i].id < peers[j].id })
+
+	result := make([]AdminPeer, 0, len(peers))
+	for _, pcs := range peers {
+		result = append(result, pcs.adminPeer())
+	}
+	return result
+}
+
+// Peer describes a single peer.
+func (s *SFU) Peer(peerID string) (AdminPeer, error) {
+	s.peersLock.RLock()
+	pcs, ok := s.peers[peerID]
+	s.peersLock.RUnlock()
+	if !ok {
+		return AdminPeer{}, fmt.Errorf("%w %s", ErrUnknownPeer, peerID)
+	}
+	return pcs.adminPeer(), nil
+}
+
+func (pcs *PeerConnectionState) adminPeer() AdminPeer {
+	peerConnection := pcs.peerConnection
+	info := AdminPeer{
+		ID:                 pcs.id,
+		RoomID:             pcs.room.id,
+		Signaling:          "websocket",
+		ConnectionState:    peerConnection.ConnectionState().String(),
+		ICEConnectionState: peerConnection.ICEConnectionState().String(),
+		SignalingState:     peerConnection.SignalingState().String(),
+		Published:          pcs.room.tracksPublishedBy(pcs.id),
+		Subscribed:         []string{},
+	}
+	if pcs.httpSignaled {
+		info.Signaling = "http"
+	}
+	if info.Published == nil {
+		info.Published = []string{}
+	}
+	sort.Strings(info.Published)
+	for _, downTrack := range pcs.room.downTracksOf(pcs.id) {
+		info.Subscribed = append(info.Subscribed, downTrack.ID())
+	}
+	sort.Strings(info.Subscribed)
+
+	// the DTLS transport, and so the ICE transport, is shared by every media section
+	pair, err := peerConnection.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+	if err == nil && pair != nil && pair.Local != nil && pair.Remote != nil {
+		info.SelectedCandidatePair = &AdminCandidatePair{
+			Local:  AdminCandidate{Address: pair.Local.Address, Port: pair.Local.Port, Protocol: pair.Local.Protocol.String(), Type: pair.Local.Typ.String()},
+			Remote: AdminCandidate{Address: pair.Remote.Address, Port: pair.Remote.Port, Protocol: pair.Remote.Protocol.String(), Type: pair.Remote.Typ.String()},
+		}
+	}
+	return info
+}
+
+// KickPeer disconnects a peer. Websocket peers get a "kicked" event first, their client
+// is free to reconnect, so keeping someone out for good needs authentication in front.
+func (s *SFU) KickPeer(peerID string) error {
+	s.peersLock.RLock()
+	pcs, ok := s.peers[peerID]
+	s.peersLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w %s", ErrUnknownPeer, peerID)
+	}
+
+	pcs.sendEvent("kicked", map[string]string{"roomId": pcs.room.id})
+	log.Printf("[%s] Kicked from room %s", peerID, pcs.room.id)
+	s.cleanupPeer(peerID)
+	return nil
+}
+
+// RemoveTrack unpublishes a track, whatever room it is in, see UnpublishTrack.
+func (s *SFU) RemoveTrack(globalTrackID string) error {
+	return s.UnpublishTrack("", globalTrackID)
+}
+
+// CloseRoom disconnects every peer of a room and stops everything else that runs in it:
+// plain RTP ingests, the HLS stream and recordings. The room goes away once the last
+// ingest released it.
+func (s *SFU) CloseRoom(roomID string) error {
+	s.roomsLock.RLock()
+	room, ok := s.rooms[roomID]
+	s.roomsLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown room %s", roomID)
+	}
+
+	// stop what hangs off the tracks first, so recordings and the stream end cleanly
+	s.recordingsLock.RLock()
+	var recordingIDs []string
+	for id, rec := range s.recordings {
+		if rec.roomID == roomID {
+			recordingIDs = append(recordingIDs, id)
+		}
+	}
+	s.recordingsLock.RUnlock()
+	for _, id := range recordingIDs {
+		if err := s.StopRecording("", id); err != nil {
+			log.Printf("Closing room %s: %v", roomID, err)
+		}
+	}
+
+	s.hlsLock.RLock()
+	_, streamed := s.hlsStreams[roomID]
+	s.hlsLock.RUnlock()
+	if streamed {
+		if err := s.StopHLS(roomID); err != nil {
+			log.Printf("Closing room %s: %v", roomID, err)
+		}
+	}
+
+	room.peersLock.RLock()
+	peerIDs := make([]string, 0, len(room.peers))
+	for peerID := range room.peers {
+		peerIDs = append(peerIDs, peerID)
+	}
+	room.peersLock.RUnlock()
+	for _, peerID := range peerIDs {
+		if err := s.KickPeer(peerID); err != nil {
+			log.Printf("Closing room %s: %v", roomID, err)
+		}
+	}
+
+	s.rtpIngestsLock.Lock()
+	var ingestIDs []string
+	for id, ingest := range s.rtpIngests {
+		if ingest.info.RoomID == roomID {
+			ingestIDs = append(ingestIDs, id)
+		}
+	}
+	s.rtpIngestsLock.Unlock()
+	for _, id := range ingestIDs {
+		if err := s.StopRTPIngest(id); err != nil {
+			log.Printf("Closing room %s: %v", roomID, err)
+		}
+	}
+
+	log.Printf("Closed room %s", roomID)
+	return nil
+}
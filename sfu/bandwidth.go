@@ -0,0 +1,327 @@
+package sfu_server
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// allocationInterval is how often every subscriber's budget is re-distributed, on top
+	// of the re-allocations triggered by the estimate changing.
+	allocationInterval = time.Second
+
+	// probeDuration is how long we pad towards a subscriber before giving up on getting
+	// enough bandwidth for its next layer, and probeCooldown how long we wait before trying again.
+	probeDuration = 3 * time.Second
+	probeCooldown = 10 * time.Second
+
+	// probeTick is how often padding is sent while probing.
+	probeTick = 20 * time.Millisecond
+
+	// maxProbeBitrate caps the padding rate, a probe only needs to show the estimator
+	// that there is headroom, not fill it.
+	maxProbeBitrate = 500_000
+)
+
+// BandwidthEstimation runs Google Congestion Control for every PeerConnection, using the
+// TWCC feedback subscribers send for what we forward them. It has to be registered through
+// InterceptorConfig, and handed to the SFU with EnableBandwidthEstimation.
+type BandwidthEstimation struct {
+	InitialBitrate int // bits per second assumed before any feedback arrived
+	MinBitrate     int
+	MaxBitrate     int
+
+	// the cc interceptor hands out one estimator per PeerConnection from inside
+	// NewPeerConnection, the SFU picks it up right after the call returns
+	estimators chan cc.BandwidthEstimator
+}
+
+// NewBandwidthEstimation returns estimation settings suitable for a video call.
+func NewBandwidthEstimation() *BandwidthEstimation {
+	return &BandwidthEstimation{
+		InitialBitrate: 1_000_000,
+		MinBitrate:     100_000,
+		MaxBitrate:     10_000_000,
+		estimators:     make(chan cc.BandwidthEstimator, 1),
+	}
+}
+
+// register adds the congestion control interceptor. It must run before the TWCC header
+// extension interceptor is added so that it sees packets after the extension was set.
+func (b *BandwidthEstimation) register(registry *interceptor.Registry) error {
+	factory, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(b.InitialBitrate),
+			gcc.SendSideBWEMinBitrate(b.MinBitrate),
+			gcc.SendSideBWEMaxBitrate(b.MaxBitrate),
+			// the allocator already keeps us under the estimate, a pacer would only add latency
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+	})
+	if err != nil {
+		return fmt.Errorf("creating congestion control interceptor: %w", err)
+	}
+
+	factory.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+		select {
+		case b.estimators <- estimator:
+		default:
+			// nobody picked up the previous one, that PeerConnection wasn't created by the SFU
+			<-b.estimators
+			b.estimators <- estimator
+		}
+	})
+	registry.Add(factory)
+	return nil
+}
+
+// takeEstimator returns the estimator of the PeerConnection that was just created.
+func (b *BandwidthEstimation) takeEstimator() cc.BandwidthEstimator {
+	select {
+	case estimator := <-b.estimators:
+		return estimator
+	default:
+		return nil
+	}
+}
+
+// EnableBandwidthEstimation makes the SFU adapt what it forwards to every subscriber to
+// that subscriber's estimated bandwidth. b must be the one the API's interceptors were built with.
+func (s *SFU) EnableBandwidthEstimation(b *BandwidthEstimation) {
+	s.pcCreateLock.Lock()
+	defer s.pcCreateLock.Unlock()
+	s.bandwidthEstimation = b
+}
+
+// newPeerConnection creates a PeerConnection along with its bandwidth estimator, which is
+// nil when estimation is off. Creation is serialized so each estimator ends up with the
+// PeerConnection it was created for.
+func (s *SFU) newPeerConnection() (*webrtc.PeerConnection, cc.BandwidthEstimator, error) {
+	s.pcCreateLock.Lock()
+	defer s.pcCreateLock.Unlock()
+
+	peerConnection, err := s.api.NewPeerConnection(s.config)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.bandwidthEstimation == nil {
+		return peerConnection, nil, nil
+	}
+	return peerConnection, s.bandwidthEstimation.takeEstimator(), nil
+}
+
+// bandwidthAllocator distributes one subscriber's estimated bandwidth over the tracks it
+// receives. Audio is always served first, then every video track gets its lowest layer,
+// then layers are upgraded one step at a time across tracks while the budget allows.
+// Video that doesn't fit at all is paused, which leaves the subscriber with audio only.
+type bandwidthAllocator struct {
+	pcs       *PeerConnectionState
+	estimator cc.BandwidthEstimator // GCC from TWCC feedback, nil without bandwidth estimation
+	remb      atomic.Int64          // last REMB bitrate, used when there is no GCC estimator
+	trigger   chan struct{}
+
+	mu         sync.Mutex
+	audioOnly  bool
+	probeUntil time.Time
+	lastProbe  time.Time
+}
+
+func newBandwidthAllocator(pcs *PeerConnectionState, estimator cc.BandwidthEstimator) *bandwidthAllocator {
+	a := &bandwidthAllocator{
+		pcs:       pcs,
+		estimator: estimator,
+		trigger:   make(chan struct{}, 1),
+	}
+	if estimator != nil {
+		estimator.OnTargetBitrateChange(func(int) { a.reallocate() })
+	}
+	return a
+}
+
+// onREMB records a receiver estimate sent by the subscriber. Browsers only send REMB when
+// TWCC isn't negotiated, so this is the fallback when GCC has nothing to work with.
+func (a *bandwidthAllocator) onREMB(bitrate float32) {
+	a.remb.Store(int64(bitrate))
+	if a.estimator == nil {
+		a.reallocate()
+	}
+}
+
+// reallocate asks the allocation loop to run as soon as possible.
+func (a *bandwidthAllocator) reallocate() {
+	select {
+	case a.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// estimate returns the subscriber's available bandwidth in bits per second, 0 if unknown.
+func (a *bandwidthAllocator) estimate() int {
+	if a.estimator != nil {
+		return a.estimator.GetTargetBitrate()
+	}
+	return int(a.remb.Load())
+}
+
+// run allocates the budget until the peer leaves.
+func (a *bandwidthAllocator) run(done <-chan struct{}) {
+	allocationTicker := time.NewTicker(allocationInterval)
+	defer allocationTicker.Stop()
+	probeTicker := time.NewTicker(probeTick)
+	defer probeTicker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-allocationTicker.C:
+			a.allocate()
+		case <-a.trigger:
+			a.allocate()
+		case <-probeTicker.C:
+			a.sendProbe()
+		}
+	}
+}
+
+// videoAllocation is the layer picked for one video DownTrack, -1 when it is paused.
+type videoAllocation struct {
+	downTrack *DownTrack
+	layers    []layerBitrate
+	index     int
+}
+
+func (a *bandwidthAllocator) allocate() {
+	budget := a.estimate()
+	downTracks := a.pcs.room.downTracksOf(a.pcs.id)
+
+	if budget <= 0 {
+		// no estimate yet, forward everything like before bandwidth estimation existed
+		for _, downTrack := range downTracks {
+			downTrack.setQualityCap(noQualityCap)
+			downTrack.setCongestionPaused(false)
+		}
+		return
+	}
+
+	var videos []*videoAllocation
+	for _, downTrack := range downTracks {
+		source := downTrack.Source()
+		layers := source.layerBitrates()
+		if source.kind == webrtc.RTPCodecTypeAudio {
+			for _, layer := range layers {
+				budget -= layer.bitrate
+			}
+			continue
+		}
+		if len(layers) == 0 {
+			// nothing flowing, there is nothing to measure or to save on this track
+			continue
+		}
+		if downTrack.pausedOtherThan(pauseByCongestion) {
+			// paused by the subscriber or by last-N, it costs nothing and must not eat the budget
+			continue
+		}
+		videos = append(videos, &videoAllocation{downTrack: downTrack, layers: layers, index: -1})
+	}
+	// stable order so the same tracks win from one allocation to the next
+	sort.Slice(videos, func(i, j int) bool { return videos[i].downTrack.id < videos[j].downTrack.id })
+
+	// every video track gets its lowest layer first, as long as it fits
+	for _, video := range videos {
+		if video.layers[0].bitrate <= budget {
+			video.index = 0
+			budget -= video.layers[0].bitrate
+		}
+	}
+
+	// then upgrade one step at a time, round robin, so one track can't starve the others
+	probeBitrate := 0
+	for upgraded := true; upgraded; {
+		upgraded = false
+		for _, video := range videos {
+			if video.index < 0 || video.index+1 >= len(video.layers) {
+				continue
+			}
+			extra := video.layers[video.index+1].bitrate - video.layers[video.index].bitrate
+			if extra <= budget {
+				video.index++
+				budget -= extra
+				upgraded = true
+			} else if probeBitrate == 0 {
+				probeBitrate = extra - budget
+			}
+		}
+	}
+
+	paused := 0
+	for _, video := range videos {
+		if video.index < 0 {
+			paused++
+			video.downTrack.setCongestionPaused(true)
+			continue
+		}
+		video.downTrack.setQualityCap(video.layers[video.index].quality)
+		video.downTrack.setCongestionPaused(false)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	audioOnly := len(videos) > 0 && paused == len(videos)
+	if audioOnly != a.audioOnly {
+		a.audioOnly = audioOnly
+		if audioOnly {
+			log.Printf("[%s] Estimated bandwidth %d bps is too low for any video, falling back to audio only", a.pcs.id, a.estimate())
+		} else {
+			log.Printf("[%s] Estimated bandwidth %d bps allows video again", a.pcs.id, a.estimate())
+		}
+	}
+
+	// there is some headroom but not enough for the next layer, see if the path can take more
+	if probeBitrate > 0 && a.estimator != nil && time.Since(a.lastProbe) > probeCooldown {
+		a.lastProbe = time.Now()
+		a.probeUntil = a.lastProbe.Add(probeDuration)
+		log.Printf("[%s] Probing for %d bps more bandwidth", a.pcs.id, probeBitrate)
+	}
+}
+
+// sendProbe sends one tick worth of padding while a probe is running.
+func (a *bandwidthAllocator) sendProbe() {
+	a.mu.Lock()
+	probing := time.Now().Before(a.probeUntil)
+	a.mu.Unlock()
+	if !probing {
+		return
+	}
+
+	bytesPerTick := maxProbeBitrate / 8 * int(probeTick/time.Millisecond) / 1000
+	packets := int(math.Ceil(float64(bytesPerTick) / maxPaddingSize))
+
+	// padding goes on whichever video track is able to carry it right now
+	for _, downTrack := range a.pcs.room.downTracksOf(a.pcs.id) {
+		if downTrack.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		if downTrack.writePadding(packets) > 0 {
+			return
+		}
+	}
+}
+
+// setCongestionPaused pauses or resumes a DownTrack on behalf of the bandwidth allocator.
+func (d *DownTrack) setCongestionPaused(paused bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.setPausedLocked(pauseByCongestion, paused)
+}
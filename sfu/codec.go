@@ -0,0 +1,214 @@
+package sfu_server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// videoRTCPFeedback is the feedback pion negotiates for its default video codecs.
+var videoRTCPFeedback = []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+
+// supportedCodecs are the codecs that can be negotiated by name, with the payload types
+// and parameters of pion's defaults. Every video codec comes with its RTX payload type.
+var supportedCodecs = map[string][]webrtc.RTPCodecParameters{
+	"opus": {audioCodec(webrtc.MimeTypeOpus, 111, 48000, 2, "minptime=10;useinbandfec=1")},
+	"g722": {audioCodec(webrtc.MimeTypeG722, 9, 8000, 0, "")},
+	"pcmu": {audioCodec(webrtc.MimeTypePCMU, 0, 8000, 0, "")},
+	"pcma": {audioCodec(webrtc.MimeTypePCMA, 8, 8000, 0, "")},
+	"vp8":  videoCodec(webrtc.MimeTypeVP8, 96, 97, ""),
+	"vp9": append(videoCodec(webrtc.MimeTypeVP9, 98, 99, "profile-id=0"),
+		videoCodec(webrtc.MimeTypeVP9, 100, 101, "profile-id=2")...),
+	"h264": concatCodecs(
+		videoCodec(webrtc.MimeTypeH264, 102, 103, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f"),
+		videoCodec(webrtc.MimeTypeH264, 104, 105, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42001f"),
+		videoCodec(webrtc.MimeTypeH264, 106, 107, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"),
+		videoCodec(webrtc.MimeTypeH264, 108, 109, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42e01f"),
+		videoCodec(webrtc.MimeTypeH264, 127, 125, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=4d001f"),
+		videoCodec(webrtc.MimeTypeH264, 39, 40, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=4d001f"),
+		videoCodec(webrtc.MimeTypeH264, 112, 113, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=64001f"),
+	),
+	"av1": videoCodec(webrtc.MimeTypeAV1, 45, 46, ""),
+}
+
+func audioCodec(mimeType string, payloadType webrtc.PayloadType, clockRate uint32, channels uint16, fmtp string) webrtc.RTPCodecParameters {
+	return webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: clockRate, Channels: channels, SDPFmtpLine: fmtp},
+		PayloadType:        payloadType,
+	}
+}
+
+func videoCodec(mimeType string, payloadType, rtxPayloadType webrtc.PayloadType, fmtp string) []webrtc.RTPCodecParameters {
+	return []webrtc.RTPCodecParameters{
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: 90000, SDPFmtpLine: fmtp, RTCPFeedback: videoRTCPFeedback},
+			PayloadType:        payloadType,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/rtx", ClockRate: 90000, SDPFmtpLine: fmt.Sprintf("apt=%d", payloadType)},
+			PayloadType:        rtxPayloadType,
+		},
+	}
+}
+
+func concatCodecs(lists ...[]webrtc.RTPCodecParameters) []webrtc.RTPCodecParameters {
+	var all []webrtc.RTPCodecParameters
+	for _, list := range lists {
+		all = append(all, list...)
+	}
+	return all
+}
+
+// registerCodecs registers the named codecs, all of pion's defaults when names is empty.
+func registerCodecs(m *webrtc.MediaEngine, names []string) error {
+	if len(names) == 0 {
+		return m.RegisterDefaultCodecs()
+	}
+	for _, name := range names {
+		codecs, ok := supportedCodecs[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("unsupported codec %q", name)
+		}
+		for _, codec := range codecs {
+			kind := webrtc.RTPCodecTypeVideo
+			if strings.HasPrefix(codec.MimeType, "audio/") {
+				kind = webrtc.RTPCodecTypeAudio
+			}
+			if err := m.RegisterCodec(codec, kind); err != nil {
+				return fmt.Errorf("registering %s: %w", codec.MimeType, err)
+			}
+		}
+	}
+	return nil
+}
+
+// isKeyframe reports whether an RTP payload starts a frame that a decoder can begin from.
+// Switching a subscriber to another source is only clean when it happens on such a packet,
+// otherwise the decoder references frames it never received and the video smears until the
+// next natural keyframe. Audio has no such dependency so every audio packet counts.
+func isKeyframe(mimeType string, payload []byte) bool {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return isVP8Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return isVP9Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return isH264Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		return isAV1Keyframe(payload)
+	}
+
+	return !strings.HasPrefix(strings.ToLower(mimeType), "video/")
+}
+
+// isVP8Keyframe parses the VP8 payload descriptor (RFC 7741 section 4.2) and checks
+// the inverse key frame bit of the VP8 payload header that follows it.
+func isVP8Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	// S bit must be set and the partition index must be 0, otherwise this isn't the start of a frame
+	if payload[0]&0x10 == 0 || payload[0]&0x0f != 0 {
+		return false
+	}
+
+	offset := 1
+	if payload[0]&0x80 != 0 {
+		if len(payload) < offset+1 {
+			return false
+		}
+		extension := payload[offset]
+		offset++
+
+		// picture ID, 7 or 15 bits depending on the M bit
+		if extension&0x80 != 0 {
+			if len(payload) < offset+1 {
+				return false
+			}
+			if payload[offset]&0x80 != 0 {
+				offset += 2
+			} else {
+				offset++
+			}
+		}
+		// TL0PICIDX
+		if extension&0x40 != 0 {
+			offset++
+		}
+		// TID/Y/KEYIDX share one byte
+		if extension&0x30 != 0 {
+			offset++
+		}
+	}
+
+	if len(payload) <= offset {
+		return false
+	}
+
+	// P bit of the VP8 frame tag is 0 for key frames
+	return payload[offset]&0x01 == 0
+}
+
+// isVP9Keyframe checks the P (inter-picture predicted) and B (start of frame) bits of the
+// VP9 payload descriptor.
+func isVP9Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	return payload[0]&0x40 == 0 && payload[0]&0x08 != 0
+}
+
+// isH264Keyframe looks for an IDR slice or an SPS in single NAL, STAP-A and FU-A packets (RFC 6184).
+func isH264Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	const (
+		nalIDR  = 5
+		nalSPS  = 7
+		nalSTAP = 24
+		nalFUA  = 28
+	)
+
+	switch naluType := payload[0] & 0x1f; naluType {
+	case nalIDR, nalSPS:
+		return true
+	case nalSTAP:
+		offset := 1
+		for offset+2 < len(payload) {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+			if size == 0 || offset >= len(payload) {
+				return false
+			}
+			if t := payload[offset] & 0x1f; t == nalIDR || t == nalSPS {
+				return true
+			}
+			offset += size
+		}
+	case nalFUA:
+		if len(payload) < 2 {
+			return false
+		}
+		// only the first fragment carries the start bit
+		if payload[1]&0x80 == 0 {
+			return false
+		}
+		t := payload[1] & 0x1f
+		return t == nalIDR || t == nalSPS
+	}
+
+	return false
+}
+
+// isAV1Keyframe checks the N bit of the AV1 aggregation header which marks the first
+// packet of a new coded video sequence.
+func isAV1Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	return payload[0]&0x08 != 0
+}
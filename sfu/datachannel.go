@@ -0,0 +1,207 @@
+package sfu_server
+
+import (
+	"encoding/json"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// relayQueueSize is how many messages may wait for one slow receiver before its
+	// messages start being dropped, the sender and every other receiver never wait on it.
+	relayQueueSize = 256
+
+	// maxBufferedAmount is how much may sit in a data channel's send buffer before we stop
+	// writing to it, and bufferedAmountLow when we start again.
+	maxBufferedAmount = 1 << 20
+	bufferedAmountLow = 256 << 10
+
+	// bufferedAmountPoll bounds how long a writer waits for the buffered amount low callback,
+	// which can fire between our check and starting to wait.
+	bufferedAmountPoll = 50 * time.Millisecond
+)
+
+// dataEnvelope is the JSON shape of text messages relayed between peers. To addresses a
+// single peer of the room, it is replaced by From on the way out.
+type dataEnvelope struct {
+	To   string          `json:"to,omitempty"`
+	From string          `json:"from,omitempty"`
+	Data json.RawMessage `json:"data"`
+}
+
+// dataMessage is one message queued for a receiver.
+type dataMessage struct {
+	data     []byte
+	isString bool
+}
+
+// relayChannel is a data channel a peer opened, the label is the topic. Everything other
+// peers of the room send on the same topic is delivered on it, through a queue so that
+// a receiver that can't keep up only loses its own messages.
+type relayChannel struct {
+	pcs     *PeerConnectionState
+	channel *webrtc.DataChannel
+
+	queue   chan dataMessage
+	low     chan struct{}
+	done    chan struct{}
+	dropped atomic.Uint64
+}
+
+// handleDataChannel registers the data channels a peer opens as topics it publishes and subscribes to.
+func (s *SFU) handleDataChannel(pcs *PeerConnectionState) func(*webrtc.DataChannel) {
+	return func(channel *webrtc.DataChannel) {
+		relay := &relayChannel{
+			pcs:     pcs,
+			channel: channel,
+			queue:   make(chan dataMessage, relayQueueSize),
+			low:     make(chan struct{}, 1),
+			done:    make(chan struct{}),
+		}
+
+		channel.SetBufferedAmountLowThreshold(bufferedAmountLow)
+		channel.OnBufferedAmountLow(func() {
+			select {
+			case relay.low <- struct{}{}:
+			default:
+			}
+		})
+
+		channel.OnOpen(func() {
+			log.Printf("[%s] Opened data channel %q (ordered: %t, reliable: %t)", pcs.id, channel.Label(), channel.Ordered(), isReliable(channel))
+			if !pcs.canPublishData() {
+				log.Printf("[%s] Not allowed to publish data, messages on %q are dropped", pcs.id, channel.Label())
+			}
+			pcs.addRelayChannel(relay)
+			go relay.run()
+		})
+		channel.OnClose(func() {
+			if pcs.removeRelayChannel(relay) {
+				close(relay.done)
+			}
+			if dropped := relay.dropped.Load(); dropped > 0 {
+				log.Printf("[%s] Data channel %q closed, %d messages to it were dropped", pcs.id, channel.Label(), dropped)
+			}
+		})
+		channel.OnMessage(func(msg webrtc.DataChannelMessage) {
+			// the peer still receives the topic, it just can't send to it
+			if !pcs.canPublishData() {
+				return
+			}
+			pcs.room.relayData(pcs, channel.Label(), msg)
+		})
+	}
+}
+
+// isReliable tells whether a channel retransmits lost messages, unreliable channels are
+// opened with a maximum number of retransmits or a maximum packet lifetime.
+func isReliable(channel *webrtc.DataChannel) bool {
+	return channel.MaxRetransmits() == nil && channel.MaxPacketLifeTime() == nil
+}
+
+func (pcs *PeerConnectionState) addRelayChannel(relay *relayChannel) {
+	pcs.dataChannelsLock.Lock()
+	defer pcs.dataChannelsLock.Unlock()
+	if previous, ok := pcs.dataChannels[relay.channel.Label()]; ok {
+		// a peer re-opening a topic replaces the old channel
+		close(previous.done)
+	}
+	pcs.dataChannels[relay.channel.Label()] = relay
+}
+
+// removeRelayChannel forgets a closed channel, it returns false if it was already replaced.
+func (pcs *PeerConnectionState) removeRelayChannel(relay *relayChannel) bool {
+	pcs.dataChannelsLock.Lock()
+	defer pcs.dataChannelsLock.Unlock()
+	if pcs.dataChannels[relay.channel.Label()] != relay {
+		return false
+	}
+	delete(pcs.dataChannels, relay.channel.Label())
+	return true
+}
+
+func (pcs *PeerConnectionState) relayChannel(label string) *relayChannel {
+	pcs.dataChannelsLock.Lock()
+	defer pcs.dataChannelsLock.Unlock()
+	return pcs.dataChannels[label]
+}
+
+// relayData delivers a message sent by one peer on a topic to the other peers of the room
+// that opened the same topic. Text messages in the dataEnvelope format can be addressed to
+// a single peer and reach the receivers with the sender's ID, anything else is relayed as is.
+func (r *Room) relayData(sender *PeerConnectionState, label string, msg webrtc.DataChannelMessage) {
+	out := dataMessage{data: msg.Data, isString: msg.IsString}
+	target := ""
+
+	var envelope dataEnvelope
+	if msg.IsString && json.Unmarshal(msg.Data, &envelope) == nil && envelope.Data != nil {
+		target = envelope.To
+		envelope.To = ""
+		envelope.From = sender.id
+		data, err := json.Marshal(envelope)
+		if err != nil {
+			log.Printf("[%s] Failed to re-encode data channel message: %v", sender.id, err)
+			return
+		}
+		out.data = data
+	}
+
+	r.peersLock.RLock()
+	receivers := make([]*PeerConnectionState, 0, len(r.peers))
+	for peerID, pcs := range r.peers {
+		if peerID == sender.id || (target != "" && peerID != target) {
+			continue
+		}
+		receivers = append(receivers, pcs)
+	}
+	r.peersLock.RUnlock()
+
+	for _, pcs := range receivers {
+		if relay := pcs.relayChannel(label); relay != nil {
+			relay.enqueue(out)
+		}
+	}
+}
+
+// enqueue hands a message to the channel's writer, dropping it if the receiver is too far behind.
+func (c *relayChannel) enqueue(msg dataMessage) {
+	select {
+	case c.queue <- msg:
+	default:
+		if c.dropped.Add(1) == 1 {
+			log.Printf("[%s] Data channel %q can't keep up, dropping messages", c.pcs.id, c.channel.Label())
+		}
+	}
+}
+
+// run writes queued messages, pausing while the channel's send buffer is full.
+func (c *relayChannel) run() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case msg := <-c.queue:
+			for c.channel.BufferedAmount() > maxBufferedAmount {
+				select {
+				case <-c.done:
+					return
+				case <-c.low:
+				case <-time.After(bufferedAmountPoll):
+				}
+			}
+
+			var err error
+			if msg.isString {
+				err = c.channel.SendText(string(msg.data))
+			} else {
+				err = c.channel.Send(msg.data)
+			}
+			if err != nil {
+				log.Printf("[%s] Failed to relay message on data channel %q: %v", c.pcs.id, c.channel.Label(), err)
+			}
+		}
+	}
+}
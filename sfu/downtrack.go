@@ -0,0 +1,455 @@
+package sfu_server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// LayerAuto lets the server pick the simulcast layer of a DownTrack.
+const LayerAuto = "auto"
+
+// autoLayerCheckInterval is how often a DownTrack in auto mode re-evaluates its layer.
+const autoLayerCheckInterval = 500 * time.Millisecond
+
+// DownTrack is what a subscriber actually receives for a PublishedTrack. It implements
+// webrtc.TrackLocal so it can be handed to AddTrack, and it rewrites every forwarded packet
+// to its own SSRC, payload type, sequence numbers and timestamps. That way a single
+// subscriber can be switched to another layer, paused or moved to another source without
+// its decoder ever seeing a discontinuity, and without touching any other subscriber.
+type DownTrack struct {
+	// id and streamID are what the subscriber negotiated, they stay the same even
+	// if the source is replaced later
+	id         string
+	streamID   string
+	kind       webrtc.RTPCodecType
+	subscriber *PeerConnectionState
+	sender     *webrtc.RTPSender
+
+	mu sync.Mutex
+
+	track *PublishedTrack // source currently forwarded, changed by ReplaceSource
+
+	// set by Bind once negotiation with the subscriber completed
+	ssrc        webrtc.SSRC
+	payloadType webrtc.PayloadType
+	writeStream webrtc.TrackLocalWriter
+
+	autoLayer      bool
+	requestedLayer string // layer the subscriber asked for when autoLayer is off
+	qualityCap     int    // highest layer quality the subscriber's bandwidth allows
+	targetLayer    string // layer we want to forward, switched to on its next keyframe
+	currentLayer   string // layer we are forwarding right now
+	lastAutoCheck  time.Time
+
+	pauseReasons pauseReason
+	resync       bool // the next keyframe of targetLayer has to start a new segment even if it's the current layer
+	lastMarker   bool // the last packet sent ended a frame, padding can only go in between frames
+
+	rewriter rtpRewriter
+	stats    sendCounters
+}
+
+// pauseReason records why a DownTrack is paused, forwarding only resumes once every
+// reason that paused it has been lifted.
+type pauseReason uint8
+
+const (
+	pauseByRequest    pauseReason = 1 << iota // Pause/Resume
+	pauseByCongestion                         // the subscriber's bandwidth doesn't fit this track
+	pauseByLastN                              // the publisher isn't among the subscriber's last-N speakers
+)
+
+// noQualityCap means the subscriber's bandwidth doesn't limit which layer it receives.
+const noQualityCap = math.MaxInt
+
+// maxPaddingSize is the most padding a single RTP packet can carry, its size is stored in one byte.
+const maxPaddingSize = 255
+
+func newDownTrack(track *PublishedTrack, subscriber *PeerConnectionState) *DownTrack {
+	return &DownTrack{
+		id:          track.id,
+		streamID:    track.streamID,
+		kind:        track.kind,
+		subscriber:  subscriber,
+		track:       track,
+		autoLayer:   true,
+		qualityCap:  noQualityCap,
+		targetLayer: track.bestLayerUpTo(noQualityCap),
+		rewriter:    rtpRewriter{clockRate: track.codec.ClockRate},
+	}
+}
+
+// Bind is called by the PeerConnection after negotiation is complete, it picks the
+// payload type the subscriber negotiated for the publisher's codec.
+func (d *DownTrack) Bind(t webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	codec, err := matchCodec(d.track.codec, t.CodecParameters())
+	if err != nil {
+		return webrtc.RTPCodecParameters{}, err
+	}
+
+	d.ssrc = t.SSRC()
+	d.payloadType = codec.PayloadType
+	d.writeStream = t.WriteStream()
+
+	// the subscriber can't decode anything until it gets a keyframe, don't wait for the publisher's next one
+	go d.track.requestKeyframe(d.targetLayer)
+
+	return codec, nil
+}
+
+// Unbind is called when the sender is stopped, packets are dropped from then on.
+func (d *DownTrack) Unbind(_ webrtc.TrackLocalContext) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.writeStream = nil
+	return nil
+}
+
+// ID is the global track ID of the source so subscribers can refer to it over signaling.
+func (d *DownTrack) ID() string { return d.id }
+
+// RID is empty, a subscriber always receives a single encoding.
+func (d *DownTrack) RID() string { return "" }
+
+// StreamID keeps the publisher's stream ID so audio and video of one publisher stay grouped.
+func (d *DownTrack) StreamID() string { return d.streamID }
+
+// Kind returns whether this is an audio or a video track.
+func (d *DownTrack) Kind() webrtc.RTPCodecType { return d.kind }
+
+// SSRC returns the SSRC negotiated with the subscriber, 0 until Bind was called.
+func (d *DownTrack) SSRC() webrtc.SSRC {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.ssrc
+}
+
+// Source returns the published track currently forwarded to the subscriber.
+func (d *DownTrack) Source() *PublishedTrack {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.track
+}
+
+// SetLayer selects the simulcast layer this subscriber receives, LayerAuto or an empty
+// layer hands the choice back to the server. The subscriber's bandwidth still has the last
+// word, a requested layer that doesn't fit is replaced by the best one that does.
+func (d *DownTrack) SetLayer(layer string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if layer == "" || layer == LayerAuto {
+		d.autoLayer = true
+		d.requestedLayer = ""
+		d.setTargetLayerLocked(d.chooseLayerLocked())
+		return nil
+	}
+
+	if !d.track.hasLayer(layer) {
+		return fmt.Errorf("track %s has no layer %q, available layers: %v", d.track.id, layer, d.track.Layers())
+	}
+
+	d.autoLayer = false
+	d.requestedLayer = layer
+	d.setTargetLayerLocked(d.chooseLayerLocked())
+	return nil
+}
+
+// CurrentLayer returns the layer being forwarded and the one we are switching to.
+func (d *DownTrack) CurrentLayer() (current string, target string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.currentLayer, d.targetLayer
+}
+
+// Pause stops forwarding to this subscriber without renegotiating, the sender stays in
+// the SDP and simply goes quiet.
+func (d *DownTrack) Pause() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.setPausedLocked(pauseByRequest, true)
+}
+
+// Resume undoes Pause. Forwarding starts again from the next keyframe, the outgoing
+// timestamps jump by the time the track was paused so playback doesn't speed up to catch up.
+// A track that is also paused for another reason, like congestion, stays paused.
+func (d *DownTrack) Resume() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.setPausedLocked(pauseByRequest, false)
+}
+
+// Paused reports whether forwarding is paused, for whatever reason.
+func (d *DownTrack) Paused() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pauseReasons != 0
+}
+
+// pausedOtherThan reports whether forwarding is paused for a reason other than the given one.
+func (d *DownTrack) pausedOtherThan(reason pauseReason) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pauseReasons&^reason != 0
+}
+
+func (d *DownTrack) setPausedLocked(reason pauseReason, paused bool) {
+	wasPaused := d.pauseReasons != 0
+	if paused {
+		d.pauseReasons |= reason
+	} else {
+		d.pauseReasons &^= reason
+	}
+
+	if wasPaused && d.pauseReasons == 0 {
+		d.resync = true
+		go d.track.requestKeyframe(d.targetLayer)
+	}
+}
+
+// restart makes forwarding start over at the next keyframe, for when the source went quiet
+// for a while without this subscriber being paused.
+func (d *DownTrack) restart() {
+	d.mu.Lock()
+	d.resync = true
+	track, layer := d.track, d.targetLayer
+	d.mu.Unlock()
+	go track.requestKeyframe(layer)
+}
+
+// setQualityCap limits the layers this subscriber receives to the given quality, used by
+// the bandwidth allocator. noQualityCap lifts the limit.
+func (d *DownTrack) setQualityCap(quality int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.qualityCap == quality {
+		return
+	}
+	d.qualityCap = quality
+	d.setTargetLayerLocked(d.chooseLayerLocked())
+}
+
+// chooseLayerLocked returns the layer that should be forwarded given what the subscriber
+// asked for and what its bandwidth allows.
+func (d *DownTrack) chooseLayerLocked() string {
+	if !d.autoLayer && layerQuality(d.requestedLayer) <= d.qualityCap && d.track.hasLayer(d.requestedLayer) {
+		return d.requestedLayer
+	}
+	return d.track.bestLayerUpTo(d.qualityCap)
+}
+
+// ReplaceSource makes the subscriber receive another published track through the same
+// sender, without renegotiation. Both tracks have to use the same codec.
+func (d *DownTrack) ReplaceSource(track *PublishedTrack) error {
+	d.mu.Lock()
+	oldTrack := d.track
+	if track == oldTrack {
+		d.mu.Unlock()
+		return nil
+	}
+	if track.kind != d.kind || !strings.EqualFold(track.codec.MimeType, oldTrack.codec.MimeType) {
+		d.mu.Unlock()
+		return fmt.Errorf("can't replace %s source %s with %s %s", oldTrack.codec.MimeType, oldTrack.id, track.codec.MimeType, track.id)
+	}
+
+	d.track = track
+	d.targetLayer = d.chooseLayerLocked()
+	d.currentLayer = ""
+	d.resync = true
+	targetLayer := d.targetLayer
+	d.mu.Unlock()
+
+	oldTrack.removeDownTrack(d.subscriber.id)
+	track.addDownTrack(d)
+	log.Printf("[%s] Down track %s now forwards %s instead of %s", d.subscriber.id, d.id, track.id, oldTrack.id)
+
+	go track.requestKeyframe(targetLayer)
+	return nil
+}
+
+func (d *DownTrack) setTargetLayerLocked(layer string) {
+	if layer == d.targetLayer {
+		return
+	}
+	log.Printf("[%s] Switching track %s from layer %q to %q", d.subscriber.id, d.id, d.currentLayer, layer)
+	d.targetLayer = layer
+	if layer != d.currentLayer {
+		go d.track.requestKeyframe(layer)
+	}
+}
+
+// writeRTP forwards a packet of the given source and layer if it's what this subscriber
+// should receive right now.
+func (d *DownTrack) writeRTP(source *PublishedTrack, rid string, pkt *rtp.Packet, keyframe bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.writeStream == nil || d.pauseReasons != 0 || source != d.track {
+		return
+	}
+
+	// layers come and go on the publisher side, re-check every now and then that we are
+	// still targeting the best one we are allowed to
+	now := time.Now()
+	if now.Sub(d.lastAutoCheck) > autoLayerCheckInterval {
+		d.lastAutoCheck = now
+		d.setTargetLayerLocked(d.chooseLayerLocked())
+	}
+
+	inSync := d.rewriter.started && !d.resync
+	switch {
+	case inSync && rid == d.currentLayer:
+		if !d.rewriter.inSegment(pkt) {
+			return
+		}
+	case rid == d.targetLayer && keyframe:
+		d.currentLayer = rid
+		d.resync = false
+		d.rewriter.startSegment(pkt, now)
+	default:
+		return
+	}
+
+	// padding only packets are the publisher probing its own uplink, there's no
+	// point spending the subscriber's bandwidth on them
+	if len(pkt.Payload) == 0 {
+		d.rewriter.drop(pkt)
+		return
+	}
+
+	seq, ts := d.rewriter.rewrite(pkt, now)
+	if seq == d.rewriter.lastSeq {
+		d.lastMarker = pkt.Marker
+	}
+	d.writePacketLocked(pkt, seq, ts)
+	d.stats.sent(pkt, d.kind == webrtc.RTPCodecTypeVideo && pkt.Marker)
+}
+
+// writePadding sends up to packets padding only RTP packets and returns how many bytes of
+// padding went out. It's how the bandwidth allocator probes for more capacity, the packets
+// cost bandwidth but the subscriber's decoder never sees them. Padding is only inserted
+// between two frames and never before the first keyframe.
+func (d *DownTrack) writePadding(packets int) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.writeStream == nil || d.pauseReasons != 0 || d.resync || !d.rewriter.started || !d.lastMarker {
+		return 0
+	}
+
+	sent := 0
+	for i := 0; i < packets; i++ {
+		seq, ts := d.rewriter.padding()
+		header := rtp.Header{
+			Version:        2,
+			Padding:        true,
+			SSRC:           uint32(d.ssrc),
+			PayloadType:    uint8(d.payloadType),
+			SequenceNumber: seq,
+			Timestamp:      ts,
+		}
+
+		// a padding only payload is all padding, its last byte holds its length
+		payload := make([]byte, maxPaddingSize)
+		payload[maxPaddingSize-1] = maxPaddingSize
+
+		if _, err := d.writeStream.WriteRTP(&header, payload); err != nil {
+			if !errors.Is(err, io.ErrClosedPipe) {
+				log.Printf("[%s] Error writing padding to down track %s: %v", d.subscriber.id, d.id, err)
+			}
+			break
+		}
+		sent += maxPaddingSize
+	}
+	return sent
+}
+
+// retransmit answers a subscriber NACK, given in outgoing sequence numbers, from the
+// source's packet buffer. It returns the source's own sequence numbers of the packets it
+// couldn't find, which is what the publisher is asked for.
+//
+// pion v3 never signals an RTX SSRC for local tracks, so even when the subscriber negotiated
+// video/rtx there is no RTX stream it would accept. Retransmissions go out on the primary
+// SSRC with their original sequence number instead, which every receiver handles.
+func (d *DownTrack) retransmit(outSeqs []uint16) (missing []uint16) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.writeStream == nil {
+		return nil
+	}
+
+	for _, outSeq := range outSeqs {
+		seq, ok := d.rewriter.incomingSeq(outSeq)
+		if !ok {
+			// sent before the last source switch, nothing we can map it back to
+			continue
+		}
+
+		pkt := d.track.bufferedPacket(d.currentLayer, seq)
+		if pkt == nil {
+			missing = append(missing, seq)
+			continue
+		}
+		d.writePacketLocked(pkt, outSeq, d.rewriter.outgoingTimestamp(pkt))
+		d.stats.sent(pkt, false)
+	}
+	return missing
+}
+
+// writePacketLocked sends a publisher packet with the outgoing sequence number and timestamp
+// chosen by the rewriter, under this down track's own SSRC and payload type.
+func (d *DownTrack) writePacketLocked(pkt *rtp.Packet, seq uint16, ts uint32) {
+	header := pkt.Header
+	header.SSRC = uint32(d.ssrc)
+	header.PayloadType = uint8(d.payloadType)
+	header.SequenceNumber = seq
+	header.Timestamp = ts
+	// extension IDs are negotiated per PeerConnection, the publisher's IDs mean nothing to the subscriber
+	header.Extension = false
+	header.Extensions = nil
+	header.Padding = false
+	header.PaddingSize = 0
+
+	if _, err := d.writeStream.WriteRTP(&header, pkt.Payload); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		log.Printf("[%s] Error writing to down track %s: %v", d.subscriber.id, d.id, err)
+		return
+	}
+	forwardedPackets.With(d.kind.String()).Inc()
+	forwardedBytes.With(d.kind.String()).Add(uint64(len(pkt.Payload)))
+}
+
+// matchCodec finds the subscriber's payload type for the publisher's codec, preferring an
+// exact fmtp match since H264 profiles with the same mime type aren't interchangeable.
+func matchCodec(codec webrtc.RTPCodecCapability, negotiated []webrtc.RTPCodecParameters) (webrtc.RTPCodecParameters, error) {
+	var fallback *webrtc.RTPCodecParameters
+	for i := range negotiated {
+		if !strings.EqualFold(negotiated[i].MimeType, codec.MimeType) {
+			continue
+		}
+		if negotiated[i].SDPFmtpLine == codec.SDPFmtpLine {
+			return negotiated[i], nil
+		}
+		if fallback == nil {
+			fallback = &negotiated[i]
+		}
+	}
+
+	if fallback != nil {
+		return *fallback, nil
+	}
+	return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+}
@@ -0,0 +1,217 @@
+package sfu_server
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// keyframeRequestInterval is the minimum time between two keyframe requests sent to the
+// publisher for the same layer. Every subscriber that joins or loses a packet asks for a
+// keyframe, forwarding all of those would make the publisher send nothing but keyframes.
+const keyframeRequestInterval = 500 * time.Millisecond
+
+// nackFlushDelay is how long NACKs from different subscribers are collected before being
+// sent upstream, subscribers behind the same lossy hop tend to miss the same packets.
+const nackFlushDelay = 10 * time.Millisecond
+
+// feedbackAggregator merges the RTCP feedback of every subscriber of a PublishedTrack
+// into what actually gets sent to its publisher.
+type feedbackAggregator struct {
+	track *PublishedTrack
+
+	mu                  sync.Mutex
+	lastKeyframeRequest map[string]time.Time // per layer
+	firSequenceNumber   uint8
+	pendingNacks        map[string]map[uint16]struct{} // per layer, incoming sequence numbers
+	nackFlushScheduled  bool
+}
+
+func newFeedbackAggregator(track *PublishedTrack) *feedbackAggregator {
+	return &feedbackAggregator{
+		track:               track,
+		lastKeyframeRequest: make(map[string]time.Time),
+		pendingNacks:        make(map[string]map[uint16]struct{}),
+	}
+}
+
+// requestKeyframe forwards a keyframe request for one layer unless one was sent recently.
+// useFIR keeps the request type the subscriber used, some decoders only react to FIR.
+func (f *feedbackAggregator) requestKeyframe(rid string, useFIR bool) {
+	if f.track.kind != webrtc.RTPCodecTypeVideo {
+		return
+	}
+
+	ssrc, ok := f.track.layerSSRC(rid)
+	if !ok {
+		return
+	}
+
+	f.mu.Lock()
+	if time.Since(f.lastKeyframeRequest[rid]) < keyframeRequestInterval {
+		f.mu.Unlock()
+		return
+	}
+	f.lastKeyframeRequest[rid] = time.Now()
+
+	var pkt rtcp.Packet = &rtcp.PictureLossIndication{MediaSSRC: uint32(ssrc)}
+	if useFIR {
+		f.firSequenceNumber++
+		pkt = &rtcp.FullIntraRequest{
+			MediaSSRC: uint32(ssrc),
+			FIR:       []rtcp.FIREntry{{SSRC: uint32(ssrc), SequenceNumber: f.firSequenceNumber}},
+		}
+	}
+	f.mu.Unlock()
+
+	if err := f.track.writeRTCP([]rtcp.Packet{pkt}); err != nil {
+		log.Printf("[%s] Failed to request keyframe for track %s layer %q: %v", f.track.publisherID, f.track.id, rid, err)
+	}
+}
+
+// nack queues incoming sequence numbers lost by a subscriber and schedules a flush.
+func (f *feedbackAggregator) nack(rid string, sequenceNumbers []uint16) {
+	if len(sequenceNumbers) == 0 {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pending, ok := f.pendingNacks[rid]
+	if !ok {
+		pending = make(map[uint16]struct{})
+		f.pendingNacks[rid] = pending
+	}
+	for _, seq := range sequenceNumbers {
+		pending[seq] = struct{}{}
+	}
+
+	if !f.nackFlushScheduled {
+		f.nackFlushScheduled = true
+		time.AfterFunc(nackFlushDelay, f.flushNacks)
+	}
+}
+
+// flushNacks sends one NACK per layer with every sequence number collected since the last flush.
+func (f *feedbackAggregator) flushNacks() {
+	f.mu.Lock()
+	pendingNacks := f.pendingNacks
+	f.pendingNacks = make(map[string]map[uint16]struct{})
+	f.nackFlushScheduled = false
+	f.mu.Unlock()
+
+	var pkts []rtcp.Packet
+	for rid, pending := range pendingNacks {
+		ssrc, ok := f.track.layerSSRC(rid)
+		if !ok {
+			continue
+		}
+
+		sequenceNumbers := make([]uint16, 0, len(pending))
+		for seq := range pending {
+			sequenceNumbers = append(sequenceNumbers, seq)
+		}
+		// RTP order rather than numeric order, so a NACK spanning a wrap around stays compact
+		sort.Slice(sequenceNumbers, func(i, j int) bool { return isSeqOlder(sequenceNumbers[i], sequenceNumbers[j]) })
+
+		pkts = append(pkts, &rtcp.TransportLayerNack{
+			MediaSSRC: uint32(ssrc),
+			Nacks:     rtcp.NackPairsFromSequenceNumbers(sequenceNumbers),
+		})
+	}
+
+	if len(pkts) == 0 {
+		return
+	}
+	if err := f.track.writeRTCP(pkts); err != nil {
+		log.Printf("[%s] Failed to forward NACKs for track %s: %v", f.track.publisherID, f.track.id, err)
+	}
+}
+
+// readRTCP reads the feedback a subscriber sends for this DownTrack until its sender is stopped.
+// Reading is also what drives the interceptors of the sender, so it has to happen even when
+// we don't care about the packets.
+func (d *DownTrack) readRTCP() {
+	for {
+		pkts, _, err := d.sender.ReadRTCP()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) {
+				log.Printf("[%s] Error reading RTCP of down track %s: %v", d.subscriber.id, d.id, err)
+			}
+			return
+		}
+
+		for _, pkt := range pkts {
+			d.handleRTCP(pkt)
+		}
+	}
+}
+
+// handleRTCP routes one feedback packet of the subscriber to the source it is currently receiving.
+func (d *DownTrack) handleRTCP(pkt rtcp.Packet) {
+	switch p := pkt.(type) {
+	case *rtcp.PictureLossIndication:
+		source, layer := d.feedbackTarget()
+		source.feedback.requestKeyframe(layer, false)
+
+	case *rtcp.FullIntraRequest:
+		source, layer := d.feedbackTarget()
+		source.feedback.requestKeyframe(layer, true)
+
+	case *rtcp.TransportLayerNack:
+		var outSeqs []uint16
+		for _, pair := range p.Nacks {
+			outSeqs = append(outSeqs, pair.PacketList()...)
+		}
+
+		// whatever is still in our buffer is answered right away, only the rest costs
+		// a round trip to the publisher
+		missing := d.retransmit(outSeqs)
+		source, layer := d.nackTarget()
+		source.feedback.nack(layer, missing)
+
+	case *rtcp.ReceiverReport:
+		d.receptionReports(p.Reports)
+
+	case *rtcp.SenderReport:
+		// subscribers that also publish put their reception reports in sender reports
+		d.receptionReports(p.Reports)
+
+	case *rtcp.ReceiverEstimatedMaximumBitrate:
+		// REMB covers the subscriber's whole downlink, not just this track
+		d.subscriber.bandwidth.onREMB(p.Bitrate)
+	}
+}
+
+// receptionReports keeps the report about this down track's SSRC for the stats.
+func (d *DownTrack) receptionReports(reports []rtcp.ReceptionReport) {
+	ssrc := uint32(d.SSRC())
+	now := time.Now()
+	for _, report := range reports {
+		if report.SSRC == ssrc {
+			d.stats.receiverReport(report, now)
+		}
+	}
+}
+
+// nackTarget returns the source and layer whose sequence numbers NACKs refer to.
+func (d *DownTrack) nackTarget() (*PublishedTrack, string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.track, d.currentLayer
+}
+
+// feedbackTarget returns the source and layer keyframe requests should go to, while a
+// layer switch is pending that's the layer we are waiting for.
+func (d *DownTrack) feedbackTarget() (*PublishedTrack, string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.track, d.targetLayer
+}
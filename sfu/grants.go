@@ -0,0 +1,108 @@
+package sfu_server
+
+import (
+	"errors"
+	"log"
+
+	"github.com/samyak112/monoport/auth"
+)
+
+// ErrNotGranted is returned when a peer's access token doesn't allow what it asked for.
+var ErrNotGranted = errors.New("not allowed by the access token")
+
+// peerGrant is what the access token of a websocket peer allows.
+type peerGrant struct {
+	room        string // the only room the peer may join, empty for any
+	grants      auth.Grants
+	connections int // websockets authenticated as the peer, the grant goes with the last
+}
+
+// RequireAuthorization makes peers without an access token, or whose websockets are all
+// gone, get no grants at all. Without it they may do anything, which is how the server runs
+// with authentication off.
+func (s *SFU) RequireAuthorization() {
+	s.roomsLock.Lock()
+	defer s.roomsLock.Unlock()
+	s.authRequired = true
+}
+
+// Authorize records the access token a websocket authenticated with as peerID. Every call
+// has to be matched by a Deauthorize when the websocket closes, the peer keeps the grants of
+// its latest token while any of its websockets is open.
+func (s *SFU) Authorize(peerID string, claims *auth.Claims) {
+	s.roomsLock.Lock()
+	defer s.roomsLock.Unlock()
+	grant, ok := s.grants[peerID]
+	if !ok {
+		grant = &peerGrant{}
+		s.grants[peerID] = grant
+	}
+	grant.room, grant.grants = claims.Room, claims.Grants
+	grant.connections++
+	log.Printf("[%s] Authorized for room %q with %+v", peerID, claims.Room, claims.Grants)
+}
+
+// Deauthorize is called when a websocket that authenticated as peerID closes. A
+// PeerConnection that is still up keeps the grants it was created with.
+func (s *SFU) Deauthorize(peerID string) {
+	s.roomsLock.Lock()
+	defer s.roomsLock.Unlock()
+	grant, ok := s.grants[peerID]
+	if !ok {
+		return
+	}
+	grant.connections--
+	if grant.connections <= 0 {
+		delete(s.grants, peerID)
+	}
+}
+
+// grantsOf returns the grants of a peer's access token. A peer without one gets nil, which
+// allows anything, or no grants when authorization is required.
+func (s *SFU) grantsOf(peerID string) *auth.Grants {
+	s.roomsLock.RLock()
+	defer s.roomsLock.RUnlock()
+	if grant, ok := s.grants[peerID]; ok {
+		grants := grant.grants
+		return &grants
+	}
+	if s.authRequired {
+		return &auth.Grants{}
+	}
+	return nil
+}
+
+// requestedRoomLocked returns the room a peer is placed in when its offer arrives: the one
+// it asked for in join-room, else the one its access token is for. roomsLock must be held.
+func (s *SFU) requestedRoomLocked(peerID string) string {
+	if request, ok := s.peerRooms[peerID]; ok {
+		return request.roomID
+	}
+	if grant, ok := s.grants[peerID]; ok && grant.room != "" {
+		return grant.room
+	}
+	return DefaultRoomID
+}
+
+// httpGrants returns the grants of a WHIP or WHEP peer, whose request was authorized for
+// publishing or subscribing by the HTTP handler.
+func (s *SFU) httpGrants(publishOnly bool) *auth.Grants {
+	s.roomsLock.RLock()
+	defer s.roomsLock.RUnlock()
+	if !s.authRequired {
+		return nil
+	}
+	return &auth.Grants{CanPublish: publishOnly, CanSubscribe: !publishOnly}
+}
+
+func (pcs *PeerConnectionState) canPublish() bool {
+	return pcs.grants == nil || pcs.grants.CanPublish
+}
+
+func (pcs *PeerConnectionState) canSubscribe() bool {
+	return pcs.grants == nil || pcs.grants.CanSubscribe
+}
+
+func (pcs *PeerConnectionState) canPublishData() bool {
+	return pcs.grants == nil || pcs.grants.CanPublishData
+}
@@ -0,0 +1,169 @@
+package sfu_server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/samyak112/monoport/hls"
+)
+
+// HLSOptions picks what the HLS stream of a room carries.
+type HLSOptions struct {
+	// VideoTrackID is the global ID of an H.264 track, empty picks the one of the most
+	// relevant publisher
+	VideoTrackID string `json:"videoTrackId"`
+	// AudioTrackID is the global ID of an Opus track, empty picks the one of the video's
+	// publisher, or of the most relevant publisher
+	AudioTrackID string `json:"audioTrackId"`
+	// LowLatency adds LL-HLS partial segments
+	LowLatency bool `json:"lowLatency"`
+}
+
+// hlsStream is the HLS output of a room, its tracks feed the muxer as sinks.
+type hlsStream struct {
+	sinkID string
+	muxer  *hls.Muxer
+	tracks []*PublishedTrack
+}
+
+// StartHLS starts muxing a room's H.264 and Opus tracks into HLS, without transcoding.
+// A room has at most one stream, a stream that ended because its tracks went away is
+// replaced. Viewers read it through HLSHandler.
+func (s *SFU) StartHLS(roomID string, options HLSOptions) error {
+	if roomID == "" {
+		roomID = DefaultRoomID
+	}
+
+	s.roomsLock.RLock()
+	room, ok := s.rooms[roomID]
+	s.roomsLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown room %s", roomID)
+	}
+
+	video, err := room.hlsTrack(options.VideoTrackID, webrtc.RTPCodecTypeVideo, webrtc.MimeTypeH264, "")
+	if err != nil {
+		return err
+	}
+	publisherID := ""
+	if video != nil {
+		publisherID = video.publisherID
+	}
+	audio, err := room.hlsTrack(options.AudioTrackID, webrtc.RTPCodecTypeAudio, webrtc.MimeTypeOpus, publisherID)
+	if err != nil {
+		return err
+	}
+	if video == nil && audio == nil {
+		return fmt.Errorf("room %s has no H.264 or Opus track to stream", roomID)
+	}
+
+	config := hls.DefaultConfig()
+	if options.LowLatency {
+		config.PartDuration = hls.DefaultPartDuration
+	}
+	stream := &hlsStream{sinkID: "hls-" + roomID, muxer: hls.NewMuxer(config)}
+
+	s.hlsLock.Lock()
+	previous, ok := s.hlsStreams[roomID]
+	if ok && !previous.muxer.Ended() {
+		s.hlsLock.Unlock()
+		return fmt.Errorf("room %s is already streamed over HLS", roomID)
+	}
+	s.hlsStreams[roomID] = stream
+	s.hlsLock.Unlock()
+	if ok {
+		// a track that outlived the end of the previous stream still feeds it
+		for _, track := range previous.tracks {
+			track.removeSink(previous.sinkID)
+		}
+	}
+
+	// every track is added to the muxer before any of them starts writing
+	var sinks []rtpSink
+	if video != nil {
+		stream.tracks = append(stream.tracks, video)
+		sinks = append(sinks, stream.muxer.AddVideoTrack())
+	}
+	if audio != nil {
+		stream.tracks = append(stream.tracks, audio)
+		sinks = append(sinks, stream.muxer.AddAudioTrack(audio.codec.Channels))
+	}
+	for i, track := range stream.tracks {
+		track.addSink(stream.sinkID, sinks[i])
+		log.Printf("HLS stream of room %s carries track %s", roomID, track.id)
+	}
+	return nil
+}
+
+// hlsTrack resolves the track a stream carries for one kind: the given one, which then
+// has to exist and use mimeType, or the best one available, possibly none.
+func (r *Room) hlsTrack(trackID string, kind webrtc.RTPCodecType, mimeType, preferredPublisher string) (*PublishedTrack, error) {
+	if trackID != "" {
+		track := r.publishedTrack(trackID)
+		if track == nil {
+			return nil, fmt.Errorf("unknown track %s in room %s", trackID, r.id)
+		}
+		if track.kind != kind || !strings.EqualFold(track.codec.MimeType, mimeType) {
+			return nil, fmt.Errorf("track %s is %s, HLS needs %s", trackID, track.codec.MimeType, mimeType)
+		}
+		return track, nil
+	}
+
+	tracks := r.tracksByPublisher(kind)
+	for publisherID, published := range tracks {
+		published = slices.DeleteFunc(published, func(t *PublishedTrack) bool {
+			return !strings.EqualFold(t.codec.MimeType, mimeType)
+		})
+		if len(published) == 0 {
+			delete(tracks, publisherID)
+			continue
+		}
+		slices.SortFunc(published, func(a, b *PublishedTrack) int { return strings.Compare(a.id, b.id) })
+		tracks[publisherID] = published
+	}
+
+	if published, ok := tracks[preferredPublisher]; ok {
+		return published[0], nil
+	}
+	if ranking := r.rankPublishers(tracks); len(ranking) > 0 {
+		return tracks[ranking[0]][0], nil
+	}
+	return nil, nil
+}
+
+// StopHLS ends the HLS stream of a room.
+func (s *SFU) StopHLS(roomID string) error {
+	if roomID == "" {
+		roomID = DefaultRoomID
+	}
+
+	s.hlsLock.Lock()
+	stream, ok := s.hlsStreams[roomID]
+	delete(s.hlsStreams, roomID)
+	s.hlsLock.Unlock()
+	if !ok {
+		return fmt.Errorf("room %s is not streamed over HLS", roomID)
+	}
+
+	// closing the sinks ends the muxer, players that still hold the playlist see ENDLIST
+	for _, track := range stream.tracks {
+		track.removeSink(stream.sinkID)
+	}
+	log.Printf("Stopped HLS stream of room %s", roomID)
+	return nil
+}
+
+// HLSHandler returns what serves the playlist and segments of a room's HLS stream.
+func (s *SFU) HLSHandler(roomID string) (http.Handler, bool) {
+	s.hlsLock.RLock()
+	defer s.hlsLock.RUnlock()
+	stream, ok := s.hlsStreams[roomID]
+	if !ok {
+		return nil, false
+	}
+	return stream.muxer, true
+}
@@ -0,0 +1,113 @@
+package sfu_server
+
+import (
+	"fmt"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/interceptor/pkg/twcc"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// InterceptorConfig selects the interceptors every PeerConnection of the API is built with.
+// Interceptors sit between pion's RTP/RTCP streams and the SFU and are where things like
+// reports and congestion control feedback get generated.
+//
+// There is deliberately no NACK responder here, subscriber NACKs are answered by the SFU
+// itself from the retransmission buffer of each published track. A pion responder would
+// keep a second copy of every packet and retransmit the same packet twice.
+type InterceptorConfig struct {
+	// NACK asks publishers to retransmit packets lost on their uplink.
+	NACK bool
+	// Reports sends RTCP sender reports to subscribers (needed for lip sync) and receiver
+	// reports to publishers.
+	Reports bool
+	// TWCC negotiates transport wide congestion control. Publishers get TWCC feedback for
+	// what they send us, and everything we send to subscribers carries the TWCC sequence
+	// number extension so subscribers can send feedback too.
+	TWCC bool
+	// BandwidthEstimation runs congestion control on the TWCC feedback of subscribers,
+	// it needs TWCC. The same value has to be passed to SFU.EnableBandwidthEstimation.
+	BandwidthEstimation *BandwidthEstimation
+
+	// Interceptors are added after the built-in ones, in order.
+	Interceptors []interceptor.Factory
+	// Configure runs last with the media engine and the registry, for interceptors that
+	// also need to negotiate RTCP feedback or header extensions.
+	Configure func(*webrtc.MediaEngine, *interceptor.Registry) error
+}
+
+// DefaultInterceptorConfig enables every built-in interceptor.
+func DefaultInterceptorConfig() InterceptorConfig {
+	return InterceptorConfig{
+		NACK:    true,
+		Reports: true,
+		TWCC:    true,
+
+		BandwidthEstimation: NewBandwidthEstimation(),
+	}
+}
+
+// register adds the configured interceptors to the registry, and the feedback and header
+// extensions they rely on to the media engine.
+func (c InterceptorConfig) register(m *webrtc.MediaEngine, registry *interceptor.Registry) error {
+	if c.NACK {
+		generator, err := nack.NewGeneratorInterceptor()
+		if err != nil {
+			return fmt.Errorf("creating NACK generator: %w", err)
+		}
+		m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+		m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+		registry.Add(generator)
+	}
+
+	if c.Reports {
+		if err := webrtc.ConfigureRTCPReports(registry); err != nil {
+			return fmt.Errorf("creating RTCP report interceptors: %w", err)
+		}
+	}
+
+	if c.BandwidthEstimation != nil && !c.TWCC {
+		return fmt.Errorf("bandwidth estimation needs TWCC to be enabled")
+	}
+
+	if c.TWCC {
+		// estimation has to be added before the header extension interceptor,
+		// interceptors wrap each other so it then sees packets with the extension set
+		if c.BandwidthEstimation != nil {
+			if err := c.BandwidthEstimation.register(registry); err != nil {
+				return err
+			}
+		}
+
+		// feedback towards publishers
+		if err := webrtc.ConfigureTWCCSender(m, registry); err != nil {
+			return fmt.Errorf("creating TWCC feedback interceptor: %w", err)
+		}
+
+		// sequence numbers on what we send, so subscribers can report back
+		headerExtension, err := twcc.NewHeaderExtensionInterceptor()
+		if err != nil {
+			return fmt.Errorf("creating TWCC header extension interceptor: %w", err)
+		}
+		for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+			if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.TransportCCURI}, kind); err != nil {
+				return fmt.Errorf("registering TWCC header extension: %w", err)
+			}
+		}
+		registry.Add(headerExtension)
+	}
+
+	for _, factory := range c.Interceptors {
+		registry.Add(factory)
+	}
+
+	if c.Configure != nil {
+		if err := c.Configure(m, registry); err != nil {
+			return fmt.Errorf("running interceptor configure hook: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package sfu_server
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// LastNEvent is the data of a last-n message, it tells a subscriber which of the video
+// tracks it is subscribed to are currently forwarded. The others stay negotiated but
+// receive nothing, so the UI can show an avatar instead of a frozen frame.
+type LastNEvent struct {
+	LastN  int      `json:"lastN"`  // 0 when every video is forwarded
+	Live   []string `json:"live"`   // publisher peer IDs whose video is forwarded, null when LastN is 0
+	Pinned []string `json:"pinned"` // publisher peer IDs pinned by this subscriber, always live
+}
+
+// SetLastN sets how many of the most recent dominant speakers every peer of a room receives
+// video from, 0 forwards all video. Audio is never affected.
+func (s *SFU) SetLastN(roomID string, n int) error {
+	if n < 0 {
+		return fmt.Errorf("last-N can't be negative, got %d", n)
+	}
+	if roomID == "" {
+		roomID = DefaultRoomID
+	}
+
+	s.roomsLock.RLock()
+	room, ok := s.rooms[roomID]
+	s.roomsLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown room %s", roomID)
+	}
+
+	log.Printf("Last-N of room %s set to %d", roomID, n)
+	room.lastN.Store(int32(n))
+	room.applyLastN()
+	return nil
+}
+
+// Pin makes peerID always receive the video of publisherID, regardless of last-N.
+func (s *SFU) Pin(peerID, publisherID string) error {
+	return s.setPinned(peerID, publisherID, true)
+}
+
+// Unpin undoes Pin, the publisher's video goes back to being ranked like everyone else's.
+func (s *SFU) Unpin(peerID, publisherID string) error {
+	return s.setPinned(peerID, publisherID, false)
+}
+
+func (s *SFU) setPinned(peerID, publisherID string, pinned bool) error {
+	s.peersLock.RLock()
+	pcs, ok := s.peers[peerID]
+	s.peersLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown peer %s", peerID)
+	}
+	if publisherID == "" || publisherID == peerID {
+		return fmt.Errorf("peer %s can't pin %q", peerID, publisherID)
+	}
+
+	pcs.lastNLock.Lock()
+	if pinned {
+		pcs.pinned[publisherID] = true
+	} else {
+		delete(pcs.pinned, publisherID)
+	}
+	pcs.lastNLock.Unlock()
+
+	pcs.room.applyLastN()
+	return nil
+}
+
+// applyLastN pauses and resumes the video DownTracks of every subscriber of the room so that
+// each one only receives its pinned publishers and the lastN most recent dominant speakers.
+// Tracks are paused rather than removed, switching tiles doesn't need a renegotiation.
+func (r *Room) applyLastN() {
+	r.lastNLock.Lock()
+	defer r.lastNLock.Unlock()
+
+	lastN := int(r.lastN.Load())
+
+	videoTracks := r.tracksByPublisher(webrtc.RTPCodecTypeVideo)
+	ranking := r.rankPublishers(videoTracks)
+
+	r.peersLock.RLock()
+	subscribers := make([]*PeerConnectionState, 0, len(r.peers))
+	for _, pcs := range r.peers {
+		subscribers = append(subscribers, pcs)
+	}
+	r.peersLock.RUnlock()
+
+	for _, pcs := range subscribers {
+		pcs.lastNLock.Lock()
+		pinned := make([]string, 0, len(pcs.pinned))
+		for publisherID := range pcs.pinned {
+			pinned = append(pinned, publisherID)
+		}
+		sort.Strings(pinned)
+
+		// without last-N live stays nil, everything is forwarded and there is nothing to tell
+		var live []string
+		if lastN > 0 {
+			live = append(live, pinned...)
+			slots := lastN
+			for _, publisherID := range ranking {
+				if slots == 0 {
+					break
+				}
+				if publisherID == pcs.id || pcs.pinned[publisherID] {
+					continue
+				}
+				live = append(live, publisherID)
+				slots--
+			}
+		}
+
+		changed := !slices.Equal(live, pcs.liveVideo)
+		pcs.liveVideo = live
+		pcs.lastNLock.Unlock()
+
+		for publisherID, tracks := range videoTracks {
+			paused := lastN > 0 && !slices.Contains(live, publisherID)
+			for _, track := range tracks {
+				if downTrack := track.downTrackFor(pcs.id); downTrack != nil {
+					downTrack.setLastNPaused(paused)
+				}
+			}
+		}
+
+		if changed {
+			pcs.bandwidth.reallocate()
+			pcs.sendEvent("last-n", LastNEvent{LastN: lastN, Live: live, Pinned: pinned})
+		}
+	}
+}
+
+// tracksByPublisher groups the tracks of one kind published in the room by publisher.
+func (r *Room) tracksByPublisher(kind webrtc.RTPCodecType) map[string][]*PublishedTrack {
+	tracks := make(map[string][]*PublishedTrack)
+	r.trackLock.RLock()
+	for _, track := range r.trackLocals {
+		if track.kind == kind {
+			tracks[track.publisherID] = append(tracks[track.publisherID], track)
+		}
+	}
+	r.trackLock.RUnlock()
+	return tracks
+}
+
+// rankPublishers orders publishers by how relevant they are: recent dominant speakers
+// first, then the ones that never spoke in ID order, so a room that stays quiet still
+// fills up to lastN tiles.
+func (r *Room) rankPublishers(tracks map[string][]*PublishedTrack) []string {
+	var ranking []string
+	for _, peerID := range r.speakers.recentSpeakers() {
+		if _, ok := tracks[peerID]; ok {
+			ranking = append(ranking, peerID)
+		}
+	}
+	var quiet []string
+	for peerID := range tracks {
+		if !slices.Contains(ranking, peerID) {
+			quiet = append(quiet, peerID)
+		}
+	}
+	sort.Strings(quiet)
+	return append(ranking, quiet...)
+}
+
+// isLastNLive reports whether pcs currently receives video from publisherID, as of the last
+// applyLastN. New DownTracks start paused when they aren't, rather than flashing a few frames.
+func (pcs *PeerConnectionState) isLastNLive(publisherID string) bool {
+	if pcs.room.lastN.Load() == 0 {
+		return true
+	}
+	pcs.lastNLock.Lock()
+	defer pcs.lastNLock.Unlock()
+	return pcs.pinned[publisherID] || slices.Contains(pcs.liveVideo, publisherID)
+}
+
+// setLastNPaused pauses or resumes a DownTrack on behalf of last-N.
+func (d *DownTrack) setLastNPaused(paused bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.setPausedLocked(pauseByLastN, paused)
+}
@@ -5,27 +5,61 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"time"
 
+	"github.com/pion/interceptor/pkg/cc"
 	"github.com/pion/webrtc/v3"
 	"github.com/samyak112/monoport/transport" // Assuming this is your transport package
 )
 
-// NewSFU creates and initializes a new SFU instance.
+// NewSFU creates and initializes a new SFU instance. Its PeerConnections use no ICE servers
+// until SetICEServers is called.
 func NewSFU(api *webrtc.API, signalChannel chan *transport.SignalMessage) *SFU {
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:34.44.36.231:5000"},
-			},
-		},
-	}
-	return &SFU{
+	config := webrtc.Configuration{}
+	s := &SFU{
 		peers:             make(map[string]*PeerConnectionState),
-		trackLocals:       make(map[string]*webrtc.TrackLocalStaticRTP),
+		httpResources:     make(map[string]*PeerConnectionState),
+		rooms:             make(map[string]*Room),
+		peerRooms:         make(map[string]roomRequest),
+		recordings:        make(map[string]*recording),
+		recordingDir:      DefaultRecordingDir,
+		recordingMax:      defaultMaxRecordings,
+		rtpIngests:        make(map[string]*rtpIngest),
+		rtpIngestMax:      defaultMaxRTPIngests,
+		hlsStreams:        make(map[string]*hlsStream),
+		stats:             newStatsRegistry(),
+		bans:              make(map[string]map[string]bool),
+		grants:            make(map[string]*peerGrant),
 		config:            config,
 		api:               api,
 		signalChannelSend: signalChannel,
 	}
+	s.registerMetrics()
+	go s.sampleStats()
+	return s
+}
+
+// SetICEServers sets the STUN and TURN servers of the PeerConnections created from now on,
+// the same list is handed to clients by ICEServers.
+func (s *SFU) SetICEServers(servers []webrtc.ICEServer) {
+	s.pcCreateLock.Lock()
+	defer s.pcCreateLock.Unlock()
+	s.config.ICEServers = servers
+}
+
+// SetAPI replaces the WebRTC API PeerConnections are created from, existing ones keep
+// running on the old one. It must be built with the same BandwidthEstimation.
+func (s *SFU) SetAPI(api *webrtc.API) {
+	s.pcCreateLock.Lock()
+	defer s.pcCreateLock.Unlock()
+	s.api = api
+}
+
+// ICEServers returns the STUN and TURN servers clients should use.
+func (s *SFU) ICEServers() []webrtc.ICEServer {
+	s.pcCreateLock.Lock()
+	defer s.pcCreateLock.Unlock()
+	return s.config.ICEServers
 }
 
 // func createCustomCandidate() (ice.Candidate, error) {
@@ -77,27 +111,27 @@ func (s *SFU) DispatchSignal(peerID string, signal interface{}) {
 
 // HandleNewPeerOffer is called when a new peer sends an SDP offer.
 func (s *SFU) HandleNewPeerOffer(peerID string, offer webrtc.SessionDescription) {
+	if err := s.checkNotBanned(peerID); err != nil {
+		log.Printf("[%s] Rejecting offer: %v", peerID, err)
+		s.RejectJoin(peerID, err)
+		return
+	}
+
 	s.peersLock.Lock()
 	pcs, ok := s.peers[peerID]
 	if !ok {
 		// This is a new peer, create the connection state.
 		log.Printf("Handling offer for new peer: %s", peerID)
-		peerConnection, err := s.api.NewPeerConnection(s.config)
+		peerConnection, estimator, err := s.newPeerConnection()
 		if err != nil {
 			log.Printf("Failed to create PeerConnection for %s: %v", peerID, err)
 			s.peersLock.Unlock()
 			return
 		}
 
-		pcs = &PeerConnectionState{
-			id:             peerID,
-			peerConnection: peerConnection,
-			sfu:            s,
-			signalQueue:    make([]interface{}, 0),
-		}
-
-		s.peers[peerID] = pcs
-		s.configurePeerConnection(pcs)
+		pcs = s.newPeerConnectionState(peerID, peerConnection, estimator)
+		pcs.grants = s.grantsOf(peerID)
+		s.addPeerLocked(pcs)
 	} else {
 		fmt.Println("duplicate came")
 	}
@@ -107,6 +141,35 @@ func (s *SFU) HandleNewPeerOffer(peerID string, offer webrtc.SessionDescription)
 	s.DispatchSignal(peerID, offerSignal{sdp: offer})
 }
 
+// newPeerConnectionState wraps a freshly created PeerConnection.
+func (s *SFU) newPeerConnectionState(peerID string, peerConnection *webrtc.PeerConnection, estimator cc.BandwidthEstimator) *PeerConnectionState {
+	pcs := &PeerConnectionState{
+		id:             peerID,
+		peerConnection: peerConnection,
+		sfu:            s,
+		signalQueue:    make([]interface{}, 0),
+		done:           make(chan struct{}),
+		pinned:         make(map[string]bool),
+		dataChannels:   make(map[string]*relayChannel),
+	}
+	pcs.bandwidth = newBandwidthAllocator(pcs, estimator)
+	return pcs
+}
+
+// addPeerLocked registers a new peer, places it in the room it asked for and starts
+// handling its PeerConnection. peersLock must be held.
+func (s *SFU) addPeerLocked(pcs *PeerConnectionState) {
+	s.peers[pcs.id] = pcs
+	pcs.room = s.roomForPeer(pcs)
+	log.Printf("[%s] Added to room %s", pcs.id, pcs.room.id)
+	if pcs.room.isModerator(pcs.id) {
+		// the signaling channel can block, peersLock is held here
+		go pcs.sendEvent("moderator", map[string]interface{}{"roomId": pcs.room.id, "moderator": true})
+	}
+	go pcs.bandwidth.run(pcs.done)
+	s.configurePeerConnection(pcs)
+}
+
 // HandleIceCandidate is called when a new ICE candidate is received from a peer.
 func (s *SFU) HandleIceCandidate(peerID string, candidateStr string) {
 	var candidate webrtc.ICECandidateInit
@@ -150,21 +213,26 @@ func (pcs *PeerConnectionState) handleOffer(offer webrtc.SessionDescription) {
 
 	if err := pcs.peerConnection.SetRemoteDescription(offer); err != nil {
 		log.Printf("[%s] Failed to set remote description: %v", pcs.id, err)
+		negotiationFailures.With(stepSetRemoteDescription).Inc()
 		pcs.sfu.cleanupPeer(pcs.id)
 		return
 	}
 
-	pcs.sfu.addExistingTracksToPeer(pcs)
+	if pcs.room.autoSubscribe.Load() && pcs.canSubscribe() {
+		pcs.room.addExistingTracksToPeer(pcs)
+	}
 
 	answer, err := pcs.peerConnection.CreateAnswer(nil)
 	if err != nil {
 		log.Printf("[%s] Failed to create answer: %v", pcs.id, err)
+		negotiationFailures.With(stepCreateAnswer).Inc()
 		pcs.sfu.cleanupPeer(pcs.id)
 		return
 	}
 
 	if err := pcs.peerConnection.SetLocalDescription(answer); err != nil {
 		log.Printf("[%s] Failed to set local description: %v", pcs.id, err)
+		negotiationFailures.With(stepSetLocalDescription).Inc()
 		pcs.sfu.cleanupPeer(pcs.id)
 		return
 	}
@@ -193,6 +261,7 @@ func (pcs *PeerConnectionState) handleAnswer(answer webrtc.SessionDescription) {
 	// This completes the renegotiation initiated by the SFU.
 	if err := pcs.peerConnection.SetRemoteDescription(answer); err != nil {
 		log.Printf("[%s] Failed to set remote description for answer: %v", pcs.id, err)
+		negotiationFailures.With(stepSetRemoteDescription).Inc()
 		pcs.sfu.cleanupPeer(pcs.id)
 		return
 	}
@@ -223,15 +292,38 @@ func (s *SFU) configurePeerConnection(pcs *PeerConnectionState) {
 	peerID := pcs.id
 	peerConnection := pcs.peerConnection
 
+	// WHIP and WHEP peers negotiate once over HTTP and have nowhere to receive an offer
+	// or a trickled candidate, their answer already carries every candidate
+	if !pcs.httpSignaled {
+		s.configureSignaling(pcs)
+	}
+
+	peerConnection.OnTrack(s.handleIncomingTrack(pcs))
+	peerConnection.OnDataChannel(s.handleDataChannel(pcs))
+	peerConnection.OnConnectionStateChange(s.handleConnectionStateChange(peerID))
+
+	peerConnection.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		log.Printf("[%s] ICE Connection State has changed: %s", peerID, state)
+
+	})
+}
+
+// configureSignaling sets up the callbacks that send offers and candidates to the peer over the websocket.
+func (s *SFU) configureSignaling(pcs *PeerConnectionState) {
+	peerID := pcs.id
+	peerConnection := pcs.peerConnection
+
 	peerConnection.OnNegotiationNeeded(func() {
 		log.Printf("[%s] Negotiation needed, creating new offer...", peerID)
 		offer, err := peerConnection.CreateOffer(nil)
 		if err != nil {
 			log.Printf("[%s] Failed to create negotiation offer: %v", peerID, err)
+			negotiationFailures.With(stepCreateOffer).Inc()
 			return
 		}
 		if err := peerConnection.SetLocalDescription(offer); err != nil {
 			log.Printf("[%s] Failed to set local description for negotiation: %v", peerID, err)
+			negotiationFailures.With(stepSetLocalDescription).Inc()
 			return
 		}
 		s.signalChannelSend <- &transport.SignalMessage{
@@ -240,120 +332,101 @@ func (s *SFU) configurePeerConnection(pcs *PeerConnectionState) {
 			SDP:    offer.SDP,
 		}
 	})
-
-	peerConnection.OnTrack(s.handleIncomingTrack(pcs))
 	peerConnection.OnICECandidate(s.handleICECandidate(peerID))
-	peerConnection.OnConnectionStateChange(s.handleConnectionStateChange(peerID))
-
-	peerConnection.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
-		log.Printf("[%s] ICE Connection State has changed: %s", peerID, state)
-
-	})
-}
-
-// addExistingTracksToPeer adds all currently active tracks to a new peer's connection.
-func (s *SFU) addExistingTracksToPeer(pcs *PeerConnectionState) {
-	s.trackLock.RLock()
-	defer s.trackLock.RUnlock()
-
-	if len(s.trackLocals) == 0 {
-		return
-	}
-
-	log.Printf("[%s] Adding %d existing tracks to new peer connection", pcs.id, len(s.trackLocals))
-	for globalTrackID, localTrack := range s.trackLocals {
-		log.Printf("[%s] Adding existing track %s to new peer", pcs.id, globalTrackID)
-		if _, err := pcs.peerConnection.AddTrack(localTrack); err != nil {
-			log.Printf("[%s] Failed to add existing track %s to new peer: %v", pcs.id, globalTrackID, err)
-		}
-	}
 }
 
-// handleIncomingTrack is called when a remote track is received from a peer.
+// handleIncomingTrack is called when a remote track is received from a peer. A simulcast
+// publisher triggers it once per RID, all of them end up as layers of the same PublishedTrack.
 func (s *SFU) handleIncomingTrack(pcs *PeerConnectionState) func(*webrtc.TrackRemote, *webrtc.RTPReceiver) {
 	return func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 		fmt.Println("ready to process tracks")
-		globalTrackID := fmt.Sprintf("%s_%s_%s", pcs.id, remoteTrack.Kind(), remoteTrack.ID())
-
-		localTrack, err := webrtc.NewTrackLocalStaticRTP(remoteTrack.Codec().RTPCodecCapability, remoteTrack.ID(), remoteTrack.StreamID())
-		if err != nil {
-			log.Printf("[%s] Failed to create local track for forwarding: %v", pcs.id, err)
+		if !pcs.canPublish() {
+			log.Printf("[%s] Not allowed to publish, stopping track %s", pcs.id, remoteTrack.ID())
+			if err := receiver.Stop(); err != nil {
+				log.Printf("[%s] Failed to stop receiver: %v", pcs.id, err)
+			}
+			pcs.sendEvent("publish-rejected", map[string]string{"trackId": remoteTrack.ID(), "error": ErrNotGranted.Error()})
 			return
 		}
+		globalTrackID := fmt.Sprintf("%s_%s_%s", pcs.id, remoteTrack.Kind(), remoteTrack.ID())
 
-		s.trackLock.Lock()
-		s.trackLocals[globalTrackID] = localTrack
-		s.trackLock.Unlock()
+		track, created := pcs.room.publishTrack(globalTrackID, func() *PublishedTrack {
+			return newPublishedTrack(globalTrackID, pcs.id, remoteTrack.Kind(), remoteTrack.Codec().RTPCodecCapability, remoteTrack.StreamID(), pcs.peerConnection)
+		})
+		layer := track.addLayer(remoteTrack.RID(), remoteTrack)
+		if track.kind == webrtc.RTPCodecTypeAudio {
+			layer.audioLevelID = audioLevelExtensionID(receiver)
+		}
 
-		log.Printf("Created local track %s to forward from peer %s", globalTrackID, pcs.id)
-		s.addTrackToPeers(localTrack, globalTrackID, pcs.id)
-		go s.forwardRTP(pcs.id, globalTrackID, remoteTrack, localTrack)
+		if created {
+			s.announceTrack(pcs.room, track)
+		}
+		go s.forwardRTP(pcs.room, track, layer)
 	}
 }
 
-// addTrackToPeers adds a new local track to all connected peers except the originator.
-func (s *SFU) addTrackToPeers(localTrack *webrtc.TrackLocalStaticRTP, globalTrackID, originatorPeerID string) {
-	s.peersLock.RLock()
-	defer s.peersLock.RUnlock()
-
-	for otherPeerID, otherPCS := range s.peers {
-		if otherPeerID == originatorPeerID {
-			continue
-		}
-		if _, err := otherPCS.peerConnection.AddTrack(localTrack); err != nil {
-			log.Printf("Failed to add track %s to peer %s: %v", globalTrackID, otherPeerID, err)
-		}
+// announceTrack offers a newly published track to the room it was published in.
+func (s *SFU) announceTrack(room *Room, track *PublishedTrack) {
+	log.Printf("Created track %s to forward from peer %s in room %s", track.id, track.publisherID, room.id)
+	room.notifyPeers(track.publisherID, "track-added", track.info(""))
+	s.attachRecordings(room, track)
+	if room.autoSubscribe.Load() {
+		room.addTrackToPeers(track)
 	}
 }
 
-// forwardRTP reads packets from a remote track and writes them to a local track.
-func (s *SFU) forwardRTP(peerID, globalTrackID string, remoteTrack *webrtc.TrackRemote, localTrack *webrtc.TrackLocalStaticRTP) {
+// forwardRTP reads packets from one layer of a remote track and hands them to its subscribers.
+func (s *SFU) forwardRTP(room *Room, track *PublishedTrack, layer *simulcastLayer) {
 	defer func() {
-		log.Printf("Finished forwarding for track %s from peer %s.", globalTrackID, peerID)
-		s.removeTrack(globalTrackID)
+		log.Printf("Finished forwarding for track %s layer %q from peer %s.", track.id, layer.rid, track.publisherID)
+		if track.removeLayer(layer.rid) == 0 {
+			room.removeTrack(track.id)
+		}
 	}()
 
-	rtpBuf := make([]byte, 1500)
 	for {
-		i, _, readErr := remoteTrack.Read(rtpBuf)
+		pkt, _, readErr := layer.track.ReadRTP()
 		if readErr != nil {
 			if readErr != io.EOF {
-				log.Printf("Error reading from remote track %s: %v", globalTrackID, readErr)
+				log.Printf("Error reading from remote track %s: %v", track.id, readErr)
 			}
 			return
 		}
 
-		if _, writeErr := localTrack.Write(rtpBuf[:i]); writeErr != nil && writeErr != io.ErrClosedPipe {
-			log.Printf("Error writing to local track %s: %v", globalTrackID, writeErr)
-			return
+		layer.stats.observe(pkt, time.Now(), track.codec.ClockRate, track.kind == webrtc.RTPCodecTypeVideo)
+		if track.muted.Load() {
+			// a muted publisher doesn't take part in speaker detection either
+			continue
 		}
+		if layer.audioLevelID != 0 {
+			if level, ok := packetAudioLevel(pkt, layer.audioLevelID); ok {
+				room.speakers.observe(track.publisherID, level)
+			}
+		}
+		track.writeRTP(layer, pkt)
 	}
 }
 
-// removeTrack cleans up a track from the SFU and all peer connections.
-func (s *SFU) removeTrack(globalTrackID string) {
-	s.trackLock.Lock()
-	trackToRemove, ok := s.trackLocals[globalTrackID]
+// SetLayer picks the simulcast layer peerID receives for a track, LayerAuto lets the server decide.
+func (s *SFU) SetLayer(peerID, globalTrackID, layer string) error {
+	s.peersLock.RLock()
+	pcs, ok := s.peers[peerID]
+	s.peersLock.RUnlock()
 	if !ok {
-		s.trackLock.Unlock()
-		return
+		return fmt.Errorf("unknown peer %s", peerID)
 	}
-	delete(s.trackLocals, globalTrackID)
-	s.trackLock.Unlock()
 
-	log.Printf("Removed track %s from SFU state", globalTrackID)
+	track := pcs.room.publishedTrack(globalTrackID)
+	if track == nil {
+		return fmt.Errorf("unknown track %s in room %s", globalTrackID, pcs.room.id)
+	}
 
-	s.peersLock.RLock()
-	defer s.peersLock.RUnlock()
-	for _, pcs := range s.peers {
-		for _, sender := range pcs.peerConnection.GetSenders() {
-			if sender.Track() != nil && sender.Track().ID() == trackToRemove.ID() {
-				if err := pcs.peerConnection.RemoveTrack(sender); err != nil {
-					log.Printf("Error removing track %s from peer %s: %v", globalTrackID, pcs.id, err)
-				}
-			}
-		}
+	downTrack := track.downTrackFor(peerID)
+	if downTrack == nil {
+		return fmt.Errorf("peer %s is not subscribed to track %s", peerID, globalTrackID)
 	}
+
+	return downTrack.SetLayer(layer)
 }
 
 // handleConnectionStateChange cleans up a peer if the connection fails or closes.
@@ -394,24 +467,25 @@ func (s *SFU) cleanupPeer(peerID string) {
 		return
 	}
 	delete(s.peers, peerID)
+	if pcs.httpResource != "" {
+		delete(s.httpResources, pcs.httpResource)
+	}
 	s.peersLock.Unlock()
+	close(pcs.done)
 
 	if err := pcs.peerConnection.Close(); err != nil {
 		log.Printf("[%s] Error closing peer connection: %v", peerID, err)
 	}
 	log.Printf("Peer %s and its connection removed.", peerID)
 
-	s.trackLock.RLock()
-	var tracksToRemove []string
-	for globalTrackID := range s.trackLocals {
-		if len(globalTrackID) > len(peerID) && globalTrackID[:len(peerID)] == peerID && globalTrackID[len(peerID)] == '_' {
-			tracksToRemove = append(tracksToRemove, globalTrackID)
-		}
-	}
-	s.trackLock.RUnlock()
+	// leave the room first so no new track gets added to this peer while its own tracks are removed
+	s.leaveRoom(pcs)
+	pcs.room.unsubscribeAll(peerID)
 
-	for _, trackID := range tracksToRemove {
-		s.removeTrack(trackID)
+	for _, trackID := range pcs.room.tracksPublishedBy(peerID) {
+		pcs.room.removeTrack(trackID)
 	}
-	log.Printf("Cleaned up all tracks originated by peer %s.", peerID)
+	// a last-N slot may have been freed up for someone else
+	pcs.room.applyLastN()
+	log.Printf("Cleaned up all tracks originated by peer %s in room %s.", peerID, pcs.room.id)
 }
@@ -0,0 +1,81 @@
+package sfu_server
+
+import (
+	"github.com/pion/webrtc/v3"
+	"github.com/samyak112/monoport/metrics"
+)
+
+var (
+	negotiationFailures = metrics.NewCounterVec("monoport_negotiation_failures_total",
+		"SDP negotiations that failed, by the step that failed.", "step")
+	forwardedPackets = metrics.NewCounterVec("monoport_forwarded_packets_total",
+		"RTP packets sent to subscribers, retransmissions included, by track kind.", "kind")
+	forwardedBytes = metrics.NewCounterVec("monoport_forwarded_bytes_total",
+		"RTP payload bytes sent to subscribers, retransmissions included, by track kind.", "kind")
+)
+
+// negotiation steps counted by negotiationFailures
+const (
+	stepSetRemoteDescription = "set_remote_description"
+	stepSetLocalDescription  = "set_local_description"
+	stepCreateOffer          = "create_offer"
+	stepCreateAnswer         = "create_answer"
+)
+
+// registerMetrics exposes the gauges that are read from the SFU's state at scrape time.
+func (s *SFU) registerMetrics() {
+	metrics.NewGaugeFunc("monoport_peers", "Peers with a PeerConnection, WHIP and WHEP sessions included.", func() float64 {
+		s.peersLock.RLock()
+		defer s.peersLock.RUnlock()
+		return float64(len(s.peers))
+	})
+	metrics.NewGaugeFunc("monoport_rooms", "Rooms with at least one peer or ingest.", func() float64 {
+		s.roomsLock.RLock()
+		defer s.roomsLock.RUnlock()
+		return float64(len(s.rooms))
+	})
+	metrics.NewGaugeVecFunc("monoport_tracks", "Published tracks, by kind.", "kind", func() map[string]float64 {
+		tracks := map[string]float64{
+			webrtc.RTPCodecTypeAudio.String(): 0,
+			webrtc.RTPCodecTypeVideo.String(): 0,
+		}
+		for _, room := range s.roomList() {
+			room.trackLock.RLock()
+			for _, track := range room.trackLocals {
+				tracks[track.kind.String()]++
+			}
+			room.trackLock.RUnlock()
+		}
+		return tracks
+	})
+	metrics.NewGaugeVecFunc("monoport_peer_connections", "PeerConnections, by connection state.", "state", func() map[string]float64 {
+		states := make(map[string]float64)
+		for _, state := range []webrtc.PeerConnectionState{
+			webrtc.PeerConnectionStateNew,
+			webrtc.PeerConnectionStateConnecting,
+			webrtc.PeerConnectionStateConnected,
+			webrtc.PeerConnectionStateDisconnected,
+			webrtc.PeerConnectionStateFailed,
+			webrtc.PeerConnectionStateClosed,
+		} {
+			states[state.String()] = 0
+		}
+		s.peersLock.RLock()
+		for _, pcs := range s.peers {
+			states[pcs.peerConnection.ConnectionState().String()]++
+		}
+		s.peersLock.RUnlock()
+		return states
+	})
+}
+
+// roomList returns the current rooms, so they can be walked without holding roomsLock.
+func (s *SFU) roomList() []*Room {
+	s.roomsLock.RLock()
+	defer s.roomsLock.RUnlock()
+	rooms := make([]*Room, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
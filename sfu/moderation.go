@@ -0,0 +1,191 @@
+package sfu_server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/samyak112/monoport/transport"
+)
+
+var (
+	// ErrNotModerator is returned when a peer tries a moderation action in a room it
+	// doesn't moderate.
+	ErrNotModerator = errors.New("not a moderator of the room")
+	// ErrBanned is returned when a banned peer tries to join a room.
+	ErrBanned = errors.New("banned from the room")
+)
+
+// ModerationEvent is sent to every peer of a room when a moderator acts in it.
+type ModerationEvent struct {
+	TrackID     string `json:"trackId,omitempty"`
+	PublisherID string `json:"publisherId,omitempty"` // whose track was acted on
+	PeerID      string `json:"peerId,omitempty"`      // banned peer
+	Muted       *bool  `json:"muted,omitempty"`
+	By          string `json:"by"` // moderator's peer ID, empty for the admin API
+}
+
+// moderatedTrack resolves the track a moderation action targets and checks actorID may
+// moderate its room. An empty actorID is the admin API, which may act in every room.
+func (s *SFU) moderatedTrack(actorID, globalTrackID string) (*Room, *PublishedTrack, error) {
+	if actorID == "" {
+		for _, room := range s.roomList() {
+			if track := room.publishedTrack(globalTrackID); track != nil {
+				return room, track, nil
+			}
+		}
+		return nil, nil, fmt.Errorf("unknown track %s", globalTrackID)
+	}
+
+	s.peersLock.RLock()
+	actor, ok := s.peers[actorID]
+	s.peersLock.RUnlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("%w %s", ErrUnknownPeer, actorID)
+	}
+	if !actor.room.isModerator(actorID) {
+		return nil, nil, ErrNotModerator
+	}
+	track := actor.room.publishedTrack(globalTrackID)
+	if track == nil {
+		return nil, nil, fmt.Errorf("unknown track %s in room %s", globalTrackID, actor.room.id)
+	}
+	return actor.room, track, nil
+}
+
+// MuteTrack stops or restarts forwarding a track to everyone, subscribers and sinks alike.
+// Every peer of the room, the publisher included, gets a "track-muted" event. Unmuting
+// restarts subscribers at the next keyframe.
+func (s *SFU) MuteTrack(actorID, globalTrackID string, muted bool) error {
+	room, track, err := s.moderatedTrack(actorID, globalTrackID)
+	if err != nil {
+		return err
+	}
+	if track.muted.Swap(muted) == muted {
+		return nil
+	}
+	if !muted {
+		for _, downTrack := range track.allDownTracks() {
+			downTrack.restart()
+		}
+	}
+
+	log.Printf("Track %s in room %s muted: %t (by %q)", globalTrackID, room.id, muted, actorID)
+	room.notifyPeers("", "track-muted", ModerationEvent{TrackID: track.id, PublisherID: track.publisherID, Muted: &muted, By: actorID})
+	return nil
+}
+
+// UnpublishTrack removes a track from its room. Subscribers get the usual "track-removed",
+// and every peer of the room, the publisher included, gets a "track-unpublished" event.
+// The publisher's packets are read and dropped until it stops sending them.
+func (s *SFU) UnpublishTrack(actorID, globalTrackID string) error {
+	room, track, err := s.moderatedTrack(actorID, globalTrackID)
+	if err != nil {
+		return err
+	}
+
+	room.removeTrack(globalTrackID)
+	log.Printf("Track %s in room %s unpublished (by %q)", globalTrackID, room.id, actorID)
+	room.notifyPeers("", "track-unpublished", ModerationEvent{TrackID: track.id, PublisherID: track.publisherID, By: actorID})
+	return nil
+}
+
+// BanPeer keeps a peer ID out of a room and kicks it if it's there. With an actorID the
+// room is the actor's own, the admin API names the room in roomID instead. The rest of
+// the room gets a "peer-banned" event.
+func (s *SFU) BanPeer(actorID, roomID, peerID string) error {
+	if actorID != "" {
+		s.peersLock.RLock()
+		actor, ok := s.peers[actorID]
+		s.peersLock.RUnlock()
+		if !ok {
+			return fmt.Errorf("%w %s", ErrUnknownPeer, actorID)
+		}
+		if !actor.room.isModerator(actorID) {
+			return ErrNotModerator
+		}
+		roomID = actor.room.id
+	}
+	if roomID == "" {
+		roomID = DefaultRoomID
+	}
+
+	s.roomsLock.Lock()
+	if s.bans[roomID] == nil {
+		s.bans[roomID] = make(map[string]bool)
+	}
+	s.bans[roomID][peerID] = true
+	room := s.rooms[roomID]
+	s.roomsLock.Unlock()
+	log.Printf("[%s] Banned from room %s (by %q)", peerID, roomID, actorID)
+
+	s.peersLock.RLock()
+	target, inRoom := s.peers[peerID]
+	s.peersLock.RUnlock()
+	if inRoom && target.room.id == roomID {
+		if err := s.KickPeer(peerID); err != nil {
+			log.Printf("[%s] Failed to kick banned peer: %v", peerID, err)
+		}
+	}
+	if room != nil {
+		room.notifyPeers("", "peer-banned", ModerationEvent{PeerID: peerID, By: actorID})
+	}
+	return nil
+}
+
+// UnbanPeer lets a banned peer ID join a room again.
+func (s *SFU) UnbanPeer(roomID, peerID string) error {
+	s.roomsLock.Lock()
+	defer s.roomsLock.Unlock()
+	if !s.bans[roomID][peerID] {
+		return fmt.Errorf("peer %s is not banned from room %s", peerID, roomID)
+	}
+	delete(s.bans[roomID], peerID)
+	if len(s.bans[roomID]) == 0 {
+		delete(s.bans, roomID)
+	}
+	return nil
+}
+
+// bannedLocked reports whether a peer is banned from a room. roomsLock must be held.
+func (s *SFU) bannedLocked(roomID, peerID string) bool {
+	return s.bans[roomID][peerID]
+}
+
+// RejectJoin tells a websocket peer it can't join its room, e.g. because it is banned.
+func (s *SFU) RejectJoin(peerID string, reason error) {
+	data, err := json.Marshal(map[string]string{"error": reason.Error()})
+	if err != nil {
+		return
+	}
+	s.signalChannelSend <- &transport.SignalMessage{PeerID: peerID, Type: "join-rejected", Data: data}
+}
+
+// SetModerator grants or revokes the moderator role of a peer in its room.
+func (s *SFU) SetModerator(peerID string, moderator bool) error {
+	s.peersLock.RLock()
+	pcs, ok := s.peers[peerID]
+	s.peersLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w %s", ErrUnknownPeer, peerID)
+	}
+
+	pcs.room.peersLock.Lock()
+	if moderator {
+		pcs.room.moderators[peerID] = true
+	} else {
+		delete(pcs.room.moderators, peerID)
+	}
+	pcs.room.peersLock.Unlock()
+
+	log.Printf("[%s] Moderator of room %s: %t", peerID, pcs.room.id, moderator)
+	pcs.sendEvent("moderator", map[string]interface{}{"roomId": pcs.room.id, "moderator": moderator})
+	return nil
+}
+
+func (r *Room) isModerator(peerID string) bool {
+	r.peersLock.RLock()
+	defer r.peersLock.RUnlock()
+	return r.moderators[peerID]
+}
@@ -0,0 +1,37 @@
+package sfu_server
+
+import (
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+// packetBufferSize is how many packets are kept per layer for retransmission. At a few
+// hundred packets per second for HD video this covers roughly one to two seconds, which
+// is about as long as a retransmission is still useful to the subscriber's jitter buffer.
+const packetBufferSize = 512
+
+// packetBuffer is a ring of the most recent packets of one layer, indexed by sequence number.
+type packetBuffer struct {
+	mu      sync.Mutex
+	packets [packetBufferSize]*rtp.Packet
+}
+
+// push stores a packet, overwriting whatever was stored packetBufferSize sequence numbers earlier.
+// The packet is kept as is, forwarding never modifies the packets read from the publisher.
+func (b *packetBuffer) push(pkt *rtp.Packet) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.packets[pkt.SequenceNumber%packetBufferSize] = pkt
+}
+
+// get returns the packet with the given sequence number if it is still buffered.
+func (b *packetBuffer) get(seq uint16) *rtp.Packet {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	pkt := b.packets[seq%packetBufferSize]
+	if pkt == nil || pkt.SequenceNumber != seq {
+		return nil
+	}
+	return pkt
+}
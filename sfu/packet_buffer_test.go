@@ -0,0 +1,41 @@
+package sfu_server
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+func TestPacketBuffer(t *testing.T) {
+	tests := []struct {
+		name   string
+		pushed []uint16
+		seq    uint16
+		want   bool
+	}{
+		{name: "empty", seq: 1, want: false},
+		{name: "buffered", pushed: []uint16{1, 2, 3}, seq: 2, want: true},
+		{name: "never pushed", pushed: []uint16{1, 3}, seq: 2, want: false},
+		{name: "overwritten a ring later", pushed: []uint16{5, 5 + packetBufferSize}, seq: 5, want: false},
+		{name: "overwriting packet", pushed: []uint16{5, 5 + packetBufferSize}, seq: 5 + packetBufferSize, want: true},
+		{name: "across wraparound", pushed: []uint16{65534, 65535, 0, 1}, seq: 65535, want: true},
+		{name: "after wraparound", pushed: []uint16{65534, 65535, 0, 1}, seq: 0, want: true},
+		{name: "same slot a wrap earlier", pushed: []uint16{0}, seq: 65536 - packetBufferSize, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &packetBuffer{}
+			for _, seq := range tt.pushed {
+				b.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq}})
+			}
+			pkt := b.get(tt.seq)
+			if got := pkt != nil; got != tt.want {
+				t.Fatalf("get(%d) found %v, want %v", tt.seq, got, tt.want)
+			}
+			if pkt != nil && pkt.SequenceNumber != tt.seq {
+				t.Errorf("get(%d) returned packet %d", tt.seq, pkt.SequenceNumber)
+			}
+		})
+	}
+}
@@ -0,0 +1,413 @@
+package sfu_server
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// staleLayerTimeout is how long a simulcast layer may go without packets before the server
+// stops picking it for subscribers. Browsers silently stop sending their upper layers when
+// their own uplink gets congested, so a layer existing doesn't mean it's flowing.
+const staleLayerTimeout = time.Second
+
+// simulcastLayerQuality orders the RIDs browsers commonly use, q(uarter) < h(alf) < f(ull).
+// A non simulcast track has a single layer with an empty RID.
+var simulcastLayerQuality = map[string]int{"": 0, "q": 0, "h": 1, "f": 2}
+
+func layerQuality(rid string) int {
+	if quality, ok := simulcastLayerQuality[rid]; ok {
+		return quality
+	}
+	// unknown RIDs go above the known ones, they are still ordered by name in Layers
+	return len(simulcastLayerQuality)
+}
+
+// rtpSource is where the packets of a layer are read from. For WebRTC publishers it is
+// the TrackRemote, packets returned by ReadRTP must not be reused by the source.
+type rtpSource interface {
+	ReadRTP() (*rtp.Packet, interceptor.Attributes, error)
+	SSRC() webrtc.SSRC
+}
+
+// rtcpWriter carries keyframe requests and NACKs back to where a track comes from, for
+// WebRTC publishers that is their PeerConnection.
+type rtcpWriter interface {
+	WriteRTCP(pkts []rtcp.Packet) error
+}
+
+// simulcastLayer is one encoding of a published source, for a simulcast publisher every
+// RID arrives as its own TrackRemote on the same RTPReceiver.
+type simulcastLayer struct {
+	rid        string
+	track      rtpSource
+	lastPacket atomic.Int64  // unix nanos of the last packet read, used to detect paused layers
+	buffer     *packetBuffer // recent packets for retransmissions, nil for audio
+	bytes      atomic.Uint64 // payload bytes received, sampled into bitrate
+	stats      receiveCounters
+	// audioLevelID is the negotiated ID of the audio level extension, 0 when there is none
+	audioLevelID uint8
+
+	rateLock   sync.Mutex
+	rateBytes  uint64
+	rateSample time.Time
+	bitrate    int // bits per second over the last bitrateSampleInterval
+}
+
+// bitrateSampleInterval is how often the bitrate of a layer is recomputed.
+const bitrateSampleInterval = time.Second
+
+func (l *simulcastLayer) active(now time.Time) bool {
+	return now.Sub(time.Unix(0, l.lastPacket.Load())) < staleLayerTimeout
+}
+
+// sampleBitrate returns the layer's bitrate, recomputing it when the last sample is old enough.
+func (l *simulcastLayer) sampleBitrate(now time.Time) int {
+	l.rateLock.Lock()
+	defer l.rateLock.Unlock()
+
+	elapsed := now.Sub(l.rateSample)
+	if elapsed < bitrateSampleInterval {
+		return l.bitrate
+	}
+
+	bytes := l.bytes.Load()
+	if !l.rateSample.IsZero() {
+		l.bitrate = int(float64(bytes-l.rateBytes) * 8 / elapsed.Seconds())
+	}
+	l.rateBytes = bytes
+	l.rateSample = now
+	return l.bitrate
+}
+
+// layerBitrate is the measured bitrate of one layer, as seen by the bandwidth allocator.
+type layerBitrate struct {
+	rid     string
+	quality int
+	bitrate int
+}
+
+// rtpSink consumes the packets of a track on the server itself, recordings and HLS streams
+// are sinks. Packets are never modified after the fact so sinks may hold on to them.
+type rtpSink interface {
+	WriteRTP(pkt *rtp.Packet, keyframe bool)
+	Close() error
+}
+
+// trackSink is a sink attached to one layer of a PublishedTrack.
+type trackSink struct {
+	rid  string
+	sink rtpSink
+}
+
+// PublishedTrack is a single source published by a peer, with all of its simulcast layers.
+// Subscribers never receive the publisher's packets directly, each of them gets its own
+// DownTrack which forwards exactly one layer of this track.
+type PublishedTrack struct {
+	id          string // global track ID, unique inside a room
+	publisherID string // peer that publishes the track, or the ID of a plain RTP ingest
+	kind        webrtc.RTPCodecType
+	codec       webrtc.RTPCodecCapability
+	streamID    string
+	upstream    rtcpWriter  // where keyframe requests and NACKs for the publisher go
+	muted       atomic.Bool // muted by a moderator, nothing is forwarded while it is set
+
+	layersLock sync.RWMutex
+	layers     map[string]*simulcastLayer
+
+	downTracksLock sync.RWMutex
+	downTracks     map[string]*DownTrack // keyed by subscriber peer ID
+
+	feedback *feedbackAggregator
+
+	sinksLock sync.RWMutex
+	sinks     map[string]*trackSink // keyed by recording or HLS stream ID
+
+	// how many NACKed packets were answered from our own buffer and how many weren't there anymore
+	nackHits   atomic.Uint64
+	nackMisses atomic.Uint64
+}
+
+func newPublishedTrack(globalTrackID string, publisherID string, kind webrtc.RTPCodecType, codec webrtc.RTPCodecCapability, streamID string, upstream rtcpWriter) *PublishedTrack {
+	track := &PublishedTrack{
+		id:          globalTrackID,
+		publisherID: publisherID,
+		kind:        kind,
+		codec:       codec,
+		streamID:    streamID,
+		upstream:    upstream,
+		layers:      make(map[string]*simulcastLayer),
+		downTracks:  make(map[string]*DownTrack),
+		sinks:       make(map[string]*trackSink),
+	}
+	track.feedback = newFeedbackAggregator(track)
+	return track
+}
+
+// ID returns the global track ID, this is also the track ID subscribers see in their SDP.
+func (t *PublishedTrack) ID() string { return t.id }
+
+// Kind returns whether this is an audio or a video track.
+func (t *PublishedTrack) Kind() webrtc.RTPCodecType { return t.kind }
+
+// addLayer registers a newly received RID of this source.
+func (t *PublishedTrack) addLayer(rid string, source rtpSource) *simulcastLayer {
+	layer := &simulcastLayer{rid: rid, track: source}
+	layer.lastPacket.Store(time.Now().UnixNano())
+	// audio is never NACKed by browsers, a lost Opus packet is concealed rather than retransmitted
+	if t.kind == webrtc.RTPCodecTypeVideo {
+		layer.buffer = &packetBuffer{}
+	}
+
+	t.layersLock.Lock()
+	t.layers[layer.rid] = layer
+	t.layersLock.Unlock()
+
+	if layer.rid != "" {
+		log.Printf("Track %s received simulcast layer %q", t.id, layer.rid)
+	}
+	return layer
+}
+
+// removeLayer forgets a layer whose TrackRemote ended and returns how many layers are left.
+func (t *PublishedTrack) removeLayer(rid string) int {
+	t.layersLock.Lock()
+	defer t.layersLock.Unlock()
+	delete(t.layers, rid)
+	return len(t.layers)
+}
+
+func (t *PublishedTrack) hasLayer(rid string) bool {
+	t.layersLock.RLock()
+	defer t.layersLock.RUnlock()
+	_, ok := t.layers[rid]
+	return ok
+}
+
+// Layers returns the RIDs of this track ordered from the lowest to the highest quality.
+func (t *PublishedTrack) Layers() []string {
+	t.layersLock.RLock()
+	rids := make([]string, 0, len(t.layers))
+	for rid := range t.layers {
+		rids = append(rids, rid)
+	}
+	t.layersLock.RUnlock()
+
+	sort.Slice(rids, func(i, j int) bool {
+		if layerQuality(rids[i]) != layerQuality(rids[j]) {
+			return layerQuality(rids[i]) < layerQuality(rids[j])
+		}
+		return rids[i] < rids[j]
+	})
+	return rids
+}
+
+// bestLayerUpTo returns the highest quality layer not above maxQuality that is currently
+// receiving packets. When none of them is, it falls back to the highest layer not above
+// maxQuality, or the lowest layer when even that doesn't exist.
+func (t *PublishedTrack) bestLayerUpTo(maxQuality int) string {
+	rids := t.Layers()
+	if len(rids) == 0 {
+		return ""
+	}
+
+	now := time.Now()
+	fallback := rids[0]
+	foundFallback := false
+
+	t.layersLock.RLock()
+	defer t.layersLock.RUnlock()
+	for i := len(rids) - 1; i >= 0; i-- {
+		if layerQuality(rids[i]) > maxQuality {
+			continue
+		}
+		if layer, ok := t.layers[rids[i]]; ok && layer.active(now) {
+			return rids[i]
+		}
+		if !foundFallback {
+			fallback = rids[i]
+			foundFallback = true
+		}
+	}
+	return fallback
+}
+
+// layerBitrates returns the bitrate of every active layer, from the lowest to the highest quality.
+func (t *PublishedTrack) layerBitrates() []layerBitrate {
+	rids := t.Layers()
+	now := time.Now()
+
+	t.layersLock.RLock()
+	defer t.layersLock.RUnlock()
+
+	bitrates := make([]layerBitrate, 0, len(rids))
+	for _, rid := range rids {
+		layer, ok := t.layers[rid]
+		if !ok || !layer.active(now) {
+			continue
+		}
+		bitrates = append(bitrates, layerBitrate{rid: rid, quality: layerQuality(rid), bitrate: layer.sampleBitrate(now)})
+	}
+	return bitrates
+}
+
+// writeRTP hands a packet read from one of the layers to every subscriber's DownTrack,
+// each of them decides on its own whether it forwards this layer.
+func (t *PublishedTrack) writeRTP(layer *simulcastLayer, pkt *rtp.Packet) {
+	layer.lastPacket.Store(time.Now().UnixNano())
+	layer.bytes.Add(uint64(len(pkt.Payload)))
+	if layer.buffer != nil {
+		layer.buffer.push(pkt)
+	}
+	keyframe := isKeyframe(t.codec.MimeType, pkt.Payload)
+
+	t.sinksLock.RLock()
+	for _, sink := range t.sinks {
+		if sink.rid == layer.rid {
+			sink.sink.WriteRTP(pkt, keyframe)
+		}
+	}
+	t.sinksLock.RUnlock()
+
+	t.downTracksLock.RLock()
+	defer t.downTracksLock.RUnlock()
+	for _, downTrack := range t.downTracks {
+		downTrack.writeRTP(t, layer.rid, pkt, keyframe)
+	}
+}
+
+// bufferedPacket looks up a packet of one layer for a retransmission and counts the hit or miss.
+func (t *PublishedTrack) bufferedPacket(rid string, seq uint16) *rtp.Packet {
+	t.layersLock.RLock()
+	layer, ok := t.layers[rid]
+	t.layersLock.RUnlock()
+
+	var pkt *rtp.Packet
+	if ok && layer.buffer != nil {
+		pkt = layer.buffer.get(seq)
+	}
+
+	if pkt == nil {
+		t.nackMisses.Add(1)
+	} else {
+		t.nackHits.Add(1)
+	}
+	return pkt
+}
+
+// NackCounters tells how well the retransmission buffer of a track works.
+type NackCounters struct {
+	Hits   uint64 `json:"hits"`   // NACKed packets retransmitted from the SFU's buffer
+	Misses uint64 `json:"misses"` // NACKed packets that had to be requested from the publisher
+}
+
+// NackStats returns the retransmission counters of this track.
+func (t *PublishedTrack) NackStats() NackCounters {
+	return NackCounters{Hits: t.nackHits.Load(), Misses: t.nackMisses.Load()}
+}
+
+// requestKeyframe asks the publisher for a keyframe on one layer, requests are throttled
+// per layer so many subscribers asking at once result in a single PLI.
+func (t *PublishedTrack) requestKeyframe(rid string) {
+	t.feedback.requestKeyframe(rid, false)
+}
+
+// layerSSRC returns the SSRC the publisher uses for a layer.
+func (t *PublishedTrack) layerSSRC(rid string) (webrtc.SSRC, bool) {
+	t.layersLock.RLock()
+	defer t.layersLock.RUnlock()
+	layer, ok := t.layers[rid]
+	if !ok {
+		return 0, false
+	}
+	return layer.track.SSRC(), true
+}
+
+// writeRTCP sends feedback to the publisher, the media SSRCs in the packets make the
+// publisher's PeerConnection route it to the RTPReceiver this track came from.
+func (t *PublishedTrack) writeRTCP(pkts []rtcp.Packet) error {
+	return t.upstream.WriteRTCP(pkts)
+}
+
+func (t *PublishedTrack) addDownTrack(downTrack *DownTrack) {
+	t.downTracksLock.Lock()
+	defer t.downTracksLock.Unlock()
+	t.downTracks[downTrack.subscriber.id] = downTrack
+}
+
+func (t *PublishedTrack) removeDownTrack(peerID string) *DownTrack {
+	t.downTracksLock.Lock()
+	defer t.downTracksLock.Unlock()
+	downTrack, ok := t.downTracks[peerID]
+	if !ok {
+		return nil
+	}
+	delete(t.downTracks, peerID)
+	return downTrack
+}
+
+func (t *PublishedTrack) downTrackFor(peerID string) *DownTrack {
+	t.downTracksLock.RLock()
+	defer t.downTracksLock.RUnlock()
+	return t.downTracks[peerID]
+}
+
+// allDownTracks returns a snapshot so callers can touch PeerConnections without holding downTracksLock.
+func (t *PublishedTrack) allDownTracks() []*DownTrack {
+	t.downTracksLock.RLock()
+	defer t.downTracksLock.RUnlock()
+	downTracks := make([]*DownTrack, 0, len(t.downTracks))
+	for _, downTrack := range t.downTracks {
+		downTracks = append(downTracks, downTrack)
+	}
+	return downTracks
+}
+
+// addSink attaches a sink to the track. Simulcast tracks feed it from their best layer at
+// the time, switching layers halfway would need a keyframe aligned splice.
+func (t *PublishedTrack) addSink(id string, sink rtpSink) {
+	rid := t.bestLayerUpTo(noQualityCap)
+
+	t.sinksLock.Lock()
+	t.sinks[id] = &trackSink{rid: rid, sink: sink}
+	t.sinksLock.Unlock()
+
+	// whatever the sink writes can only start at a keyframe
+	t.requestKeyframe(rid)
+}
+
+// removeSink detaches a sink from the track and closes it.
+func (t *PublishedTrack) removeSink(id string) {
+	t.sinksLock.Lock()
+	sink, ok := t.sinks[id]
+	delete(t.sinks, id)
+	t.sinksLock.Unlock()
+	if !ok {
+		return
+	}
+	if err := sink.sink.Close(); err != nil {
+		log.Printf("Failed to close %s of track %s: %v", id, t.id, err)
+	}
+}
+
+// closeAllSinks closes the sinks of a track that is going away, the recordings and streams
+// they belong to keep running for the rest of the room.
+func (t *PublishedTrack) closeAllSinks() {
+	t.sinksLock.Lock()
+	sinks := t.sinks
+	t.sinks = make(map[string]*trackSink)
+	t.sinksLock.Unlock()
+
+	for id, sink := range sinks {
+		if err := sink.sink.Close(); err != nil {
+			log.Printf("Failed to close %s of track %s: %v", id, t.id, err)
+		}
+	}
+}
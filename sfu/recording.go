@@ -0,0 +1,201 @@
+package sfu_server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/samyak112/monoport/recorder"
+)
+
+// DefaultRecordingDir is where recordings go unless SetRecordingDir says otherwise.
+const DefaultRecordingDir = "recordings"
+
+// defaultMaxRecordings is how many recordings may run at once unless SetRecordingLimit says
+// otherwise.
+const defaultMaxRecordings = 8
+
+// recording is a running recording of a whole room, or of a single track when trackID is set.
+type recording struct {
+	id      string
+	roomID  string
+	trackID string
+	session *recorder.Session
+}
+
+// covers reports whether a track published in roomID belongs in this recording.
+func (r *recording) covers(roomID string, track *PublishedTrack) bool {
+	return r.roomID == roomID && (r.trackID == "" || r.trackID == track.id)
+}
+
+// checkRecordingActor checks that a peer may start and stop recordings of roomID: it has to
+// be in that room and moderate it. A peer without a PeerConnection yet needs an access token
+// with isAdmin for the room it is about to join. An empty actorID is the admin API.
+func (s *SFU) checkRecordingActor(actorID, roomID string) error {
+	if actorID == "" {
+		return nil
+	}
+
+	s.peersLock.RLock()
+	actor, ok := s.peers[actorID]
+	s.peersLock.RUnlock()
+	if ok {
+		if actor.room.id != roomID {
+			return fmt.Errorf("%w %s, peers only record their own room", ErrNotModerator, roomID)
+		}
+		if !actor.room.isModerator(actorID) {
+			return ErrNotModerator
+		}
+		return nil
+	}
+
+	s.roomsLock.RLock()
+	defer s.roomsLock.RUnlock()
+	if grant, ok := s.grants[actorID]; ok && grant.grants.IsAdmin && s.requestedRoomLocked(actorID) == roomID {
+		return nil
+	}
+	return ErrNotModerator
+}
+
+// ErrTooManyRecordings is returned by StartRecording when the limit of recordings running at
+// once is reached.
+var ErrTooManyRecordings = errors.New("too many recordings")
+
+// SetRecordingLimit caps how many recordings may run at once, every one of them writes to
+// disk for as long as it runs.
+func (s *SFU) SetRecordingLimit(max int) error {
+	if max <= 0 {
+		return fmt.Errorf("invalid recording limit %d", max)
+	}
+	s.recordingsLock.Lock()
+	defer s.recordingsLock.Unlock()
+	s.recordingMax = max
+	return nil
+}
+
+// SetRecordingDir sets the directory new recordings are written to.
+func (s *SFU) SetRecordingDir(dir string) {
+	s.recordingsLock.Lock()
+	defer s.recordingsLock.Unlock()
+	s.recordingDir = dir
+}
+
+// StartRecording records every track of a room, including the ones published later, or
+// only the track with the given global ID when trackID isn't empty. It returns the
+// recording ID, which is also the name of the directory the files end up in. actorID is
+// the peer asking for it, which has to moderate the room, empty for the admin API.
+func (s *SFU) StartRecording(actorID, roomID, trackID string) (string, error) {
+	if roomID == "" {
+		roomID = DefaultRoomID
+	}
+	if err := s.checkRecordingActor(actorID, roomID); err != nil {
+		return "", err
+	}
+
+	s.roomsLock.RLock()
+	room, ok := s.rooms[roomID]
+	s.roomsLock.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("unknown room %s", roomID)
+	}
+	if trackID != "" && room.publishedTrack(trackID) == nil {
+		return "", fmt.Errorf("unknown track %s in room %s", trackID, roomID)
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	// room IDs come from clients, the ID is used as a directory name
+	id := fmt.Sprintf("%s-%s-%s", recorder.SafeName(roomID), time.Now().UTC().Format("20060102T150405"), hex.EncodeToString(suffix))
+
+	s.recordingsLock.Lock()
+	if len(s.recordings) >= s.recordingMax {
+		s.recordingsLock.Unlock()
+		return "", fmt.Errorf("%w: %d are running", ErrTooManyRecordings, s.recordingMax)
+	}
+	session, err := recorder.NewSession(s.recordingDir, id, roomID)
+	if err != nil {
+		s.recordingsLock.Unlock()
+		return "", err
+	}
+	rec := &recording{id: id, roomID: roomID, trackID: trackID, session: session}
+	s.recordings[id] = rec
+	s.recordingsLock.Unlock()
+
+	room.trackLock.RLock()
+	for _, track := range room.trackLocals {
+		if rec.covers(roomID, track) {
+			track.startRecording(rec)
+		}
+	}
+	room.trackLock.RUnlock()
+
+	log.Printf("Started recording %s of room %s into %s", id, roomID, session.Dir())
+	return id, nil
+}
+
+// StopRecording stops a recording and writes its manifest. actorID is the peer asking for
+// it, which has to moderate the recorded room, empty for the admin API.
+func (s *SFU) StopRecording(actorID, recordingID string) error {
+	if actorID != "" {
+		s.recordingsLock.RLock()
+		rec, ok := s.recordings[recordingID]
+		s.recordingsLock.RUnlock()
+		if !ok {
+			return fmt.Errorf("unknown recording %s", recordingID)
+		}
+		if err := s.checkRecordingActor(actorID, rec.roomID); err != nil {
+			return err
+		}
+	}
+
+	s.recordingsLock.Lock()
+	rec, ok := s.recordings[recordingID]
+	delete(s.recordings, recordingID)
+	s.recordingsLock.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown recording %s", recordingID)
+	}
+
+	s.roomsLock.RLock()
+	room, ok := s.rooms[rec.roomID]
+	s.roomsLock.RUnlock()
+	if ok {
+		room.trackLock.RLock()
+		for _, track := range room.trackLocals {
+			track.removeSink(rec.id)
+		}
+		room.trackLock.RUnlock()
+	}
+
+	if err := rec.session.Close(); err != nil {
+		return fmt.Errorf("closing recording %s: %w", recordingID, err)
+	}
+	log.Printf("Stopped recording %s", recordingID)
+	return nil
+}
+
+// attachRecordings adds a newly published track to the running recordings of its room.
+func (s *SFU) attachRecordings(room *Room, track *PublishedTrack) {
+	s.recordingsLock.RLock()
+	defer s.recordingsLock.RUnlock()
+	for _, rec := range s.recordings {
+		if rec.covers(room.id, track) {
+			track.startRecording(rec)
+		}
+	}
+}
+
+// startRecording attaches a recording to the track.
+func (t *PublishedTrack) startRecording(rec *recording) {
+	recorded, err := rec.session.AddTrack(t.id, t.publisherID, t.kind, t.codec)
+	if err != nil {
+		log.Printf("Recording %s: can't record track %s: %v", rec.id, t.id, err)
+		return
+	}
+	t.addSink(rec.id, recorded)
+}
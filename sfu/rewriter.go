@@ -0,0 +1,112 @@
+package sfu_server
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// rtpRewriter maps the incoming packets of whatever source a DownTrack currently forwards
+// onto one continuous outgoing stream. Every time the source changes (layer switch, resume
+// after a pause, replaced publisher) a new segment starts whose offsets are chosen so that
+// its first packet directly follows the last packet sent, subscribers never see the jump.
+type rtpRewriter struct {
+	clockRate uint32
+	started   bool // false until the first segment started
+
+	// outgoing = incoming + offset for the current segment
+	seqOffset uint16
+	tsOffset  uint32
+
+	segmentStartSeq uint16 // incoming sequence number the current segment started at
+	segmentStartOut uint16 // outgoing sequence number of that same packet
+
+	lastSeq   uint16 // highest outgoing sequence number written so far
+	lastTS    uint32 // outgoing timestamp of lastSeq
+	lastWrite time.Time
+}
+
+// startSegment makes pkt the first packet of a new segment. The outgoing timestamp advances
+// by the wall clock time elapsed since the last packet, so a gap of any length (a pause,
+// a publisher that was gone for a while) still plays back at the right pace.
+func (r *rtpRewriter) startSegment(pkt *rtp.Packet, now time.Time) {
+	if r.started {
+		ticks := uint32(now.Sub(r.lastWrite).Seconds() * float64(r.clockRate))
+		if ticks == 0 {
+			ticks = 1
+		}
+		r.seqOffset = r.lastSeq + 1 - pkt.SequenceNumber
+		r.tsOffset = r.lastTS + ticks - pkt.Timestamp
+	}
+
+	r.segmentStartSeq = pkt.SequenceNumber
+	r.segmentStartOut = pkt.SequenceNumber + r.seqOffset
+	r.lastSeq = r.segmentStartOut - 1
+	r.lastTS = pkt.Timestamp + r.tsOffset
+	r.lastWrite = now
+	r.started = true
+}
+
+// inSegment reports whether pkt belongs to the current segment. Packets reordered from
+// before the segment started would collide with the previous source's sequence numbers.
+func (r *rtpRewriter) inSegment(pkt *rtp.Packet) bool {
+	return r.started && !isSeqOlder(pkt.SequenceNumber, r.segmentStartSeq)
+}
+
+// rewrite returns the outgoing sequence number and timestamp of a packet of the current segment.
+func (r *rtpRewriter) rewrite(pkt *rtp.Packet, now time.Time) (uint16, uint32) {
+	seq := pkt.SequenceNumber + r.seqOffset
+	ts := pkt.Timestamp + r.tsOffset
+
+	if isSeqOlder(r.lastSeq, seq) {
+		r.lastSeq = seq
+		r.lastTS = ts
+	}
+	r.lastWrite = now
+	return seq, ts
+}
+
+// outgoingTimestamp returns the outgoing timestamp of a packet of the current segment
+// without touching any state, used for retransmissions.
+func (r *rtpRewriter) outgoingTimestamp(pkt *rtp.Packet) uint32 {
+	return pkt.Timestamp + r.tsOffset
+}
+
+// drop skips a packet of the current segment without leaving a hole in the outgoing
+// sequence numbers, so the subscriber doesn't NACK a packet that will never come.
+// Only the next in order packet can be skipped that way, anything else already has
+// outgoing packets after it and would just show up as loss. Since the offset changes,
+// the packets after the dropped one start a new segment for incomingSeq.
+func (r *rtpRewriter) drop(pkt *rtp.Packet) {
+	if pkt.SequenceNumber+r.seqOffset != r.lastSeq+1 {
+		return
+	}
+	r.seqOffset--
+	r.segmentStartSeq = pkt.SequenceNumber + 1
+	r.segmentStartOut = r.lastSeq + 1
+}
+
+// padding reserves the next outgoing sequence number for a packet the SFU generates itself.
+// Every later packet of the segment is shifted by one, which like drop starts a new segment
+// for incomingSeq. The padding reuses the last timestamp since it doesn't belong to any frame.
+func (r *rtpRewriter) padding() (uint16, uint32) {
+	r.seqOffset++
+	r.lastSeq++
+	r.segmentStartSeq = r.lastSeq + 1 - r.seqOffset
+	r.segmentStartOut = r.lastSeq + 1
+	return r.lastSeq, r.lastTS
+}
+
+// incomingSeq maps an outgoing sequence number back to the incoming one, this only works
+// for packets of the current segment since earlier ones came from another source.
+func (r *rtpRewriter) incomingSeq(outSeq uint16) (uint16, bool) {
+	if !r.started || isSeqOlder(outSeq, r.segmentStartOut) || isSeqOlder(r.lastSeq, outSeq) {
+		return 0, false
+	}
+	return outSeq - r.seqOffset, true
+}
+
+// isSeqOlder reports whether sequence number a comes before b, taking wrap around into account.
+func isSeqOlder(a, b uint16) bool {
+	return a != b && b-a < 0x8000
+}
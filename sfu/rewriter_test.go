@@ -0,0 +1,129 @@
+package sfu_server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func TestRTPRewriter(t *testing.T) {
+	type step struct {
+		seq       uint16
+		ts        uint32
+		at        time.Duration // since the first packet
+		newSource bool          // the packet comes from a new source
+		wantSeq   uint16
+		wantTS    uint32
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "first source is forwarded as is",
+			steps: []step{
+				{seq: 100, ts: 1000, wantSeq: 100, wantTS: 1000},
+				{seq: 101, ts: 4000, wantSeq: 101, wantTS: 4000},
+				{seq: 103, ts: 7000, wantSeq: 103, wantTS: 7000},
+				{seq: 102, ts: 7000, wantSeq: 102, wantTS: 7000},
+			},
+		},
+		{
+			name: "layer switch continues sequence numbers and advances timestamps by the wall clock",
+			steps: []step{
+				{seq: 100, ts: 1000, wantSeq: 100, wantTS: 1000},
+				{seq: 101, ts: 4000, wantSeq: 101, wantTS: 4000},
+				{seq: 5000, ts: 700000, at: time.Second, newSource: true, wantSeq: 102, wantTS: 94000},
+				{seq: 5001, ts: 703000, at: time.Second, wantSeq: 103, wantTS: 97000},
+				{seq: 20, ts: 10, at: 2 * time.Second, newSource: true, wantSeq: 104, wantTS: 187000},
+			},
+		},
+		{
+			name: "source wraps around",
+			steps: []step{
+				{seq: 65534, ts: 4294967000, wantSeq: 65534, wantTS: 4294967000},
+				{seq: 65535, ts: 2704, wantSeq: 65535, wantTS: 2704},
+				{seq: 0, ts: 5704, wantSeq: 0, wantTS: 5704},
+			},
+		},
+		{
+			name: "layer switch wraps the outgoing stream around",
+			steps: []step{
+				{seq: 65535, ts: 4294967000, wantSeq: 65535, wantTS: 4294967000},
+				{seq: 10, ts: 500, at: time.Second, newSource: true, wantSeq: 0, wantTS: 89704},
+				{seq: 11, ts: 3500, at: time.Second, wantSeq: 1, wantTS: 92704},
+			},
+		},
+		{
+			name: "switch right after a switch still moves the clock forward",
+			steps: []step{
+				{seq: 100, ts: 1000, wantSeq: 100, wantTS: 1000},
+				{seq: 7, ts: 0, newSource: true, wantSeq: 101, wantTS: 1001},
+				{seq: 900, ts: 50, newSource: true, wantSeq: 102, wantTS: 1002},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &rtpRewriter{clockRate: 90000}
+			start := time.Now()
+			for i, s := range tt.steps {
+				pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: s.seq, Timestamp: s.ts}}
+				now := start.Add(s.at)
+				if s.newSource || !r.started {
+					r.startSegment(pkt, now)
+				}
+				seq, ts := r.rewrite(pkt, now)
+				if seq != s.wantSeq || ts != s.wantTS {
+					t.Errorf("step %d: got seq %d ts %d, want seq %d ts %d", i, seq, ts, s.wantSeq, s.wantTS)
+				}
+			}
+		})
+	}
+}
+
+func TestRTPRewriterSegments(t *testing.T) {
+	r := &rtpRewriter{clockRate: 90000}
+	start := time.Now()
+	first := &rtp.Packet{Header: rtp.Header{SequenceNumber: 65530}}
+	r.startSegment(first, start)
+	r.rewrite(first, start)
+	next := &rtp.Packet{Header: rtp.Header{SequenceNumber: 3}}
+	r.startSegment(next, start.Add(time.Second))
+	r.rewrite(next, start.Add(time.Second))
+	r.rewrite(&rtp.Packet{Header: rtp.Header{SequenceNumber: 4}}, start.Add(time.Second))
+
+	inSegment := []struct {
+		seq  uint16
+		want bool
+	}{
+		{seq: 2, want: false}, // reordered packet from before the switch
+		{seq: 3, want: true},
+		{seq: 5, want: true},
+		{seq: 65535, want: false},
+	}
+	for _, tt := range inSegment {
+		if got := r.inSegment(&rtp.Packet{Header: rtp.Header{SequenceNumber: tt.seq}}); got != tt.want {
+			t.Errorf("inSegment(%d) = %v, want %v", tt.seq, got, tt.want)
+		}
+	}
+
+	incoming := []struct {
+		outSeq uint16
+		want   uint16
+		ok     bool
+	}{
+		{outSeq: 65530, ok: false}, // sent for the previous source
+		{outSeq: 65531, want: 3, ok: true},
+		{outSeq: 65532, want: 4, ok: true},
+		{outSeq: 65533, ok: false}, // not sent yet
+	}
+	for _, tt := range incoming {
+		got, ok := r.incomingSeq(tt.outSeq)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("incomingSeq(%d) = %d, %v, want %d, %v", tt.outSeq, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package sfu_server
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// newRoom creates an empty room, rooms are created lazily when their first peer sends an offer.
+func newRoom(id string) *Room {
+	room := &Room{
+		id:          id,
+		peers:       make(map[string]*PeerConnectionState),
+		moderators:  make(map[string]bool),
+		trackLocals: make(map[string]*PublishedTrack),
+		done:        make(chan struct{}),
+	}
+	room.autoSubscribe.Store(true)
+	room.speakers = newSpeakerDetector(room)
+	go room.speakers.run(room.done)
+	return room
+}
+
+// ID returns the room identifier sent by clients in join-room.
+func (r *Room) ID() string {
+	return r.id
+}
+
+// JoinRoom records which room a peer wants to be part of. It has to be called before the
+// peer's first offer is handled, peers that never call it are placed in DefaultRoomID.
+// Peers banned from the room get ErrBanned, peers whose access token is for another room
+// ErrNotGranted. settings are applied if the peer ends up creating the room and moderating it.
+func (s *SFU) JoinRoom(peerID string, roomID string, settings RoomSettings) error {
+	if roomID == "" {
+		roomID = DefaultRoomID
+	}
+
+	s.roomsLock.Lock()
+	defer s.roomsLock.Unlock()
+
+	if s.bannedLocked(roomID, peerID) {
+		return fmt.Errorf("%w %s", ErrBanned, roomID)
+	}
+	if grant, ok := s.grants[peerID]; ok && grant.room != "" && grant.room != roomID {
+		return fmt.Errorf("%w: room %s", ErrNotGranted, roomID)
+	}
+	if existing, ok := s.peerRooms[peerID]; ok && existing.roomID != roomID {
+		log.Printf("[%s] Already joined room %s, ignoring request to join %s", peerID, existing.roomID, roomID)
+		return nil
+	}
+	s.peerRooms[peerID] = roomRequest{roomID: roomID, settings: settings}
+	log.Printf("[%s] Joined room %s", peerID, roomID)
+	return nil
+}
+
+// checkNotBanned returns ErrBanned when a peer is banned from the room it would be placed in.
+func (s *SFU) checkNotBanned(peerID string) error {
+	s.roomsLock.RLock()
+	defer s.roomsLock.RUnlock()
+	roomID := s.requestedRoomLocked(peerID)
+	if s.bannedLocked(roomID, peerID) {
+		return fmt.Errorf("%w %s", ErrBanned, roomID)
+	}
+	return nil
+}
+
+// roomForPeer returns the room a peer asked to join, creating it if this is its first peer.
+// The peer is registered in the room while roomsLock is held so an empty room
+// can't be deleted between the lookup and the registration.
+func (s *SFU) roomForPeer(pcs *PeerConnectionState) *Room {
+	s.roomsLock.Lock()
+	defer s.roomsLock.Unlock()
+
+	roomID := s.requestedRoomLocked(pcs.id)
+	_, existed := s.rooms[roomID]
+	room := s.roomLocked(roomID)
+	room.addPeer(pcs)
+	if !existed {
+		s.applyRoomSettingsLocked(room, pcs.id)
+	}
+
+	return room
+}
+
+// roomLocked returns a room, creating it if it doesn't exist. roomsLock must be held.
+func (s *SFU) roomLocked(roomID string) *Room {
+	room, ok := s.rooms[roomID]
+	if ok {
+		return room
+	}
+
+	room = newRoom(roomID)
+	s.rooms[roomID] = room
+	log.Printf("Created room %s", roomID)
+	return room
+}
+
+// applyRoomSettingsLocked applies what a peer asked for in join-room to the room it just
+// created, if it moderates it. roomsLock must be held.
+func (s *SFU) applyRoomSettingsLocked(room *Room, peerID string) {
+	settings := s.peerRooms[peerID].settings
+	if settings == (RoomSettings{}) {
+		return
+	}
+	if !room.isModerator(peerID) {
+		log.Printf("[%s] Not a moderator of room %s, ignoring its room settings", peerID, room.id)
+		return
+	}
+	if settings.AutoSubscribe != nil {
+		room.autoSubscribe.Store(*settings.AutoSubscribe)
+		log.Printf("Auto subscribe of room %s set to %t by %s", room.id, *settings.AutoSubscribe, peerID)
+	}
+	if settings.LastN != nil && *settings.LastN >= 0 {
+		room.lastN.Store(int32(*settings.LastN))
+		log.Printf("Last-N of room %s set to %d by %s", room.id, *settings.LastN, peerID)
+	}
+}
+
+// leaveRoom removes a peer from its room and deletes the room once nobody is left in it.
+func (s *SFU) leaveRoom(pcs *PeerConnectionState) {
+	s.roomsLock.Lock()
+	defer s.roomsLock.Unlock()
+
+	delete(s.peerRooms, pcs.id)
+	if pcs.room == nil {
+		return
+	}
+
+	pcs.room.removePeer(pcs.id)
+	s.removeRoomIfEmptyLocked(pcs.room)
+}
+
+// removeRoomIfEmptyLocked deletes a room nobody is in anymore. roomsLock must be held.
+func (s *SFU) removeRoomIfEmptyLocked(room *Room) {
+	if room.peerCount() == 0 && room.ingests == 0 && s.rooms[room.id] == room {
+		delete(s.rooms, room.id)
+		close(room.done)
+		log.Printf("Room %s is empty, removed it", room.id)
+	}
+}
+
+// addPeer adds a peer to the room. Peers with an access token moderate the room when it
+// grants isAdmin. Without tokens the first websocket peer of a room without moderators
+// becomes its moderator, so whoever opens a meeting hosts it.
+func (r *Room) addPeer(pcs *PeerConnectionState) {
+	r.peersLock.Lock()
+	defer r.peersLock.Unlock()
+	r.peers[pcs.id] = pcs
+	if pcs.grants != nil {
+		if pcs.grants.IsAdmin {
+			r.moderators[pcs.id] = true
+		}
+	} else if len(r.moderators) == 0 && !pcs.httpSignaled {
+		r.moderators[pcs.id] = true
+	}
+}
+
+func (r *Room) removePeer(peerID string) {
+	r.peersLock.Lock()
+	delete(r.peers, peerID)
+	delete(r.moderators, peerID)
+	r.peersLock.Unlock()
+	r.speakers.forget(peerID)
+}
+
+func (r *Room) peerCount() int {
+	r.peersLock.RLock()
+	defer r.peersLock.RUnlock()
+	return len(r.peers)
+}
+
+// addExistingTracksToPeer subscribes a new peer to all currently active tracks of the room.
+func (r *Room) addExistingTracksToPeer(pcs *PeerConnectionState) {
+	r.trackLock.RLock()
+	defer r.trackLock.RUnlock()
+
+	if len(r.trackLocals) == 0 {
+		return
+	}
+
+	log.Printf("[%s] Adding %d existing tracks of room %s to new peer connection", pcs.id, len(r.trackLocals), r.id)
+	for globalTrackID, track := range r.trackLocals {
+		// every offer of the peer ends up here, not only its first one
+		if track.publisherID == pcs.id || track.downTrackFor(pcs.id) != nil {
+			continue
+		}
+		log.Printf("[%s] Adding existing track %s to new peer", pcs.id, globalTrackID)
+		if err := r.subscribe(pcs, track); err != nil {
+			log.Printf("[%s] Failed to add existing track %s to new peer: %v", pcs.id, globalTrackID, err)
+		}
+	}
+}
+
+// publishTrack returns the track registered under globalTrackID, creating it with newTrack
+// when this is the first layer we see of it. created tells the caller it still has to
+// offer it to the room.
+func (r *Room) publishTrack(globalTrackID string, newTrack func() *PublishedTrack) (track *PublishedTrack, created bool) {
+	r.trackLock.Lock()
+	defer r.trackLock.Unlock()
+
+	if track, ok := r.trackLocals[globalTrackID]; ok {
+		return track, false
+	}
+	track = newTrack()
+	r.trackLocals[globalTrackID] = track
+	return track, true
+}
+
+// publishedTrack returns a track of the room by its global ID, or nil.
+func (r *Room) publishedTrack(globalTrackID string) *PublishedTrack {
+	r.trackLock.RLock()
+	defer r.trackLock.RUnlock()
+	return r.trackLocals[globalTrackID]
+}
+
+// addTrackToPeers subscribes all connected peers of the room except the originator to a new track.
+func (r *Room) addTrackToPeers(track *PublishedTrack) {
+	r.peersLock.RLock()
+	defer r.peersLock.RUnlock()
+
+	for otherPeerID, otherPCS := range r.peers {
+		// peers signaled over HTTP can't renegotiate, WHEP viewers keep the tracks they started with
+		if otherPeerID == track.publisherID || otherPCS.httpSignaled || !otherPCS.canSubscribe() {
+			continue
+		}
+		if err := r.subscribe(otherPCS, track); err != nil {
+			log.Printf("Failed to add track %s to peer %s: %v", track.id, otherPeerID, err)
+		}
+	}
+}
+
+// subscribe creates a DownTrack of track for pcs and adds it to its PeerConnection,
+// which triggers a renegotiation with that peer.
+func (r *Room) subscribe(pcs *PeerConnectionState, track *PublishedTrack) error {
+	if track.publisherID == pcs.id {
+		return fmt.Errorf("peer %s can't subscribe to its own track %s", pcs.id, track.id)
+	}
+	if pcs.publishOnly {
+		return fmt.Errorf("peer %s only publishes", pcs.id)
+	}
+	if !pcs.canSubscribe() {
+		return fmt.Errorf("%w: peer %s can't subscribe", ErrNotGranted, pcs.id)
+	}
+	if track.downTrackFor(pcs.id) != nil {
+		return fmt.Errorf("peer %s is already subscribed to track %s", pcs.id, track.id)
+	}
+
+	downTrack := newDownTrack(track, pcs)
+	if track.kind == webrtc.RTPCodecTypeVideo && !pcs.isLastNLive(track.publisherID) {
+		downTrack.setLastNPaused(true)
+	}
+	sender, err := pcs.peerConnection.AddTrack(downTrack)
+	if err != nil {
+		return err
+	}
+	downTrack.sender = sender
+	track.addDownTrack(downTrack)
+	go downTrack.readRTCP()
+	pcs.bandwidth.reallocate()
+	// callers may hold room locks, the ranking is refreshed from outside of them
+	go r.applyLastN()
+	return nil
+}
+
+// unsubscribe stops forwarding a track to pcs and removes its transceiver's track,
+// which triggers a renegotiation with that peer.
+func (r *Room) unsubscribe(pcs *PeerConnectionState, track *PublishedTrack) error {
+	downTrack := track.removeDownTrack(pcs.id)
+	if downTrack == nil {
+		return fmt.Errorf("peer %s is not subscribed to track %s", pcs.id, track.id)
+	}
+	pcs.bandwidth.reallocate()
+	if downTrack.sender == nil {
+		return nil
+	}
+	return pcs.peerConnection.RemoveTrack(downTrack.sender)
+}
+
+// unsubscribeAll drops every DownTrack of a peer that is leaving, its PeerConnection
+// is closed anyway so there is nothing to renegotiate.
+func (r *Room) unsubscribeAll(peerID string) {
+	r.trackLock.RLock()
+	defer r.trackLock.RUnlock()
+
+	for _, track := range r.trackLocals {
+		track.removeDownTrack(peerID)
+	}
+}
+
+// downTracksOf returns every DownTrack a peer currently receives in this room.
+func (r *Room) downTracksOf(peerID string) []*DownTrack {
+	r.trackLock.RLock()
+	defer r.trackLock.RUnlock()
+
+	var downTracks []*DownTrack
+	for _, track := range r.trackLocals {
+		if downTrack := track.downTrackFor(peerID); downTrack != nil {
+			downTracks = append(downTracks, downTrack)
+		}
+	}
+	return downTracks
+}
+
+// removeTrack cleans up a track from the room and all peer connections in it.
+func (r *Room) removeTrack(globalTrackID string) {
+	r.trackLock.Lock()
+	trackToRemove, ok := r.trackLocals[globalTrackID]
+	if !ok {
+		r.trackLock.Unlock()
+		return
+	}
+	delete(r.trackLocals, globalTrackID)
+	r.trackLock.Unlock()
+
+	log.Printf("Removed track %s from room %s", globalTrackID, r.id)
+	trackToRemove.closeAllSinks()
+	r.notifyPeers(trackToRemove.publisherID, "track-removed", trackToRemove.info(""))
+
+	for _, downTrack := range trackToRemove.allDownTracks() {
+		trackToRemove.removeDownTrack(downTrack.subscriber.id)
+		if downTrack.sender == nil {
+			continue
+		}
+		if err := downTrack.subscriber.peerConnection.RemoveTrack(downTrack.sender); err != nil {
+			log.Printf("Error removing track %s from peer %s: %v", globalTrackID, downTrack.subscriber.id, err)
+		}
+	}
+}
+
+// NackStats returns the retransmission counters of every track of a room, keyed by global track ID.
+func (s *SFU) NackStats(roomID string) (map[string]NackCounters, error) {
+	s.roomsLock.RLock()
+	room, ok := s.rooms[roomID]
+	s.roomsLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown room %s", roomID)
+	}
+
+	room.trackLock.RLock()
+	defer room.trackLock.RUnlock()
+	stats := make(map[string]NackCounters, len(room.trackLocals))
+	for globalTrackID, track := range room.trackLocals {
+		stats[globalTrackID] = track.NackStats()
+	}
+	return stats, nil
+}
+
+// tracksPublishedBy returns the global IDs of every track in the room that was published by peerID.
+func (r *Room) tracksPublishedBy(peerID string) []string {
+	r.trackLock.RLock()
+	defer r.trackLock.RUnlock()
+
+	var trackIDs []string
+	for globalTrackID, track := range r.trackLocals {
+		if track.publisherID == peerID {
+			trackIDs = append(trackIDs, globalTrackID)
+		}
+	}
+	return trackIDs
+}
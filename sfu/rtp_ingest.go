@@ -0,0 +1,313 @@
+package sfu_server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// rtpIngestIdleTimeout is how long an ingest may go without a valid packet before it is
+	// removed, this also bounds how long an allocated port waits for its first packet.
+	rtpIngestIdleTimeout = 10 * time.Second
+
+	// rtpIngestMTU is the largest packet read from an ingest port.
+	rtpIngestMTU = 1500
+
+	// defaultMaxRTPIngests is how many ingests may run at once unless SetRTPIngestLimit
+	// says otherwise.
+	defaultMaxRTPIngests = 16
+)
+
+// rtpIngestCodec is a codec plain RTP sources can send, with the payload type they are
+// told to use. Payload types follow pion's defaults so they look familiar, subscribers
+// get whatever their own negotiation picked.
+type rtpIngestCodec struct {
+	kind        webrtc.RTPCodecType
+	capability  webrtc.RTPCodecCapability
+	payloadType uint8
+}
+
+var rtpIngestCodecs = []rtpIngestCodec{
+	{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"}, 111},
+	{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, 96},
+	{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0"}, 98},
+	{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"}, 106},
+	{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000}, 45},
+}
+
+// RTPIngest tells a plain RTP source, like ffmpeg or GStreamer, where and how to send its
+// stream. Packets with another SSRC or payload type are dropped.
+type RTPIngest struct {
+	ID          string `json:"id"`      // publisher ID of the track, also used to stop the ingest
+	RoomID      string `json:"roomId"`  // room the track is published in
+	TrackID     string `json:"trackId"` // global track ID subscribers see once packets flow
+	Port        int    `json:"port"`    // UDP port to send RTP to
+	SSRC        uint32 `json:"ssrc"`
+	PayloadType uint8  `json:"payloadType"`
+	MimeType    string `json:"mimeType"`
+	ClockRate   uint32 `json:"clockRate"`
+}
+
+// rtpIngest reads a plain RTP stream from its own UDP port. It is both the rtpSource of the
+// track's single layer and its rtcpWriter.
+type rtpIngest struct {
+	info  RTPIngest
+	codec rtpIngestCodec
+	sfu   *SFU
+	room  *Room
+	conn  *net.UDPConn
+
+	// only touched by the goroutine reading the port
+	remote  *net.UDPAddr // latched on the first valid packet, others are dropped
+	first   *rtp.Packet  // read while waiting for the stream, returned by the next ReadRTP
+	dropped uint64       // packets that didn't match the allocation
+}
+
+// SetRTPIngestPorts limits the UDP ports given to plain RTP ingests to [minPort, maxPort], so they
+// can be opened in a firewall. With 0, 0 the OS picks any free port.
+func (s *SFU) SetRTPIngestPorts(minPort, maxPort int) error {
+	if minPort < 0 || maxPort > 65535 || minPort > maxPort {
+		return fmt.Errorf("invalid RTP ingest port range %d-%d", minPort, maxPort)
+	}
+	s.rtpIngestsLock.Lock()
+	defer s.rtpIngestsLock.Unlock()
+	s.rtpPortMin, s.rtpPortMax = minPort, maxPort
+	return nil
+}
+
+// ErrTooManyRTPIngests is returned by StartRTPIngest when the limit of ingests running at
+// once is reached.
+var ErrTooManyRTPIngests = errors.New("too many plain RTP ingests")
+
+// SetRTPIngestLimit caps how many plain RTP ingests may run at once, every one of them
+// holds a UDP port.
+func (s *SFU) SetRTPIngestLimit(max int) error {
+	if max <= 0 {
+		return fmt.Errorf("invalid RTP ingest limit %d", max)
+	}
+	s.rtpIngestsLock.Lock()
+	defer s.rtpIngestsLock.Unlock()
+	s.rtpIngestMax = max
+	return nil
+}
+
+// StartRTPIngest allocates a UDP port a plain RTP source can send a single stream of
+// mimeType to, unencrypted and without any signaling. The track is published in roomID
+// when the first packet arrives, subscribers receive it like any WebRTC published track,
+// and it is removed once no packet arrived for rtpIngestIdleTimeout.
+func (s *SFU) StartRTPIngest(roomID string, mimeType string) (*RTPIngest, error) {
+	if roomID == "" {
+		roomID = DefaultRoomID
+	}
+	codec, ok := rtpIngestCodecFor(mimeType)
+	if !ok {
+		return nil, fmt.Errorf("plain RTP ingest doesn't support %q", mimeType)
+	}
+
+	// the slot is taken before the port is bound, so concurrent requests can't overshoot
+	s.rtpIngestsLock.Lock()
+	if len(s.rtpIngests)+s.rtpIngestsStarting >= s.rtpIngestMax {
+		s.rtpIngestsLock.Unlock()
+		return nil, fmt.Errorf("%w: %d are running", ErrTooManyRTPIngests, s.rtpIngestMax)
+	}
+	s.rtpIngestsStarting++
+	s.rtpIngestsLock.Unlock()
+	defer func() {
+		s.rtpIngestsLock.Lock()
+		s.rtpIngestsStarting--
+		s.rtpIngestsLock.Unlock()
+	}()
+
+	id, err := newPublisherID("rtp")
+	if err != nil {
+		return nil, err
+	}
+	ssrc := make([]byte, 4)
+	if _, err := rand.Read(ssrc); err != nil {
+		return nil, err
+	}
+
+	conn, err := s.listenRTPIngest()
+	if err != nil {
+		return nil, err
+	}
+
+	ingest := &rtpIngest{
+		info: RTPIngest{
+			ID:          id,
+			RoomID:      roomID,
+			TrackID:     fmt.Sprintf("%s_%s_rtp", id, codec.kind),
+			Port:        conn.LocalAddr().(*net.UDPAddr).Port,
+			SSRC:        binary.BigEndian.Uint32(ssrc),
+			PayloadType: codec.payloadType,
+			MimeType:    codec.capability.MimeType,
+			ClockRate:   codec.capability.ClockRate,
+		},
+		codec: codec,
+		sfu:   s,
+		conn:  conn,
+	}
+
+	// the room has to outlive its peers while the ingest publishes into it
+	s.roomsLock.Lock()
+	ingest.room = s.roomLocked(roomID)
+	ingest.room.ingests++
+	s.roomsLock.Unlock()
+
+	s.rtpIngestsLock.Lock()
+	s.rtpIngests[id] = ingest
+	s.rtpIngestsLock.Unlock()
+
+	log.Printf("[%s] Waiting for %s RTP on port %d for room %s", id, codec.capability.MimeType, ingest.info.Port, roomID)
+	go ingest.run()
+
+	info := ingest.info
+	return &info, nil
+}
+
+// StopRTPIngest closes the port of an ingest and unpublishes its track.
+func (s *SFU) StopRTPIngest(id string) error {
+	s.rtpIngestsLock.Lock()
+	ingest, ok := s.rtpIngests[id]
+	s.rtpIngestsLock.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown RTP ingest %s", id)
+	}
+	// the reader sees the closed socket, removes the track and releases the rest
+	return ingest.conn.Close()
+}
+
+func rtpIngestCodecFor(mimeType string) (rtpIngestCodec, bool) {
+	for _, codec := range rtpIngestCodecs {
+		if strings.EqualFold(codec.capability.MimeType, mimeType) {
+			return codec, true
+		}
+	}
+	return rtpIngestCodec{}, false
+}
+
+// listenRTPIngest binds a free UDP port inside the configured range.
+func (s *SFU) listenRTPIngest() (*net.UDPConn, error) {
+	s.rtpIngestsLock.Lock()
+	minPort, maxPort := s.rtpPortMin, s.rtpPortMax
+	s.rtpIngestsLock.Unlock()
+
+	if maxPort == 0 {
+		return net.ListenUDP("udp", &net.UDPAddr{})
+	}
+	for port := minPort; port <= maxPort; port++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, fmt.Errorf("no free UDP port in %d-%d for RTP ingest", minPort, maxPort)
+}
+
+// run publishes the track once the stream starts and forwards it until it goes idle or
+// the ingest is stopped.
+func (i *rtpIngest) run() {
+	defer i.release()
+
+	pkt, _, err := i.ReadRTP()
+	if err != nil {
+		log.Printf("[%s] No RTP received on port %d, releasing it", i.info.ID, i.info.Port)
+		return
+	}
+	i.first = pkt
+
+	track, created := i.room.publishTrack(i.info.TrackID, func() *PublishedTrack {
+		return newPublishedTrack(i.info.TrackID, i.info.ID, i.codec.kind, i.codec.capability, i.info.ID, i)
+	})
+	layer := track.addLayer("", i)
+	if created {
+		i.sfu.announceTrack(i.room, track)
+	}
+	i.sfu.forwardRTP(i.room, track, layer)
+}
+
+// release frees the port and lets the room go once nothing else is in it.
+func (i *rtpIngest) release() {
+	i.conn.Close()
+
+	i.sfu.rtpIngestsLock.Lock()
+	delete(i.sfu.rtpIngests, i.info.ID)
+	i.sfu.rtpIngestsLock.Unlock()
+
+	i.sfu.roomsLock.Lock()
+	i.room.ingests--
+	i.sfu.removeRoomIfEmptyLocked(i.room)
+	i.sfu.roomsLock.Unlock()
+
+	if i.dropped > 0 {
+		log.Printf("[%s] RTP ingest stopped, %d packets not matching the allocation were dropped", i.info.ID, i.dropped)
+	}
+}
+
+// ReadRTP returns the next packet of the stream. Going idle and being stopped both end the
+// stream like a WebRTC track ending, with io.EOF.
+func (i *rtpIngest) ReadRTP() (*rtp.Packet, interceptor.Attributes, error) {
+	if pkt := i.first; pkt != nil {
+		i.first = nil
+		return pkt, nil, nil
+	}
+
+	for {
+		if err := i.conn.SetReadDeadline(time.Now().Add(rtpIngestIdleTimeout)); err != nil {
+			return nil, nil, io.EOF
+		}
+		// packets are kept by the retransmission buffer and sinks, each one needs its own memory
+		buf := make([]byte, rtpIngestMTU)
+		n, addr, err := i.conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				log.Printf("[%s] RTP ingest idle for %s, removing it", i.info.ID, rtpIngestIdleTimeout)
+			} else if !errors.Is(err, net.ErrClosed) {
+				log.Printf("[%s] RTP ingest read error: %v", i.info.ID, err)
+			}
+			return nil, nil, io.EOF
+		}
+
+		pkt := &rtp.Packet{}
+		if err := pkt.Unmarshal(buf[:n]); err != nil || pkt.SSRC != i.info.SSRC || pkt.PayloadType != i.info.PayloadType {
+			// RTCP muxed on the same port ends up here too, there is nothing in it we need
+			i.drop(addr)
+			continue
+		}
+		if i.remote == nil {
+			i.remote = addr
+			log.Printf("[%s] Receiving RTP from %s", i.info.ID, addr)
+		} else if !i.remote.IP.Equal(addr.IP) || i.remote.Port != addr.Port {
+			i.drop(addr)
+			continue
+		}
+		return pkt, nil, nil
+	}
+}
+
+func (i *rtpIngest) drop(addr *net.UDPAddr) {
+	i.dropped++
+	if i.dropped == 1 {
+		log.Printf("[%s] Dropping packet from %s that doesn't match SSRC %d and payload type %d", i.info.ID, addr, i.info.SSRC, i.info.PayloadType)
+	}
+}
+
+// SSRC returns the SSRC the source was told to use.
+func (i *rtpIngest) SSRC() webrtc.SSRC { return webrtc.SSRC(i.info.SSRC) }
+
+// WriteRTCP drops feedback, plain RTP sources have no way to receive it. Encoders have to
+// send keyframes on their own, subscribers that join in between wait for the next one.
+func (i *rtpIngest) WriteRTCP([]rtcp.Packet) error { return nil }
@@ -3,11 +3,46 @@ package sfu_server
 import (
 	"fmt"
 	"github.com/pion/ice/v2"
+	"github.com/pion/interceptor"
+	"github.com/pion/logging"
+	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v3"
 	"github.com/samyak112/monoport/logger"
 	"net"
 )
 
+// pion/sdp doesn't export this one, it carries the RID an RTX packet is repairing
+const sdesRepairedRTPStreamIDURI = "urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id"
+
+// APIConfig holds the ICE and media settings every PeerConnection of the API is built with.
+type APIConfig struct {
+	// AnnouncedIPs replace the addresses of the host candidates, the public IPs of a
+	// server behind 1:1 NAT. Each address family is mapped on its own, by one IP or by
+	// public/local pairs, and a family without any announces its interface addresses.
+	AnnouncedIPs []string
+	// NetworkTypes are the candidates gathered, TCP ones need TCPMux
+	NetworkTypes []webrtc.NetworkType
+	// TCPMux serves passive ICE-TCP candidates on one TCP port, nil gathers none. It
+	// outlives the API, one built for a new announced IP takes the same mux.
+	TCPMux ice.TCPMux
+	// Codecs are the names of the codecs to negotiate, keys of supportedCodecs. Empty
+	// negotiates all of them.
+	Codecs []string
+	// LogLevel is the level of pion's logs.
+	LogLevel logging.LogLevel
+
+	Interceptors InterceptorConfig
+}
+
+// DefaultAPIConfig uses UDP over IPv4 and IPv6, every codec and every built-in interceptor.
+func DefaultAPIConfig() APIConfig {
+	return APIConfig{
+		NetworkTypes: []webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6},
+		LogLevel:     logging.LogLevelWarn,
+		Interceptors: DefaultInterceptorConfig(),
+	}
+}
+
 /*
 CreateCustomUDPWebRTCAPI configures and returns a WebRTC API instance that utilizes a
 pre-existing UDP connection instead of opening new ports.
@@ -21,27 +56,15 @@ these settings to all subsequently created PeerConnections.
 Args:
 
 	conn (net.PacketConn): The existing UDP connection to be used by WebRTC.
+	config (APIConfig): The ICE, codec and interceptor settings every PeerConnection is built with.
 
 Returns:
 
 	*webrtc.API: A configured WebRTC API for creating PeerConnections.
+	ice.UDPMux: The multiplexer wrapping conn, the STUN server needs it too.
+	error: Set when a codec or one of the interceptors couldn't be configured.
 */
-func CreateCustomUDPWebRTCAPI(conn net.PacketConn) (*webrtc.API, ice.UDPMux) {
-
-	/*SettingEngine must be configured with the UDP multiplexer before creating
-	PeerConnections because ICE transport configuration is immutable after
-	initialization. The ICE agent needs to know about the shared socket during
-	setup to properly register for packet demultiplexing and generate
-	appropriate candidates referencing the multiplexed port.
-
-	However, it doesn't actually do anything by itself - it just stores your preferences we have to call
-	a newAPI function bring this in effect.*/
-	settingEngine := webrtc.SettingEngine{}
-	settingEngine.SetNAT1To1IPs([]string{"34.44.36.231"}, webrtc.ICECandidateTypeHost)
-
-	settingEngine.SetNetworkTypes([]webrtc.NetworkType{
-		webrtc.NetworkTypeUDP4,
-	})
+func CreateCustomUDPWebRTCAPI(conn net.PacketConn, config APIConfig) (*webrtc.API, ice.UDPMux, error) {
 
 	/*Tow reasons to use pion's udp multiplexer here
 	1.NewICEUDPMux creates a UDP multiplexer for efficient port sharing across
@@ -52,26 +75,83 @@ func CreateCustomUDPWebRTCAPI(conn net.PacketConn) (*webrtc.API, ice.UDPMux) {
 	in main.go so that i can try to bypass symmetric NATs*/
 
 	// added this logger so that i can see the internal logs of pion for debugging
-	logger := &logger.SimpleLogger{}
-	var udpMux = webrtc.NewICEUDPMux(logger, conn)
+	var udpMux = webrtc.NewICEUDPMux(&logger.SimpleLogger{Level: config.LogLevel}, conn)
+
+	api, err := NewWebRTCAPI(udpMux, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return api, udpMux, nil
+}
+
+// NewWebRTCAPI builds a WebRTC API on an existing UDP multiplexer. Settings of an API can't
+// change once it is built, so a new one is built on the same mux when they do, e.g. when
+// the announced IP changes. Interceptors, custom ones too, are registered again.
+func NewWebRTCAPI(udpMux ice.UDPMux, config APIConfig) (*webrtc.API, error) {
+
+	/*SettingEngine must be configured with the UDP multiplexer before creating
+	PeerConnections because ICE transport configuration is immutable after
+	initialization. The ICE agent needs to know about the shared socket during
+	setup to properly register for packet demultiplexing and generate
+	appropriate candidates referencing the multiplexed port.
+
+	However, it doesn't actually do anything by itself - it just stores your preferences we have to call
+	a newAPI function bring this in effect.*/
+	settingEngine := webrtc.SettingEngine{
+		LoggerFactory: logger.Factory{Level: config.LogLevel},
+	}
+	if len(config.AnnouncedIPs) > 0 {
+		settingEngine.SetNAT1To1IPs(config.AnnouncedIPs, webrtc.ICECandidateTypeHost)
+	}
+
+	settingEngine.SetNetworkTypes(config.NetworkTypes)
 	settingEngine.SetICEUDPMux(udpMux)
+	if config.TCPMux != nil {
+		settingEngine.SetICETCPMux(config.TCPMux)
+	}
 
 	m := &webrtc.MediaEngine{}
 
-	// 2. Register the default codecs that browsers support.
+	// 2. Register the codecs that browsers support.
 	// THIS IS THE CRUCIAL STEP. Without it, the SFU doesn't know how
 	// to handle video (VP8, H264) or audio (Opus) from a browser.
-	if err := m.RegisterDefaultCodecs(); err != nil {
-		// This is a fatal startup error, so panic is appropriate.
-		fmt.Println("Failed to register default codecs: %v", err)
+	if err := registerCodecs(m, config.Codecs); err != nil {
+		return nil, err
+	}
+
+	// simulcast publishers tag every encoding with a RID header extension, pion can only
+	// demux those layers into separate TrackRemotes if these extensions are negotiated
+	for _, uri := range []string{sdp.SDESMidURI, sdp.SDESRTPStreamIDURI, sdesRepairedRTPStreamIDURI} {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, fmt.Errorf("registering simulcast header extension %s: %w", uri, err)
+		}
+	}
+
+	// browsers put the loudness of every audio packet in this extension, it is what
+	// active speaker detection runs on
+	if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, fmt.Errorf("registering audio level header extension: %w", err)
+	}
+
+	/*Interceptors have to be registered on the same media engine the API is built with,
+	most of them also negotiate RTCP feedback or header extensions. Every PeerConnection
+	builds its own chain from this registry, so whatever is added here (including custom
+	interceptors from the config hook) runs on every PeerConnection.*/
+	registry := &interceptor.Registry{}
+	if err := config.Interceptors.register(m, registry); err != nil {
+		return nil, err
 	}
 
 	/*NewAPI creates a configured WebRTC API factory from SettingEngine options.
 	Returns an API instance that applies custom settings to all created
 	PeerConnections. Initialize once per application, not per connection.*/
-	api := webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine), webrtc.WithMediaEngine(m))
+	api := webrtc.NewAPI(
+		webrtc.WithSettingEngine(settingEngine),
+		webrtc.WithMediaEngine(m),
+		webrtc.WithInterceptorRegistry(registry),
+	)
 
-	return api, udpMux
+	return api, nil
 }
 
 func RecvAndForwardMediaPackets(webRtcApi *webrtc.API) {
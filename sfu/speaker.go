@@ -0,0 +1,224 @@
+package sfu_server
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// speakerCheckInterval is how often speaking states and the active speaker are re-evaluated.
+	speakerCheckInterval = 200 * time.Millisecond
+
+	// silenceLevel is the quietest level the audio level extension can carry, in -dBov.
+	silenceLevel = 127
+
+	// levelSmoothing is the weight of every new packet in the smoothed level. Audio comes in
+	// every 20ms, so the score follows speech within a couple hundred milliseconds while a
+	// single loud packet (a cough, a keyboard click) barely moves it.
+	levelSmoothing = 0.1
+
+	// a peer starts speaking above speakingStartLevel and stops below speakingStopLevel, both
+	// in -dBov, the gap keeps indicators from flickering around a single threshold
+	speakingStartLevel = 45
+	speakingStopLevel  = 55
+
+	// speakerTimeout is how long a peer may go without audio packets before it counts as silent.
+	// Opus DTX stops sending packets altogether during silence.
+	speakerTimeout = 500 * time.Millisecond
+
+	// activeSpeakerHold is the minimum time a peer stays the active speaker, and
+	// activeSpeakerMargin how much louder (in dB) someone else must be to take over earlier.
+	activeSpeakerHold   = time.Second
+	activeSpeakerMargin = 6
+)
+
+// audioLevelExtensionID returns the negotiated ID of the audio level header extension on a
+// receiver, or 0 when the publisher didn't negotiate it.
+func audioLevelExtensionID(receiver *webrtc.RTPReceiver) uint8 {
+	for _, extension := range receiver.GetParameters().HeaderExtensions {
+		if extension.URI == sdp.AudioLevelURI {
+			return uint8(extension.ID)
+		}
+	}
+	return 0
+}
+
+// packetAudioLevel reads the audio level of a packet, ok is false when it doesn't carry one.
+func packetAudioLevel(pkt *rtp.Packet, extensionID uint8) (level uint8, ok bool) {
+	payload := pkt.GetExtension(extensionID)
+	if payload == nil {
+		return 0, false
+	}
+	var extension rtp.AudioLevelExtension
+	if err := extension.Unmarshal(payload); err != nil {
+		return 0, false
+	}
+	return extension.Level, true
+}
+
+// speakerState is the smoothed loudness of one peer, in -dBov like the extension itself,
+// so lower means louder.
+type speakerState struct {
+	level      float64
+	lastPacket time.Time
+	speaking   bool
+}
+
+// speakerDetector keeps a loudness score for every peer of a room that publishes audio, and
+// tells the room who is speaking and who the active (loudest) speaker is.
+type speakerDetector struct {
+	room *Room
+
+	mu                 sync.Mutex
+	speakers           map[string]*speakerState // keyed by peer ID
+	activeSpeaker      string
+	activeSpeakerSince time.Time
+	recent             []string // peers that were active speaker, most recent first
+}
+
+func newSpeakerDetector(room *Room) *speakerDetector {
+	return &speakerDetector{
+		room:     room,
+		speakers: make(map[string]*speakerState),
+	}
+}
+
+// observe feeds the level of one audio packet of a peer into its score.
+func (d *speakerDetector) observe(peerID string, level uint8) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	speaker, ok := d.speakers[peerID]
+	if !ok {
+		speaker = &speakerState{level: silenceLevel}
+		d.speakers[peerID] = speaker
+	}
+	speaker.level += (float64(level) - speaker.level) * levelSmoothing
+	speaker.lastPacket = time.Now()
+}
+
+// forget drops a peer that left the room.
+func (d *speakerDetector) forget(peerID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.speakers, peerID)
+	d.recent = removeString(d.recent, peerID)
+}
+
+// recentSpeakers returns the peers that have been the active speaker, most recent first.
+func (d *speakerDetector) recentSpeakers() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.recent...)
+}
+
+// setActiveSpeakerLocked makes peerID the active speaker and moves it to the front of recent.
+func (d *speakerDetector) setActiveSpeakerLocked(peerID string, now time.Time) {
+	d.activeSpeaker = peerID
+	d.activeSpeakerSince = now
+	if peerID != "" {
+		d.recent = append([]string{peerID}, removeString(d.recent, peerID)...)
+	}
+}
+
+func removeString(values []string, value string) []string {
+	kept := values[:0]
+	for _, v := range values {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// SpeakingEvent is the data of a speaking-changed message.
+type SpeakingEvent struct {
+	PeerID   string `json:"peerId"`
+	Speaking bool   `json:"speaking"`
+	Level    int    `json:"level"` // smoothed audio level in -dBov, 0 is the loudest and 127 silence
+}
+
+// ActiveSpeakerEvent is the data of an active-speaker message.
+type ActiveSpeakerEvent struct {
+	PeerID string `json:"peerId"` // empty once the previous active speaker left the room
+}
+
+// run re-evaluates the room every speakerCheckInterval until done is closed.
+func (d *speakerDetector) run(done <-chan struct{}) {
+	ticker := time.NewTicker(speakerCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			d.check()
+		}
+	}
+}
+
+// check updates speaking states and the active speaker, and notifies the room of changes.
+func (d *speakerDetector) check() {
+	now := time.Now()
+	var changes []SpeakingEvent
+	var activeSpeaker *ActiveSpeakerEvent
+
+	d.mu.Lock()
+	peerIDs := make([]string, 0, len(d.speakers))
+	for peerID := range d.speakers {
+		peerIDs = append(peerIDs, peerID)
+	}
+	sort.Strings(peerIDs)
+
+	loudest := ""
+	for _, peerID := range peerIDs {
+		speaker := d.speakers[peerID]
+		if now.Sub(speaker.lastPacket) > speakerTimeout {
+			speaker.level = silenceLevel
+		}
+
+		switch {
+		case !speaker.speaking && speaker.level < speakingStartLevel:
+			speaker.speaking = true
+			changes = append(changes, SpeakingEvent{PeerID: peerID, Speaking: true, Level: int(speaker.level)})
+		case speaker.speaking && speaker.level > speakingStopLevel:
+			speaker.speaking = false
+			changes = append(changes, SpeakingEvent{PeerID: peerID, Speaking: false, Level: int(speaker.level)})
+		}
+
+		if speaker.speaking && (loudest == "" || speaker.level < d.speakers[loudest].level) {
+			loudest = peerID
+		}
+	}
+
+	current, currentPresent := d.speakers[d.activeSpeaker]
+	switch {
+	case d.activeSpeaker != "" && !currentPresent:
+		// the active speaker left, whoever speaks takes over right away
+		d.setActiveSpeakerLocked(loudest, now)
+		activeSpeaker = &ActiveSpeakerEvent{PeerID: loudest}
+	case loudest == "" || loudest == d.activeSpeaker:
+		// nobody speaks, the last active speaker stays, like the big tile of a call app
+	case d.activeSpeaker == "" || !current.speaking ||
+		(now.Sub(d.activeSpeakerSince) >= activeSpeakerHold && d.speakers[loudest].level+activeSpeakerMargin < current.level):
+		d.setActiveSpeakerLocked(loudest, now)
+		activeSpeaker = &ActiveSpeakerEvent{PeerID: loudest}
+	}
+	d.mu.Unlock()
+
+	for _, change := range changes {
+		d.room.notifyPeers("", "speaking-changed", change)
+	}
+	if activeSpeaker != nil {
+		log.Printf("Active speaker of room %s is now %q", d.room.id, activeSpeaker.PeerID)
+		d.room.notifyPeers("", "active-speaker", *activeSpeaker)
+		d.room.applyLastN()
+	}
+}
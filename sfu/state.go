@@ -2,10 +2,16 @@ package sfu_server
 
 import (
 	"github.com/pion/webrtc/v3"
+	"github.com/samyak112/monoport/auth"
 	"github.com/samyak112/monoport/transport"
 	"sync"
+	"sync/atomic"
 )
 
+// DefaultRoomID is used for peers that never sent a room ID in their join-room message,
+// so older clients keep working and simply end up sharing one room.
+const DefaultRoomID = "default"
+
 // Signal types for the queue
 type offerSignal struct{ sdp webrtc.SessionDescription }
 type candidateSignal struct{ candidate webrtc.ICECandidateInit }
@@ -13,20 +19,124 @@ type AnswerSignal struct{ SDP webrtc.SessionDescription }
 
 // SFU (Selective Forwarding Unit) holds the global state for all peer connections.
 type SFU struct {
-	peersLock         sync.RWMutex
-	peers             map[string]*PeerConnectionState
-	trackLock         sync.RWMutex
-	trackLocals       map[string]*webrtc.TrackLocalStaticRTP // Store the concrete type
+	// peers is an index of every peer on the server regardless of its room,
+	// signals only carry a peer ID so this is what we use to route them
+	peersLock sync.RWMutex
+	peers     map[string]*PeerConnectionState
+	// httpResources maps the resource IDs of WHIP and WHEP sessions to their peers. Peer IDs
+	// are public, resource IDs are only known to whoever created the session
+	httpResources map[string]*PeerConnectionState
+
+	// roomsLock protects both rooms and peerRooms
+	roomsLock sync.RWMutex
+	rooms     map[string]*Room
+	peerRooms map[string]roomRequest // room requested by each peer in join-room, read when its offer arrives
+
 	config            webrtc.Configuration
 	api               *webrtc.API
 	signalChannelSend chan *transport.SignalMessage
+
+	// pcCreateLock serializes PeerConnection creation so every estimator handed out by
+	// the congestion control interceptor can be matched with its PeerConnection
+	pcCreateLock        sync.Mutex
+	bandwidthEstimation *BandwidthEstimation // nil when bandwidth estimation is off
+
+	recordingsLock sync.RWMutex
+	recordings     map[string]*recording // running recordings by ID
+	recordingDir   string
+	recordingMax   int // recordings running at once
+
+	rtpIngestsLock sync.Mutex
+	rtpIngests     map[string]*rtpIngest // plain RTP ingests by ID
+	// rtpPortMin and rtpPortMax bound the UDP ports given to plain RTP ingests,
+	// 0 lets the OS pick any free port
+	rtpPortMin, rtpPortMax int
+	// rtpIngestMax caps the ingests running at once, rtpIngestsStarting counts those that
+	// passed the check but aren't in rtpIngests yet
+	rtpIngestMax       int
+	rtpIngestsStarting int
+
+	stats *StatsRegistry
+
+	// bans holds the peer IDs banned from a room by room ID, it outlives the rooms
+	// themselves. Protected by roomsLock.
+	bans map[string]map[string]bool
+	// grants holds the access tokens websocket peers authenticated with by peer ID.
+	// Protected by roomsLock, like authRequired.
+	grants       map[string]*peerGrant
+	authRequired bool // peers without a grant may do nothing instead of anything
+
+	hlsLock    sync.RWMutex
+	hlsStreams map[string]*hlsStream // HLS outputs by room ID
+}
+
+// Room holds the peers and tracks of a single meeting, media published in a room
+// is only ever forwarded to the other peers of that same room.
+type Room struct {
+	id string
+
+	// autoSubscribe subscribes every peer to every track of the room. When it is off
+	// peers only receive the tracks they asked for with a subscribe message.
+	autoSubscribe atomic.Bool
+	// lastN is how many of the most recent dominant speakers every subscriber receives the
+	// video of, on top of the peers it pinned. 0 forwards every video.
+	lastN     atomic.Int32
+	lastNLock sync.Mutex // serializes applyLastN
+
+	peersLock  sync.RWMutex
+	peers      map[string]*PeerConnectionState
+	moderators map[string]bool // peer IDs that may mute, unpublish and ban in this room
+
+	trackLock   sync.RWMutex
+	trackLocals map[string]*PublishedTrack // keyed by global track ID
+
+	// ingests counts the plain RTP ingests publishing into the room, they keep it alive
+	// like peers do. Protected by SFU.roomsLock.
+	ingests int
+
+	speakers *speakerDetector
+	done     chan struct{} // closed when the room is removed
+}
+
+// RoomSettings are what a peer can ask of its room in join-room. They are only applied when
+// the peer creates the room and moderates it, so nobody changes a room for everyone else.
+type RoomSettings struct {
+	AutoSubscribe *bool // nil subscribes everyone to everything, like before subscriptions existed
+	LastN         *int  // nil forwards all video
+}
+
+// roomRequest is the room a peer asked for in join-room, with the settings it asked for.
+type roomRequest struct {
+	roomID   string
+	settings RoomSettings
 }
 
 // PeerConnectionState holds the state for a single peer, including its connection and signaling queue.
 type PeerConnectionState struct {
 	id             string
 	peerConnection *webrtc.PeerConnection
-	sfu            *SFU // Reference back to the SFU
+	sfu            *SFU  // Reference back to the SFU
+	room           *Room // Room this peer joined, never changes after creation
+
+	httpSignaled bool // negotiated over WHIP or WHEP, there is no websocket to send anything to
+	publishOnly  bool // never subscribed to anything, e.g. a WHIP encoder
+	// resource and owner of a WHIP or WHEP session, owner is the identity of the access
+	// token that created it, empty with authentication off
+	httpResource, httpOwner string
+	// grants of the peer's access token, nil when authorization isn't required and it may
+	// do anything
+	grants *auth.Grants
+
+	bandwidth *bandwidthAllocator // splits this peer's downlink between the tracks it receives
+	done      chan struct{}       // closed when the peer is cleaned up
+
+	// lastNLock protects the last-N state of this subscriber
+	lastNLock sync.Mutex
+	pinned    map[string]bool // publisher peer IDs whose video is always forwarded
+	liveVideo []string        // publisher peer IDs whose video is forwarded, as last sent to the peer
+
+	dataChannelsLock sync.Mutex
+	dataChannels     map[string]*relayChannel // data channels the peer opened, keyed by label (topic)
 
 	// stateLock protects the fields below, ensuring atomic state updates for this peer.
 	stateLock             sync.Mutex
@@ -0,0 +1,371 @@
+package sfu_server
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// statsInterval is how often every stream is sampled into the registry.
+	statsInterval = time.Second
+	// statsHistoryLength is how many samples the registry keeps per stream.
+	statsHistoryLength = 60
+)
+
+// Stream directions, inbound streams are published tracks and outbound streams are what a
+// subscriber receives of them.
+const (
+	StatsInbound  = "inbound"
+	StatsOutbound = "outbound"
+)
+
+// StreamStats is one sample of a stream. Counters are totals since the stream started,
+// rates cover the interval since the previous sample.
+type StreamStats struct {
+	Timestamp time.Time `json:"timestamp"`
+	Packets   uint64    `json:"packets"`
+	Bytes     uint64    `json:"bytes"` // payload bytes
+	Frames    uint64    `json:"frames,omitempty"`
+	// PacketsLost is what the server missed of an inbound stream, or what the subscriber
+	// reported missing of an outbound one
+	PacketsLost  int64   `json:"packetsLost"`
+	FractionLost float64 `json:"fractionLost"` // 0 to 1
+	Bitrate      uint64  `json:"bitrate"`      // bits per second
+	FrameRate    float64 `json:"frameRate,omitempty"`
+	JitterMs     float64 `json:"jitterMs"`
+	// RTTMs comes from the subscriber's receiver reports, so only outbound streams have it
+	RTTMs float64 `json:"rttMs,omitempty"`
+	// Layer is the simulcast layer an outbound stream is forwarding
+	Layer string `json:"layer,omitempty"`
+}
+
+// StreamHistory is the recent history of a stream, oldest sample first.
+type StreamHistory struct {
+	Direction string `json:"direction"`
+	// PeerID is the publisher of an inbound stream, or the subscriber of an outbound one
+	PeerID  string        `json:"peerId"`
+	TrackID string        `json:"trackId"`
+	Kind    string        `json:"kind"`
+	RoomID  string        `json:"roomId"`
+	Samples []StreamStats `json:"samples"`
+}
+
+type statsKey struct {
+	direction string
+	peerID    string
+	trackID   string
+}
+
+// StatsRegistry keeps a rolling history of every live stream, keyed by peer ID and global
+// track ID. Streams that go away are dropped with their history.
+type StatsRegistry struct {
+	mu      sync.RWMutex
+	streams map[statsKey]*StreamHistory
+}
+
+func newStatsRegistry() *StatsRegistry {
+	return &StatsRegistry{streams: make(map[statsKey]*StreamHistory)}
+}
+
+// record replaces the set of streams with the ones sampled just now.
+func (r *StatsRegistry) record(samples map[statsKey]*StreamHistory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, sampled := range samples {
+		history, ok := r.streams[key]
+		if !ok {
+			r.streams[key] = sampled
+			continue
+		}
+		history.RoomID = sampled.RoomID
+		history.Samples = append(history.Samples, sampled.Samples...)
+		if len(history.Samples) > statsHistoryLength {
+			history.Samples = append([]StreamStats(nil), history.Samples[len(history.Samples)-statsHistoryLength:]...)
+		}
+	}
+	for key := range r.streams {
+		if _, ok := samples[key]; !ok {
+			delete(r.streams, key)
+		}
+	}
+}
+
+// last returns the latest sample of a stream.
+func (r *StatsRegistry) last(key statsKey) (StreamStats, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	history, ok := r.streams[key]
+	if !ok || len(history.Samples) == 0 {
+		return StreamStats{}, false
+	}
+	return history.Samples[len(history.Samples)-1], true
+}
+
+// query returns a copy of every stream match accepts, ordered by direction, peer and track.
+func (r *StatsRegistry) query(match func(statsKey) bool) []StreamHistory {
+	r.mu.RLock()
+	var result []StreamHistory
+	for key, history := range r.streams {
+		if match(key) {
+			copied := *history
+			copied.Samples = append([]StreamStats(nil), history.Samples...)
+			result = append(result, copied)
+		}
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Direction != b.Direction {
+			return a.Direction < b.Direction
+		}
+		if a.PeerID != b.PeerID {
+			return a.PeerID < b.PeerID
+		}
+		return a.TrackID < b.TrackID
+	})
+	return result
+}
+
+// Stats returns the history of every stream on the server.
+func (s *SFU) Stats() []StreamHistory {
+	return s.stats.query(func(statsKey) bool { return true })
+}
+
+// PeerStats returns the history of what a peer publishes and receives.
+func (s *SFU) PeerStats(peerID string) []StreamHistory {
+	return s.stats.query(func(key statsKey) bool { return key.peerID == peerID })
+}
+
+// TrackStats returns the history of a published track and of every subscriber's copy of it.
+func (s *SFU) TrackStats(globalTrackID string) []StreamHistory {
+	return s.stats.query(func(key statsKey) bool { return key.trackID == globalTrackID })
+}
+
+// sampleStats samples every stream once per statsInterval, for as long as the server runs.
+func (s *SFU) sampleStats() {
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.stats.record(s.collectStats(now))
+	}
+}
+
+func (s *SFU) collectStats(now time.Time) map[statsKey]*StreamHistory {
+	rooms := s.roomList()
+	samples := make(map[statsKey]*StreamHistory)
+	add := func(room *Room, key statsKey, kind webrtc.RTPCodecType, sample StreamStats) {
+		sample.Timestamp = now
+		if previous, ok := s.stats.last(key); ok {
+			sample.addRates(previous)
+			if key.direction == StatsInbound {
+				sample.addLossRate(previous)
+			}
+		}
+		samples[key] = &StreamHistory{
+			Direction: key.direction,
+			PeerID:    key.peerID,
+			TrackID:   key.trackID,
+			Kind:      kind.String(),
+			RoomID:    room.id,
+			Samples:   []StreamStats{sample},
+		}
+	}
+
+	for _, room := range rooms {
+		room.trackLock.RLock()
+		for _, track := range room.trackLocals {
+			add(room, statsKey{StatsInbound, track.publisherID, track.id}, track.kind, track.receiveStats())
+
+			track.downTracksLock.RLock()
+			for subscriberID, downTrack := range track.downTracks {
+				add(room, statsKey{StatsOutbound, subscriberID, downTrack.id}, track.kind, downTrack.sendStats())
+			}
+			track.downTracksLock.RUnlock()
+		}
+		room.trackLock.RUnlock()
+	}
+	return samples
+}
+
+// addRates fills in the rates of a sample from the previous one of the same stream.
+func (st *StreamStats) addRates(previous StreamStats) {
+	elapsed := st.Timestamp.Sub(previous.Timestamp).Seconds()
+	if elapsed <= 0 || st.Bytes < previous.Bytes || st.Packets < previous.Packets {
+		return
+	}
+	st.Bitrate = uint64(float64(st.Bytes-previous.Bytes) * 8 / elapsed)
+	if st.Frames >= previous.Frames {
+		st.FrameRate = float64(st.Frames-previous.Frames) / elapsed
+	}
+}
+
+// addLossRate fills in FractionLost of an inbound sample from the previous one, outbound
+// streams get theirs from the subscriber's receiver reports.
+func (st *StreamStats) addLossRate(previous StreamStats) {
+	lost := st.PacketsLost - previous.PacketsLost
+	received := int64(st.Packets) - int64(previous.Packets)
+	if lost > 0 && received >= 0 {
+		st.FractionLost = float64(lost) / float64(lost+received)
+	}
+}
+
+// receiveCounters follows the packets of one inbound layer the way an RTP receiver does
+// (RFC 3550 appendix A.3 and A.8) to count losses and estimate jitter.
+type receiveCounters struct {
+	mu         sync.Mutex
+	packets    uint64
+	bytes      uint64
+	frames     uint64
+	started    bool
+	baseSeq    uint32
+	highestSeq uint32 // extended with the number of wrap arounds
+	jitter     float64
+	transit    int64
+}
+
+func (c *receiveCounters) observe(pkt *rtp.Packet, arrival time.Time, clockRate uint32, video bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.packets++
+	c.bytes += uint64(len(pkt.Payload))
+	if video && pkt.Marker {
+		c.frames++
+	}
+
+	if !c.started {
+		c.started = true
+		c.baseSeq = uint32(pkt.SequenceNumber)
+		c.highestSeq = c.baseSeq
+	} else if delta := pkt.SequenceNumber - uint16(c.highestSeq); delta != 0 && delta < 1<<15 {
+		c.highestSeq += uint32(delta)
+	}
+
+	if clockRate == 0 {
+		return
+	}
+	arrivalTicks := arrival.UnixNano() * int64(clockRate) / int64(time.Second)
+	transit := arrivalTicks - int64(pkt.Timestamp)
+	if c.transit != 0 {
+		d := transit - c.transit
+		if d < 0 {
+			d = -d
+		}
+		c.jitter += (float64(d) - c.jitter) / 16
+	}
+	c.transit = transit
+}
+
+// sample returns the counters, jitter in milliseconds.
+func (c *receiveCounters) sample(clockRate uint32) (packets, bytes, frames uint64, expected uint64, jitterMs float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.started {
+		expected = uint64(c.highestSeq-c.baseSeq) + 1
+	}
+	if clockRate > 0 {
+		jitterMs = c.jitter * 1000 / float64(clockRate)
+	}
+	return c.packets, c.bytes, c.frames, expected, jitterMs
+}
+
+// receiveStats sums the counters of every layer of a published track.
+func (t *PublishedTrack) receiveStats() StreamStats {
+	t.layersLock.RLock()
+	defer t.layersLock.RUnlock()
+
+	var st StreamStats
+	var expected uint64
+	for _, layer := range t.layers {
+		packets, bytes, frames, layerExpected, jitterMs := layer.stats.sample(t.codec.ClockRate)
+		st.Packets += packets
+		st.Bytes += bytes
+		// simulcast layers carry the same frames, the best layer has the real frame rate
+		st.Frames = max(st.Frames, frames)
+		st.JitterMs = max(st.JitterMs, jitterMs)
+		expected += layerExpected
+	}
+	// retransmissions and duplicates can make up for more than what was lost
+	if expected > st.Packets {
+		st.PacketsLost = int64(expected - st.Packets)
+	}
+	return st
+}
+
+// sendCounters counts what a DownTrack sends and keeps what its subscriber reports back.
+type sendCounters struct {
+	mu           sync.Mutex
+	packets      uint64
+	bytes        uint64
+	frames       uint64
+	packetsLost  int64
+	fractionLost float64
+	jitter       uint32 // in RTP ticks
+	rtt          time.Duration
+}
+
+func (c *sendCounters) sent(pkt *rtp.Packet, frame bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.packets++
+	c.bytes += uint64(len(pkt.Payload))
+	if frame {
+		c.frames++
+	}
+}
+
+// receiverReport takes the subscriber's view of the stream, and the round trip time when
+// the report refers to one of our sender reports.
+func (c *sendCounters) receiverReport(report rtcp.ReceptionReport, arrival time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.packetsLost = int64(report.TotalLost)
+	c.fractionLost = float64(report.FractionLost) / 256
+	c.jitter = report.Jitter
+	if report.LastSenderReport != 0 {
+		// all three are in the middle 32 bits of an NTP timestamp, 1/65536 of a second
+		rtt := compactNTP(arrival) - report.LastSenderReport - report.Delay
+		if rtt < 1<<31 {
+			c.rtt = time.Duration(uint64(rtt) * uint64(time.Second) >> 16)
+		}
+	}
+}
+
+// compactNTP returns the middle 32 bits of the NTP timestamp of t.
+func compactNTP(t time.Time) uint32 {
+	const ntpEpochOffset = 2208988800 // seconds between 1900 and 1970
+	seconds := uint64(t.Unix()+ntpEpochOffset) << 16
+	fraction := uint64(t.Nanosecond()) << 16 / uint64(time.Second)
+	return uint32(seconds | fraction)
+}
+
+// sendStats samples what the down track sent and what the subscriber reported about it.
+func (d *DownTrack) sendStats() StreamStats {
+	d.mu.Lock()
+	layer := d.currentLayer
+	clockRate := d.track.codec.ClockRate
+	d.mu.Unlock()
+
+	c := &d.stats
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := StreamStats{
+		Packets:      c.packets,
+		Bytes:        c.bytes,
+		Frames:       c.frames,
+		PacketsLost:  c.packetsLost,
+		FractionLost: c.fractionLost,
+		RTTMs:        float64(c.rtt) / float64(time.Millisecond),
+		Layer:        layer,
+	}
+	if clockRate > 0 {
+		st.JitterMs = float64(c.jitter) * 1000 / float64(clockRate)
+	}
+	return st
+}
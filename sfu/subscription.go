@@ -0,0 +1,163 @@
+package sfu_server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/samyak112/monoport/transport"
+)
+
+// TrackInfo describes a published track to clients that pick their own subscriptions.
+type TrackInfo struct {
+	TrackID     string   `json:"trackId"`     // global track ID, used in subscribe and set-layer
+	PublisherID string   `json:"publisherId"` // peer that publishes the track
+	Kind        string   `json:"kind"`        // "audio" or "video"
+	StreamID    string   `json:"streamId"`    // media stream of the publisher, groups its audio and video
+	Layers      []string `json:"layers"`      // simulcast RIDs, a single empty RID without simulcast
+	Subscribed  bool     `json:"subscribed"`  // whether the peer that asked receives this track
+}
+
+// info describes the track as seen by subscriberID.
+func (t *PublishedTrack) info(subscriberID string) TrackInfo {
+	return TrackInfo{
+		TrackID:     t.id,
+		PublisherID: t.publisherID,
+		Kind:        t.kind.String(),
+		StreamID:    t.streamID,
+		Layers:      t.Layers(),
+		Subscribed:  subscriberID != "" && t.downTrackFor(subscriberID) != nil,
+	}
+}
+
+// Subscribe starts forwarding a track of the peer's room to the peer.
+func (s *SFU) Subscribe(peerID, globalTrackID string) error {
+	pcs, track, err := s.peerAndTrack(peerID, globalTrackID)
+	if err != nil {
+		return err
+	}
+	if pcs.httpSignaled {
+		return fmt.Errorf("peer %s can't renegotiate, its tracks are fixed", peerID)
+	}
+	if err := pcs.room.subscribe(pcs, track); err != nil {
+		return err
+	}
+	log.Printf("[%s] Subscribed to track %s", peerID, globalTrackID)
+	return nil
+}
+
+// Unsubscribe stops forwarding a track to the peer.
+func (s *SFU) Unsubscribe(peerID, globalTrackID string) error {
+	pcs, track, err := s.peerAndTrack(peerID, globalTrackID)
+	if err != nil {
+		return err
+	}
+	if err := pcs.room.unsubscribe(pcs, track); err != nil {
+		return err
+	}
+	log.Printf("[%s] Unsubscribed from track %s", peerID, globalTrackID)
+	return nil
+}
+
+// ListTracks returns every track published in the peer's room by other peers, ordered by ID.
+func (s *SFU) ListTracks(peerID string) ([]TrackInfo, error) {
+	s.peersLock.RLock()
+	pcs, ok := s.peers[peerID]
+	s.peersLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown peer %s", peerID)
+	}
+
+	pcs.room.trackLock.RLock()
+	tracks := make([]TrackInfo, 0, len(pcs.room.trackLocals))
+	for _, track := range pcs.room.trackLocals {
+		if track.publisherID == peerID {
+			continue
+		}
+		tracks = append(tracks, track.info(peerID))
+	}
+	pcs.room.trackLock.RUnlock()
+
+	sort.Slice(tracks, func(i, j int) bool { return tracks[i].TrackID < tracks[j].TrackID })
+	return tracks, nil
+}
+
+// SetAutoSubscribe sets whether peers of a room are subscribed to every track automatically.
+// Changing it only affects peers and tracks arriving afterwards, existing subscriptions stay.
+func (s *SFU) SetAutoSubscribe(roomID string, enabled bool) error {
+	if roomID == "" {
+		roomID = DefaultRoomID
+	}
+
+	s.roomsLock.RLock()
+	room, ok := s.rooms[roomID]
+	s.roomsLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown room %s", roomID)
+	}
+
+	room.autoSubscribe.Store(enabled)
+	log.Printf("Auto subscribe of room %s set to %t", roomID, enabled)
+	return nil
+}
+
+// peerAndTrack looks up a peer and a track of its room.
+func (s *SFU) peerAndTrack(peerID, globalTrackID string) (*PeerConnectionState, *PublishedTrack, error) {
+	s.peersLock.RLock()
+	pcs, ok := s.peers[peerID]
+	s.peersLock.RUnlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown peer %s", peerID)
+	}
+
+	track := pcs.room.publishedTrack(globalTrackID)
+	if track == nil {
+		return nil, nil, fmt.Errorf("unknown track %s in room %s", globalTrackID, pcs.room.id)
+	}
+	return pcs, track, nil
+}
+
+// notifyPeers sends an event to every peer of the room except one, usually the peer that caused it.
+func (r *Room) notifyPeers(exceptPeerID string, eventType string, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to marshal %s event for room %s: %v", eventType, r.id, err)
+		return
+	}
+
+	// the channel can block, so it is fed from a snapshot rather than under peersLock
+	r.peersLock.RLock()
+	peers := make([]*PeerConnectionState, 0, len(r.peers))
+	for peerID, pcs := range r.peers {
+		if peerID != exceptPeerID && !pcs.httpSignaled {
+			peers = append(peers, pcs)
+		}
+	}
+	r.peersLock.RUnlock()
+
+	for _, pcs := range peers {
+		pcs.sfu.signalChannelSend <- &transport.SignalMessage{
+			PeerID: pcs.id,
+			Type:   eventType,
+			Data:   data,
+		}
+	}
+}
+
+// sendEvent sends an event to a single peer, peers signaled over HTTP are skipped.
+func (pcs *PeerConnectionState) sendEvent(eventType string, payload interface{}) {
+	if pcs.httpSignaled {
+		return
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("[%s] Failed to marshal %s event: %v", pcs.id, eventType, err)
+		return
+	}
+	pcs.sfu.signalChannelSend <- &transport.SignalMessage{
+		PeerID: pcs.id,
+		Type:   eventType,
+		Data:   data,
+	}
+}
@@ -0,0 +1,75 @@
+package sfu_server
+
+import (
+	"errors"
+	"log"
+	"sort"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// ErrNoTracks is returned to a WHEP viewer of a room where nothing is published.
+var ErrNoTracks = errors.New("nothing is published in the room")
+
+// SubscribeWHEP creates a playback-only peer in roomID from a WHEP offer. It returns the ID
+// of the WHEP resource and the SDP answer, owner works like in PublishWHIP. The viewer receives
+// the room's current tracks, as many of each kind as its offer has transceivers for, most
+// relevant publishers first. WHEP has no way to renegotiate so the set is fixed: tracks
+// published later aren't added and unpublished ones fall silent.
+func (s *SFU) SubscribeWHEP(roomID, owner, offerSDP string) (string, string, error) {
+	peerID, err := newPublisherID("whep")
+	if err != nil {
+		return "", "", err
+	}
+
+	pcs, err := s.addHTTPPeer(peerID, roomID, "whep", owner, false)
+	if err != nil {
+		return "", "", err
+	}
+
+	answer, err := answerHTTPOffer(pcs, offerSDP, func() error {
+		return pcs.room.subscribeWHEP(pcs)
+	})
+	if err != nil {
+		s.cleanupPeer(peerID)
+		return "", "", err
+	}
+	log.Printf("[%s] WHEP session started in room %s", peerID, pcs.room.id)
+	return pcs.httpResource, answer, nil
+}
+
+// subscribeWHEP subscribes a WHEP viewer to the tracks that fit in the transceivers its
+// offer created, AddTrack reuses those instead of adding new ones.
+func (r *Room) subscribeWHEP(pcs *PeerConnectionState) error {
+	slots := make(map[webrtc.RTPCodecType]int)
+	for _, transceiver := range pcs.peerConnection.GetTransceivers() {
+		if transceiver.Sender() == nil {
+			slots[transceiver.Kind()]++
+		}
+	}
+
+	subscribed := 0
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		tracks := r.tracksByPublisher(kind)
+		for _, publisherID := range r.rankPublishers(tracks) {
+			published := tracks[publisherID]
+			sort.Slice(published, func(i, j int) bool { return published[i].id < published[j].id })
+			for _, track := range published {
+				if slots[kind] == 0 {
+					break
+				}
+				if err := r.subscribe(pcs, track); err != nil {
+					log.Printf("[%s] Failed to add track %s: %v", pcs.id, track.id, err)
+					continue
+				}
+				slots[kind]--
+				subscribed++
+			}
+		}
+	}
+
+	if subscribed == 0 {
+		return ErrNoTracks
+	}
+	return nil
+}
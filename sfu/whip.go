@@ -0,0 +1,160 @@
+package sfu_server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// ErrUnknownPeer is returned for a peer ID that isn't connected, or wasn't created over HTTP.
+var ErrUnknownPeer = errors.New("unknown peer")
+
+// HTTPResource names a WHIP or WHEP session in a request on its resource URL, along with
+// the access token the request came with. A session only answers to the token identity
+// that created it, and only to tokens for its room.
+type HTTPResource struct {
+	Kind  string // "whip" or "whep", the kind of resource URL the request was sent to
+	ID    string // resource ID, the last element of the URL
+	Owner string // identity of the access token, empty with authentication off
+	Room  string // room of the access token, empty when it is good for any room
+}
+
+// PublishWHIP creates a publish-only peer in roomID from a WHIP offer. It returns the ID of
+// the WHIP resource and the SDP answer. The answer carries every candidate, the encoder has
+// no way to receive trickled ones. owner is the identity of the access token, only the same
+// identity can change or end the session.
+func (s *SFU) PublishWHIP(roomID, owner, offerSDP string) (string, string, error) {
+	peerID, err := newPublisherID("whip")
+	if err != nil {
+		return "", "", err
+	}
+
+	pcs, err := s.addHTTPPeer(peerID, roomID, "whip", owner, true)
+	if err != nil {
+		return "", "", err
+	}
+
+	answer, err := answerHTTPOffer(pcs, offerSDP, nil)
+	if err != nil {
+		s.cleanupPeer(peerID)
+		return "", "", err
+	}
+	log.Printf("[%s] WHIP session started in room %s", peerID, pcs.room.id)
+	return pcs.httpResource, answer, nil
+}
+
+// AddHTTPCandidates adds candidates trickled in a PATCH to a WHIP or WHEP resource.
+func (s *SFU) AddHTTPCandidates(resource HTTPResource, candidates []webrtc.ICECandidateInit) error {
+	pcs, ok := s.httpPeer(resource)
+	if !ok {
+		return ErrUnknownPeer
+	}
+	for _, candidate := range candidates {
+		if err := pcs.peerConnection.AddICECandidate(candidate); err != nil {
+			return fmt.Errorf("adding candidate %q: %w", candidate.Candidate, err)
+		}
+	}
+	return nil
+}
+
+// RemoveHTTPPeer tears down a WHIP or WHEP session, as a DELETE on its resource does.
+func (s *SFU) RemoveHTTPPeer(resource HTTPResource) error {
+	pcs, ok := s.httpPeer(resource)
+	if !ok {
+		return ErrUnknownPeer
+	}
+	s.cleanupPeer(pcs.id)
+	return nil
+}
+
+// httpPeer looks up the peer of a WHIP or WHEP resource. Resources of the other kind, of
+// another owner or in a room the token isn't for are reported as unknown, like IDs that
+// never existed.
+func (s *SFU) httpPeer(resource HTTPResource) (*PeerConnectionState, bool) {
+	if !strings.HasPrefix(resource.ID, resource.Kind+"-") {
+		return nil, false
+	}
+	s.peersLock.RLock()
+	defer s.peersLock.RUnlock()
+	pcs, ok := s.httpResources[resource.ID]
+	if !ok || pcs.httpOwner != resource.Owner || (resource.Room != "" && pcs.room.id != resource.Room) {
+		return nil, false
+	}
+	return pcs, true
+}
+
+// addHTTPPeer creates a peer in roomID that is signaled over HTTP instead of a websocket,
+// along with the ID of its kind of resource.
+func (s *SFU) addHTTPPeer(peerID, roomID, kind, owner string, publishOnly bool) (*PeerConnectionState, error) {
+	resourceID, err := newPublisherID(kind)
+	if err != nil {
+		return nil, err
+	}
+	peerConnection, estimator, err := s.newPeerConnection()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.JoinRoom(peerID, roomID, RoomSettings{}); err != nil {
+		peerConnection.Close()
+		return nil, err
+	}
+
+	pcs := s.newPeerConnectionState(peerID, peerConnection, estimator)
+	pcs.httpSignaled = true
+	pcs.publishOnly = publishOnly
+	pcs.grants = s.httpGrants(publishOnly)
+	pcs.httpResource = resourceID
+	pcs.httpOwner = owner
+
+	s.peersLock.Lock()
+	s.addPeerLocked(pcs)
+	s.httpResources[resourceID] = pcs
+	s.peersLock.Unlock()
+	return pcs, nil
+}
+
+// answerHTTPOffer answers an offer once ICE gathering is complete, so the answer is all the
+// peer ever hears from us. beforeAnswer, when set, runs once the offer is applied and can
+// add tracks to the transceivers it created.
+func answerHTTPOffer(pcs *PeerConnectionState, offerSDP string, beforeAnswer func() error) (string, error) {
+	peerConnection := pcs.peerConnection
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offerSDP}
+	if err := peerConnection.SetRemoteDescription(offer); err != nil {
+		negotiationFailures.With(stepSetRemoteDescription).Inc()
+		return "", fmt.Errorf("setting offer: %w", err)
+	}
+	if beforeAnswer != nil {
+		if err := beforeAnswer(); err != nil {
+			return "", err
+		}
+	}
+
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		negotiationFailures.With(stepCreateAnswer).Inc()
+		return "", fmt.Errorf("creating answer: %w", err)
+	}
+	gatheringComplete := webrtc.GatheringCompletePromise(peerConnection)
+	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		negotiationFailures.With(stepSetLocalDescription).Inc()
+		return "", fmt.Errorf("setting answer: %w", err)
+	}
+	<-gatheringComplete
+
+	return peerConnection.LocalDescription().SDP, nil
+}
+
+// newPublisherID makes up an ID for a peer or ingest that didn't pick its own, hard to
+// guess since it is all a client needs to tear the session down.
+func newPublisherID(prefix string) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return prefix + "-" + hex.EncodeToString(id), nil
+}
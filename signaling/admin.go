@@ -0,0 +1,108 @@
+package ws
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/samyak112/monoport/sfu"
+)
+
+// RequireBearerToken only lets requests with "Authorization: Bearer <token>" through.
+func RequireBearerToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="monoport admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// HandleAdminRooms lists every room with its peers and tracks.
+func HandleAdminRooms(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.SFU) {
+	writeJSON(w, sfuInstance.Rooms())
+}
+
+// HandleAdminRoom describes a room on GET and closes it on DELETE.
+func HandleAdminRoom(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.SFU) {
+	roomID := r.PathValue("room")
+	if r.Method == http.MethodDelete {
+		writeAdminResult(w, sfuInstance.CloseRoom(roomID))
+		return
+	}
+	room, err := sfuInstance.Room(roomID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, room)
+}
+
+// HandleAdminPeers lists every peer with the state of its PeerConnection.
+func HandleAdminPeers(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.SFU) {
+	writeJSON(w, sfuInstance.Peers())
+}
+
+// HandleAdminPeer describes a peer on GET and kicks it on DELETE.
+func HandleAdminPeer(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.SFU) {
+	peerID := r.PathValue("peer")
+	if r.Method == http.MethodDelete {
+		writeAdminResult(w, sfuInstance.KickPeer(peerID))
+		return
+	}
+	peer, err := sfuInstance.Peer(peerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, peer)
+}
+
+// HandleAdminTracks lists the tracks of every room.
+func HandleAdminTracks(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.SFU) {
+	writeJSON(w, sfuInstance.Tracks())
+}
+
+// HandleAdminTrack unpublishes a track on DELETE.
+func HandleAdminTrack(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.SFU) {
+	writeAdminResult(w, sfuInstance.RemoveTrack(r.PathValue("track")))
+}
+
+// HandleAdminMuteTrack mutes or unmutes a track, depending on the last path segment.
+func HandleAdminMuteTrack(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.SFU) {
+	muted := strings.HasSuffix(r.URL.Path, "/mute")
+	writeAdminResult(w, sfuInstance.MuteTrack("", r.PathValue("track"), muted))
+}
+
+// HandleAdminBan bans a peer from a room on PUT and lifts the ban on DELETE.
+func HandleAdminBan(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.SFU) {
+	roomID, peerID := r.PathValue("room"), r.PathValue("peer")
+	if r.Method == http.MethodDelete {
+		writeAdminResult(w, sfuInstance.UnbanPeer(roomID, peerID))
+		return
+	}
+	writeAdminResult(w, sfuInstance.BanPeer("", roomID, peerID))
+}
+
+// HandleAdminModerator makes a peer moderator of its room on PUT and revokes it on DELETE.
+func HandleAdminModerator(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.SFU) {
+	writeAdminResult(w, sfuInstance.SetModerator(r.PathValue("peer"), r.Method == http.MethodPut))
+}
+
+// writeAdminResult answers an admin action, everything it can fail on is an unknown ID.
+func writeAdminResult(w http.ResponseWriter, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,105 @@
+package ws
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/samyak112/monoport/auth"
+	"github.com/samyak112/monoport/sfu"
+)
+
+// checkOrigin accepts websockets opened by pages of the server's own origin or of an
+// allowed one. Clients outside of a browser send no Origin and are accepted, they have to
+// authenticate like everyone else.
+func (s *Signal) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range s.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// authenticate verifies the access token a websocket presented, in the token query
+// parameter or in its first message, or the bearer token of a WHIP or WHEP request.
+func (s *Signal) authenticate(token string) (*auth.Claims, error) {
+	if token == "" {
+		return nil, fmt.Errorf("%w: no access token", auth.ErrInvalidToken)
+	}
+	return s.Verifier.Verify(token)
+}
+
+// authorizeHTTP checks the bearer token of a WHIP or WHEP offer (RFC 9725) and answers
+// the request itself when it fails. A token for one room can only be used with that room,
+// which is also the room used when the URL names none. allowed checks the grants. It returns
+// the room the request is for and the identity of the token, empty with authentication off.
+func (s *Signal) authorizeHTTP(w http.ResponseWriter, r *http.Request, allowed func(auth.Grants) bool) (string, string, bool) {
+	roomID := r.PathValue("room")
+	if s.Verifier == nil {
+		return roomID, "", true
+	}
+
+	claims, ok := s.bearerClaims(w, r)
+	if !ok {
+		return "", "", false
+	}
+	if roomID == "" {
+		roomID = claims.Room
+	}
+	if claims.Room != "" && roomID != claims.Room {
+		http.Error(w, fmt.Sprintf("the access token is for room %q", claims.Room), http.StatusForbidden)
+		return "", "", false
+	}
+	if !allowed(claims.Grants) {
+		http.Error(w, "not allowed by the access token", http.StatusForbidden)
+		return "", "", false
+	}
+	return roomID, claims.Identity, true
+}
+
+// authorizeResource names the WHIP or WHEP resource of a PATCH or DELETE, with the identity
+// and room of its bearer token. The SFU only finds resources created by the same identity.
+func (s *Signal) authorizeResource(w http.ResponseWriter, r *http.Request, kind string) (sfu_server.HTTPResource, bool) {
+	resource := sfu_server.HTTPResource{Kind: kind, ID: r.PathValue("id")}
+	if s.Verifier == nil {
+		return resource, true
+	}
+	claims, ok := s.bearerClaims(w, r)
+	if !ok {
+		return resource, false
+	}
+	resource.Owner, resource.Room = claims.Identity, claims.Room
+	return resource, true
+}
+
+// bearerClaims verifies the bearer token of a request, answering 401 when it is missing or
+// invalid.
+func (s *Signal) bearerClaims(w http.ResponseWriter, r *http.Request) (*auth.Claims, bool) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	claims, err := s.authenticate(token)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="monoport"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+	return claims, true
+}
+
+// closePolicyViolation closes a websocket that broke the rules, with reason as close text.
+// WriteControl may be called alongside the goroutine that writes the peer's messages.
+func closePolicyViolation(conn *websocket.Conn, reason error) {
+	text := reason.Error()
+	if len(text) > 123 { // the limit of a close frame's payload, minus the code
+		text = text[:123]
+	}
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, text), time.Now().Add(time.Second))
+}
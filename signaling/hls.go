@@ -0,0 +1,51 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/samyak112/monoport/sfu"
+)
+
+// HandleStartHLS starts the HLS stream of the room named in the URL. The JSON body is
+// optional, without one the most relevant H.264 and Opus tracks are streamed. It is served
+// behind the admin bearer token, like HandleStopHLS.
+func HandleStartHLS(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.SFU) {
+	var options sfu_server.HLSOptions
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSDPSize)).Decode(&options)
+	if err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	roomID := r.PathValue("room")
+	if err := sfuInstance.StartHLS(roomID, options); err != nil {
+		log.Println("HLS stream rejected:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Location", "/hls/"+roomID+"/index.m3u8")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HandleStopHLS ends the HLS stream of the room named in the URL.
+func HandleStopHLS(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.SFU) {
+	if err := sfuInstance.StopHLS(r.PathValue("room")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleHLS serves the playlist and segments of a room's HLS stream to viewers.
+func HandleHLS(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.SFU) {
+	handler, ok := sfuInstance.HLSHandler(r.PathValue("room"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,20 @@
+package ws
+
+import (
+	"net/http"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/samyak112/monoport/sfu"
+)
+
+// HandleICEServers serves the STUN and TURN servers clients should put in their
+// RTCConfiguration, in the same shape as its iceServers member.
+func HandleICEServers(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.SFU) {
+	servers := sfuInstance.ICEServers()
+	if servers == nil {
+		servers = []webrtc.ICEServer{}
+	}
+	// the frontend is usually served from another origin
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	writeJSON(w, servers)
+}
@@ -3,6 +3,7 @@ package ws
 import (
 	"encoding/json"
 	"github.com/gorilla/websocket"
+	"github.com/samyak112/monoport/transport"
 	"log"
 )
 
@@ -41,11 +42,23 @@ func (s *Signal) SendCandidate(ufrag string, data []byte) {
 	log.Println("going to send the custom cand", ufrag)
 	// log.Println("this is the value", *s.UfragMap[ufrag])
 
-	if err2 := s.UfragMap[ufrag].WriteMessage(1, data); err2 != nil {
-		log.Println("Write error in sending SDP:", err2)
-	} else {
-		log.Println("sent stun candidate via signaling")
+	s.SignalLock.Lock()
+	conn := s.UfragMap[ufrag]
+	s.SignalLock.Unlock()
+	s.send(conn, data)
+}
+
+// sendToPeer queues a message for a peer's websocket. Server events can be produced for
+// peers whose websocket is already gone, those are dropped.
+func (s *Signal) sendToPeer(peerID string, data []byte) {
+	s.SignalLock.Lock()
+	conn := s.PeerMap[peerID]
+	s.SignalLock.Unlock()
+	if conn == nil {
+		log.Printf("No websocket for peer %s, dropping message", peerID)
+		return
 	}
+	s.send(conn, data)
 }
 
 // processOutgoingSignals simulates sending messages from the SFU to clients via a signaling server.
@@ -65,10 +78,7 @@ func (s *Signal) ProcessOutgoingSignals() {
 				break
 			}
 
-			if err := s.PeerMap[msg.PeerID].WriteMessage(1, data); err != nil {
-				log.Println("Write error in sending SDP:", err)
-				break
-			}
+			s.sendToPeer(msg.PeerID, data)
 		}
 		if msg.Candidate != "" {
 			// The candidate string is already a JSON of ICECandidateInit
@@ -82,10 +92,19 @@ func (s *Signal) ProcessOutgoingSignals() {
 				log.Println("JSON marshal error:", err)
 				break
 			}
-			if err := s.PeerMap[msg.PeerID].WriteMessage(1, data); err != nil {
-				log.Println("Write error in Candidate:", err)
-				break
+			s.sendToPeer(msg.PeerID, data)
+		}
+		if msg.Data != nil {
+			payload := map[string]interface{}{
+				"type": msg.Type,
+				"data": msg.Data,
 			}
+			data, err := json.Marshal(payload)
+			if err != nil {
+				log.Println("JSON marshal error:", err)
+				continue
+			}
+			s.sendToPeer(msg.PeerID, data)
 		}
 		if msg.Ufrag != "" {
 			log.Println("adding the peer from ufrag")
@@ -93,3 +112,20 @@ func (s *Signal) ProcessOutgoingSignals() {
 		}
 	}
 }
+
+// rejectModeration tells a peer why its moderation or recording request was refused.
+func (s *Signal) rejectModeration(msg transport.SignalMessage, reason error) {
+	data, err := json.Marshal(map[string]string{
+		"action":       msg.Type,
+		"trackId":      msg.TrackID,
+		"targetPeerId": msg.TargetPeerID,
+		"roomId":       msg.RoomID,
+		"recordingId":  msg.RecordingID,
+		"error":        reason.Error(),
+	})
+	if err != nil {
+		log.Println("JSON marshal error:", err)
+		return
+	}
+	s.SignalChannelRecv <- &transport.SignalMessage{PeerID: msg.PeerID, Type: "moderation-rejected", Data: data}
+}
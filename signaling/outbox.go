@@ -0,0 +1,114 @@
+package ws
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// outboxSize is how many messages a websocket may have waiting, further ones are dropped
+	outboxSize = 64
+	// writeTimeout bounds a single websocket write, a client that can't take a message in
+	// that time is disconnected
+	writeTimeout = 10 * time.Second
+)
+
+// outbox writes the messages of one websocket from its own goroutine, so a slow client only
+// holds up its own messages and never the SFU or the other peers.
+type outbox struct {
+	conn      *websocket.Conn
+	messages  chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newOutbox(conn *websocket.Conn) *outbox {
+	o := &outbox{conn: conn, messages: make(chan []byte, outboxSize), done: make(chan struct{})}
+	go o.run()
+	return o
+}
+
+func (o *outbox) run() {
+	for {
+		select {
+		case data := <-o.messages:
+			_ = o.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := o.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				// the read loop of the websocket fails too and cleans up
+				log.Println("Write error, closing websocket:", err)
+				o.conn.Close()
+				return
+			}
+		case <-o.done:
+			return
+		}
+	}
+}
+
+// send queues a message without waiting, it reports false when the message was dropped.
+func (o *outbox) send(data []byte) bool {
+	select {
+	case <-o.done:
+		return false
+	default:
+	}
+	select {
+	case o.messages <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+func (o *outbox) close() {
+	o.closeOnce.Do(func() { close(o.done) })
+}
+
+// openOutbox starts the writer of a websocket, every message to it has to go through send.
+func (s *Signal) openOutbox(conn *websocket.Conn) {
+	s.SignalLock.Lock()
+	defer s.SignalLock.Unlock()
+	if s.outboxes == nil {
+		s.outboxes = make(map[*websocket.Conn]*outbox)
+	}
+	s.outboxes[conn] = newOutbox(conn)
+}
+
+// closeOutbox stops the writer of a websocket that went away and forgets the peers and
+// ufrags that pointed to it.
+func (s *Signal) closeOutbox(conn *websocket.Conn) {
+	s.SignalLock.Lock()
+	defer s.SignalLock.Unlock()
+	if o, ok := s.outboxes[conn]; ok {
+		o.close()
+		delete(s.outboxes, conn)
+	}
+	for peerID, peerConn := range s.PeerMap {
+		if peerConn == conn {
+			delete(s.PeerMap, peerID)
+		}
+	}
+	for ufrag, ufragConn := range s.UfragMap {
+		if ufragConn == conn {
+			delete(s.UfragMap, ufrag)
+		}
+	}
+}
+
+// send queues a message for a websocket. Messages for websockets that are gone, or that
+// fell too far behind, are dropped.
+func (s *Signal) send(conn *websocket.Conn, data []byte) {
+	s.SignalLock.Lock()
+	o := s.outboxes[conn]
+	s.SignalLock.Unlock()
+	if o == nil {
+		log.Println("Websocket is gone, dropping message")
+		return
+	}
+	if !o.send(data) {
+		log.Println("Websocket is falling behind, dropping message")
+	}
+}
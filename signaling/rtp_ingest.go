@@ -0,0 +1,50 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/samyak112/monoport/sfu"
+)
+
+// rtpIngestRequest is the body of a POST to /rtp-ingest.
+type rtpIngestRequest struct {
+	MimeType string `json:"mimeType"` // e.g. "video/VP8" or "audio/opus"
+}
+
+// HandleStartRTPIngest allocates a UDP port for a plain RTP source publishing into the room
+// named in the URL, or into the default room, and answers with where and how to send. It
+// is served behind the admin bearer token.
+func HandleStartRTPIngest(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.SFU) {
+	var req rtpIngestRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSDPSize)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ingest, err := sfuInstance.StartRTPIngest(r.PathValue("room"), req.MimeType)
+	if errors.Is(err, sfu_server.ErrTooManyRTPIngests) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Println("RTP ingest rejected:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(ingest)
+}
+
+// HandleStopRTPIngest closes an ingest's port and unpublishes its track.
+func HandleStopRTPIngest(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.SFU) {
+	if err := sfuInstance.StopRTPIngest(r.PathValue("id")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -2,23 +2,49 @@ package ws
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v3"
+	"github.com/samyak112/monoport/auth"
 	"github.com/samyak112/monoport/sfu"
 	"github.com/samyak112/monoport/transport"
 	"log"
 	"net/http"
 )
 
-// Handles incoming WebSocket signaling
+// Handles incoming WebSocket signaling. With a Verifier every websocket has to present an
+// access token, in the token query parameter or in its first message, and can then only
+// speak for the peer ID the token was issued to.
 func HandleSDP(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.SFU, signalingInstance *Signal) {
+	// claims of the access token, nil until the websocket authenticated or when authentication is off
+	var claims *auth.Claims
+	if token := r.URL.Query().Get("token"); token != "" && signalingInstance.Verifier != nil {
+		var err error
+		if claims, err = signalingInstance.authenticate(token); err != nil {
+			log.Println("Rejecting websocket:", err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
 
+	upgrader := websocket.Upgrader{CheckOrigin: signalingInstance.checkOrigin}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("Upgrade error:", err)
 		return
 	}
 	defer conn.Close()
+	signalingInstance.openOutbox(conn)
+	defer signalingInstance.closeOutbox(conn)
+
+	if claims != nil {
+		sfuInstance.Authorize(claims.Identity, claims)
+	}
+	defer func() {
+		if claims != nil {
+			sfuInstance.Deauthorize(claims.Identity)
+		}
+	}()
 
 	for {
 		_, rawMessage, err := conn.ReadMessage()
@@ -33,6 +59,25 @@ func HandleSDP(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.S
 			// return
 		}
 
+		if signalingInstance.Verifier != nil {
+			if claims == nil {
+				if claims, err = signalingInstance.authenticate(msg.Token); err != nil {
+					log.Println("Rejecting websocket:", err)
+					closePolicyViolation(conn, err)
+					return
+				}
+				sfuInstance.Authorize(claims.Identity, claims)
+			}
+			if msg.PeerID == "" {
+				msg.PeerID = claims.Identity
+			} else if msg.PeerID != claims.Identity {
+				err := fmt.Errorf("peerId %s doesn't match the access token", msg.PeerID)
+				log.Println("Rejecting websocket:", err)
+				closePolicyViolation(conn, err)
+				return
+			}
+		}
+
 		// log.Println(msg)
 		switch msg.Type {
 		case "offer":
@@ -64,17 +109,100 @@ func HandleSDP(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.S
 			}
 			go sfuInstance.DispatchSignal(msg.PeerID, sfu_server.AnswerSignal{SDP: offer})
 
+		case "auth":
+			// only carries the access token, checked above
+
 		case "join-room":
+			// registering the room synchronously because the offer for this peer
+			// usually arrives right after join-room and needs to know its room
+			settings := sfu_server.RoomSettings{AutoSubscribe: msg.AutoSubscribe, LastN: msg.LastN}
+			if err := sfuInstance.JoinRoom(msg.PeerID, msg.RoomID, settings); err != nil {
+				log.Printf("Rejecting %s from room %s: %v", msg.PeerID, msg.RoomID, err)
+				// the rejection goes out through the websocket, so it has to be known first
+				signalingInstance.AddPeer(msg.PeerID, "", conn)
+				sfuInstance.RejectJoin(msg.PeerID, err)
+				break
+			}
 			go signalingInstance.AddPeer(msg.PeerID, "", conn)
 
+		case "set-layer":
+			if err := sfuInstance.SetLayer(msg.PeerID, msg.TrackID, msg.Layer); err != nil {
+				log.Printf("Failed to set layer for %s: %v", msg.PeerID, err)
+			}
+
+		case "subscribe":
+			if err := sfuInstance.Subscribe(msg.PeerID, msg.TrackID); err != nil {
+				log.Printf("Failed to subscribe %s to %s: %v", msg.PeerID, msg.TrackID, err)
+			}
+
+		case "unsubscribe":
+			if err := sfuInstance.Unsubscribe(msg.PeerID, msg.TrackID); err != nil {
+				log.Printf("Failed to unsubscribe %s from %s: %v", msg.PeerID, msg.TrackID, err)
+			}
+
+		case "pin":
+			if err := sfuInstance.Pin(msg.PeerID, msg.TargetPeerID); err != nil {
+				log.Printf("Failed to pin %s for %s: %v", msg.TargetPeerID, msg.PeerID, err)
+			}
+
+		case "unpin":
+			if err := sfuInstance.Unpin(msg.PeerID, msg.TargetPeerID); err != nil {
+				log.Printf("Failed to unpin %s for %s: %v", msg.TargetPeerID, msg.PeerID, err)
+			}
+
+		case "mute", "unmute":
+			if err := sfuInstance.MuteTrack(msg.PeerID, msg.TrackID, msg.Type == "mute"); err != nil {
+				log.Printf("Failed to %s %s for %s: %v", msg.Type, msg.TrackID, msg.PeerID, err)
+				signalingInstance.rejectModeration(msg, err)
+			}
+
+		case "unpublish":
+			if err := sfuInstance.UnpublishTrack(msg.PeerID, msg.TrackID); err != nil {
+				log.Printf("Failed to unpublish %s for %s: %v", msg.TrackID, msg.PeerID, err)
+				signalingInstance.rejectModeration(msg, err)
+			}
+
+		case "ban":
+			if err := sfuInstance.BanPeer(msg.PeerID, "", msg.TargetPeerID); err != nil {
+				log.Printf("Failed to ban %s for %s: %v", msg.TargetPeerID, msg.PeerID, err)
+				signalingInstance.rejectModeration(msg, err)
+			}
+
+		case "start-recording":
+			recordingID, err := sfuInstance.StartRecording(msg.PeerID, msg.RoomID, msg.TrackID)
+			if err != nil {
+				log.Printf("Failed to start recording for %s: %v", msg.PeerID, err)
+				signalingInstance.rejectModeration(msg, err)
+				break
+			}
+			data, _ := json.Marshal(map[string]string{"recordingId": recordingID, "roomId": msg.RoomID, "trackId": msg.TrackID})
+			signalingInstance.SignalChannelRecv <- &transport.SignalMessage{PeerID: msg.PeerID, Type: "recording-started", Data: data}
+
+		case "stop-recording":
+			if err := sfuInstance.StopRecording(msg.PeerID, msg.RecordingID); err != nil {
+				log.Printf("Failed to stop recording %s: %v", msg.RecordingID, err)
+				signalingInstance.rejectModeration(msg, err)
+				break
+			}
+			data, _ := json.Marshal(map[string]string{"recordingId": msg.RecordingID})
+			signalingInstance.SignalChannelRecv <- &transport.SignalMessage{PeerID: msg.PeerID, Type: "recording-stopped", Data: data}
+
+		case "list-tracks":
+			tracks, err := sfuInstance.ListTracks(msg.PeerID)
+			if err != nil {
+				log.Printf("Failed to list tracks for %s: %v", msg.PeerID, err)
+				break
+			}
+			data, err := json.Marshal(tracks)
+			if err != nil {
+				log.Println("JSON marshal error:", err)
+				break
+			}
+			// replying through the outgoing queue, only one goroutine may write to the websocket
+			signalingInstance.SignalChannelRecv <- &transport.SignalMessage{PeerID: msg.PeerID, Type: "tracks", Data: data}
+
 		default:
 			log.Printf("Unhandled signaling message type: %s", msg.Type)
 		}
 	}
 }
-
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
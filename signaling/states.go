@@ -2,6 +2,7 @@ package ws
 
 import (
 	"github.com/gorilla/websocket"
+	"github.com/samyak112/monoport/auth"
 	"github.com/samyak112/monoport/transport"
 	"sync"
 )
@@ -11,4 +12,12 @@ type Signal struct {
 	UfragMap          map[string]*websocket.Conn
 	SignalLock        sync.Mutex
 	SignalChannelRecv chan *transport.SignalMessage
+	// outboxes write the messages of every open websocket, see openOutbox
+	outboxes map[*websocket.Conn]*outbox
+
+	// Verifier checks the access tokens of /sdp websockets, nil turns authentication off
+	Verifier *auth.Verifier
+	// AllowedOrigins are the origins browsers may open /sdp websockets from besides the
+	// server's own, "*" allows every origin
+	AllowedOrigins []string
 }
@@ -0,0 +1,25 @@
+package ws
+
+import (
+	"net/http"
+
+	"github.com/samyak112/monoport/sfu"
+)
+
+// HandleStats serves the stats history of every stream, of one peer's streams when the URL
+// names a peer, or of one track and its subscribers when it names a track.
+func HandleStats(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.SFU) {
+	var streams []sfu_server.StreamHistory
+	switch {
+	case r.PathValue("peer") != "":
+		streams = sfuInstance.PeerStats(r.PathValue("peer"))
+	case r.PathValue("track") != "":
+		streams = sfuInstance.TrackStats(r.PathValue("track"))
+	default:
+		streams = sfuInstance.Stats()
+	}
+	if streams == nil {
+		streams = []sfu_server.StreamHistory{}
+	}
+	writeJSON(w, streams)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/pion/ice/v2"
 	"github.com/pion/stun"
+	"github.com/samyak112/monoport/metrics"
 	"github.com/samyak112/monoport/transport"
 	"log"
 	"net"
@@ -49,20 +50,33 @@ func (c *ICECandidate) ToSDP() string {
 }
 
 // newServerReflexiveCandidate creates an ICECandidate struct representing a
-// server reflexive (srflx) candidate.
+// server reflexive (srflx) candidate, of IPv4 or IPv6 depending on the client's address.
 func newServerReflexiveCandidate(clientAddr *net.UDPAddr) (*ICECandidate, error) {
+	ip := unmapIP(clientAddr.IP)
+	if ip == nil {
+		return nil, fmt.Errorf("client address %v has no IP", clientAddr)
+	}
+
 	// A foundation is used to group related candidates. For a simple srflx
-	// candidate from a STUN server, we can generate a simple one.
+	// candidate from a STUN server, we can generate a simple one. Candidates
+	// of different address families have different bases so they can't share it.
 	foundation := "1"
 
 	// Priority for a server-reflexive candidate. This is a typical value.
 	// Priority = (2^24)*type_preference + (2^8)*local_preference + (256 - component_id)
-	priority := (1<<24)*100 + (1<<8)*65535 + (256 - 1)
+	// IPv6 gets the higher local preference, as RFC 8421 recommends for dual-stack.
+	localPreference := 65535
+	if ip.To4() != nil {
+		localPreference = 65534
+	} else {
+		foundation = "2"
+	}
+	priority := (1<<24)*100 + (1<<8)*localPreference + (256 - 1)
 
 	candidate := &ICECandidate{
 		Foundation: foundation,
 		Priority:   uint32(priority),
-		Address:    clientAddr.IP.String(),
+		Address:    ip.String(),
 		Protocol:   "udp",
 		Port:       uint16(clientAddr.Port),
 		Typ:        "srflx", // Server Reflexive type
@@ -72,8 +86,12 @@ func newServerReflexiveCandidate(clientAddr *net.UDPAddr) (*ICECandidate, error)
 	return candidate, nil
 }
 
+// stunRequests counts the STUN packets HandleStunPackets handled, by what they turned out to be.
+var stunRequests = metrics.NewCounterVec("monoport_stun_requests_total",
+	"STUN packets handled on the shared UDP port: plain binding requests, ICE connectivity checks, or invalid.", "type")
+
 func HandleStunPackets(conn *net.UDPConn, packetChannel chan transport.PacketInfo, iceUDPMux ice.UDPMux, signalingInstance *Signal) {
-	fmt.Println("listenint at 5000 for UDP")
+	fmt.Println("listening at", conn.LocalAddr(), "for UDP")
 	for pktInfo := range packetChannel {
 
 		var udpResponse []byte
@@ -94,8 +112,14 @@ func HandleStunPackets(conn *net.UDPConn, packetChannel chan transport.PacketInf
 		udpResponse, ufrag, msgType, err = processStunPacket(pktInfo.N, pktInfo.Addr, dataPacket)
 		// fmt.Println(udpResponse)
 		if err != nil {
+			stunRequests.With("invalid").Inc()
 			fmt.Println("not sending the stun response", err)
 		} else {
+			if msgType == "messageIntegrity" {
+				stunRequests.With("connectivity_check").Inc()
+			} else {
+				stunRequests.With("binding").Inc()
+			}
 
 			// _, err = conn.WriteToUDP(udpResponse, remoteAddr)
 			if msgType == "messageIntegrity" {
@@ -110,9 +134,14 @@ func HandleStunPackets(conn *net.UDPConn, packetChannel chan transport.PacketInf
 					break
 				}
 
-				if err2 := signalingInstance.UfragMap[ufrag].WriteMessage(1, data); err2 != nil {
-					fmt.Println("something went wrong")
+				// peers signaled over WHIP or WHEP have no websocket, pion answers their checks on its own
+				signalingInstance.SignalLock.Lock()
+				ufragConn := signalingInstance.UfragMap[ufrag]
+				signalingInstance.SignalLock.Unlock()
+				if ufragConn == nil {
+					continue
 				}
+				signalingInstance.send(ufragConn, data)
 			} else {
 				if err != nil {
 					fmt.Println("not sending the stun response")
@@ -189,11 +218,13 @@ func processStunPacket(numBytes int, clientAddr *net.UDPAddr, buffer []byte) ([]
 		// The client expects a binary STUN BindingSuccess response.
 		fmt.Println("-> Handling traditional STUN request (no MessageIntegrity)...")
 
+		// IPv4 clients of the dual-stack socket arrive as IPv4-mapped IPv6 addresses, they
+		// get an IPv4 XOR-MAPPED-ADDRESS and IPv6 clients one XORed with the transaction ID
 		response, err := stun.Build(
 			stun.BindingSuccess,
 			stun.NewTransactionIDSetter(msg.TransactionID),
 			&stun.XORMappedAddress{
-				IP:   clientAddr.IP,
+				IP:   unmapIP(clientAddr.IP),
 				Port: clientAddr.Port,
 			},
 		)
@@ -211,6 +242,15 @@ func processStunPacket(numBytes int, clientAddr *net.UDPAddr, buffer []byte) ([]
 	}
 }
 
+// unmapIP returns IPv4-mapped IPv6 addresses, which is how IPv4 peers of a dual-stack
+// socket show up, as plain 4 byte IPv4 addresses and any other address as it is.
+func unmapIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
+
 func getRemoteUfragFromMessage(msg *stun.Message) (string, error) {
 	if msg.Type != stun.BindingRequest {
 		return "", fmt.Errorf("not a BindingRequest")
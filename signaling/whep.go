@@ -0,0 +1,55 @@
+package ws
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/samyak112/monoport/auth"
+	"github.com/samyak112/monoport/sfu"
+)
+
+// WHEPResourcePath is where WHEP sessions live, like WHIPResourcePath for viewers.
+const WHEPResourcePath = "/whep/resource/"
+
+// HandleWHEP answers a WHEP offer with the current tracks of the room named in the URL, or
+// of the default room. With authentication on, the bearer token has to grant canSubscribe.
+func HandleWHEP(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.SFU, signalingInstance *Signal) {
+	setCORSHeaders(w)
+	roomID, owner, ok := signalingInstance.authorizeHTTP(w, r, func(g auth.Grants) bool { return g.CanSubscribe })
+	if !ok {
+		return
+	}
+	offer, ok := readBody(w, r, "application/sdp")
+	if !ok {
+		return
+	}
+
+	resourceID, answer, err := sfuInstance.SubscribeWHEP(roomID, owner, offer)
+	if errors.Is(err, sfu_server.ErrNoTracks) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("WHEP offer rejected:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", WHEPResourcePath+resourceID)
+	w.WriteHeader(http.StatusCreated)
+	_, _ = io.WriteString(w, answer)
+}
+
+// HandleWHEPResource ends a WHEP session on DELETE and adds trickled candidates on PATCH.
+// With authentication on, only the token identity that created the session can do either.
+func HandleWHEPResource(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.SFU, signalingInstance *Signal) {
+	setCORSHeaders(w)
+	resource, ok := signalingInstance.authorizeResource(w, r, "whep")
+	if !ok {
+		return
+	}
+	handleHTTPPeerResource(w, r, sfuInstance, resource)
+}
@@ -0,0 +1,144 @@
+package ws
+
+import (
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/samyak112/monoport/auth"
+	"github.com/samyak112/monoport/sfu"
+)
+
+// maxSDPSize bounds the body of WHIP requests, real offers are a few kilobytes.
+const maxSDPSize = 64 << 10
+
+// WHIPResourcePath is where WHIP sessions live, a DELETE on it ends the session and a
+// PATCH trickles candidates.
+const WHIPResourcePath = "/whip/resource/"
+
+// HandleWHIP answers a WHIP (RFC 9725) offer, publishing the encoder's tracks into the room
+// named in the URL or in the default room. With authentication on, the bearer token has to
+// grant canPublish.
+func HandleWHIP(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.SFU, signalingInstance *Signal) {
+	setCORSHeaders(w)
+	roomID, owner, ok := signalingInstance.authorizeHTTP(w, r, func(g auth.Grants) bool { return g.CanPublish })
+	if !ok {
+		return
+	}
+	offer, ok := readBody(w, r, "application/sdp")
+	if !ok {
+		return
+	}
+
+	resourceID, answer, err := sfuInstance.PublishWHIP(roomID, owner, offer)
+	if err != nil {
+		log.Println("WHIP offer rejected:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", WHIPResourcePath+resourceID)
+	w.WriteHeader(http.StatusCreated)
+	_, _ = io.WriteString(w, answer)
+}
+
+// HandleWHIPResource ends a WHIP session on DELETE and adds trickled candidates on PATCH.
+// With authentication on, only the token identity that created the session can do either.
+func HandleWHIPResource(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.SFU, signalingInstance *Signal) {
+	setCORSHeaders(w)
+	resource, ok := signalingInstance.authorizeResource(w, r, "whip")
+	if !ok {
+		return
+	}
+	handleHTTPPeerResource(w, r, sfuInstance, resource)
+}
+
+// HandleCORSPreflight answers CORS preflights, browser based WHIP and WHEP clients send
+// them before every POST, PATCH and DELETE.
+func HandleCORSPreflight(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	w.Header().Set("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleHTTPPeerResource(w http.ResponseWriter, r *http.Request, sfuInstance *sfu_server.SFU, resource sfu_server.HTTPResource) {
+	var err error
+	switch r.Method {
+	case http.MethodDelete:
+		err = sfuInstance.RemoveHTTPPeer(resource)
+		if err == nil {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+	case http.MethodPatch:
+		fragment, ok := readBody(w, r, "application/trickle-ice-sdpfrag")
+		if !ok {
+			return
+		}
+		err = sfuInstance.AddHTTPCandidates(resource, parseTrickleFragment(fragment))
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if errors.Is(err, sfu_server.ErrUnknownPeer) {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+	log.Printf("[%s] %s failed: %v", resource.ID, r.Method, err)
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// readBody checks the request's content type and reads its body, answering the request
+// itself when either is wrong.
+func readBody(w http.ResponseWriter, r *http.Request, contentType string) (string, bool) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != contentType {
+		http.Error(w, "expected "+contentType, http.StatusUnsupportedMediaType)
+		return "", false
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSDPSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return string(body), true
+}
+
+// parseTrickleFragment extracts the candidates of an SDP fragment (RFC 8840). Candidates
+// belong to the media section of the last a=mid line before them.
+func parseTrickleFragment(fragment string) []webrtc.ICECandidateInit {
+	var candidates []webrtc.ICECandidateInit
+	var mid *string
+	for _, line := range strings.Split(fragment, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=mid:"):
+			value := strings.TrimPrefix(line, "a=mid:")
+			mid = &value
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidates = append(candidates, webrtc.ICECandidateInit{
+				Candidate: strings.TrimPrefix(line, "a="),
+				SDPMid:    mid,
+			})
+		}
+	}
+	return candidates
+}
+
+func setCORSHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+}
@@ -0,0 +1,143 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// sniffLength is the RFC 4571 length prefix plus a STUN header up to its magic cookie
+	sniffLength = 2 + 8
+	// sniffTimeout bounds how long a new connection may take to send its first bytes
+	sniffTimeout = 10 * time.Second
+
+	stunMagicCookie = 0x2112A442
+)
+
+// TCPDemux splits the connections of one listener between HTTP and ICE-TCP, so signaling
+// and media can share a single port. ICE-TCP connections start with an RFC 4571 framed
+// STUN binding request, everything else is handed to HTTP.
+type TCPDemux struct {
+	listener net.Listener
+	http     *demuxListener
+	ice      *demuxListener
+}
+
+// NewTCPDemux starts accepting connections on listener, they are then taken from the
+// listeners returned by HTTP and ICE.
+func NewTCPDemux(listener net.Listener) *TCPDemux {
+	d := &TCPDemux{
+		listener: listener,
+		http:     newDemuxListener(listener.Addr()),
+		ice:      newDemuxListener(listener.Addr()),
+	}
+	go d.acceptLoop()
+	return d
+}
+
+// HTTP returns the listener of the connections that aren't ICE-TCP.
+func (d *TCPDemux) HTTP() net.Listener { return d.http }
+
+// ICE returns the listener of the ICE-TCP connections, for pion's TCP mux.
+func (d *TCPDemux) ICE() net.Listener { return d.ice }
+
+func (d *TCPDemux) acceptLoop() {
+	for {
+		conn, err := d.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			d.http.Close()
+			d.ice.Close()
+			return
+		}
+		if err != nil {
+			// e.g. out of file descriptors, http.Server backs off the same way
+			log.Println("TCP accept error:", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		// sniffing waits on the client, it must not hold up the next Accept
+		go d.route(conn)
+	}
+}
+
+// route peeks at the first bytes of conn and hands it to the listener they belong to.
+func (d *TCPDemux) route(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	head, _ := reader.Peek(sniffLength)
+	_ = conn.SetReadDeadline(time.Time{})
+	if len(head) == 0 {
+		conn.Close()
+		return
+	}
+
+	target := d.http
+	if isFramedSTUN(head) {
+		target = d.ice
+	}
+	target.deliver(&peekedConn{Conn: conn, reader: reader})
+}
+
+// isFramedSTUN reports whether head starts with a STUN message behind an RFC 4571 length
+// prefix. HTTP requests start with a method name, which never has the zero bits and the
+// magic cookie of a STUN header.
+func isFramedSTUN(head []byte) bool {
+	if len(head) < sniffLength {
+		return false
+	}
+	message := head[2:]
+	return message[0]&0xC0 == 0 && binary.BigEndian.Uint32(message[4:8]) == stunMagicCookie
+}
+
+// peekedConn is a connection whose first bytes were already read into reader.
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// demuxListener is one side of a TCPDemux. Closing it only stops its own side, the
+// underlying listener is closed by its owner.
+type demuxListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newDemuxListener(addr net.Addr) *demuxListener {
+	return &demuxListener{addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *demuxListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *demuxListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *demuxListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *demuxListener) Addr() net.Addr { return l.addr }
@@ -0,0 +1,154 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+// framedBindingRequest returns a STUN binding request behind an RFC 4571 length prefix, the
+// way an ICE-TCP client opens its connection.
+func framedBindingRequest(t *testing.T) []byte {
+	t.Helper()
+	m, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(m.Raw)))
+	return append(framed, m.Raw...)
+}
+
+func TestIsFramedSTUN(t *testing.T) {
+	framed := framedBindingRequest(t)
+	wrongCookie := append([]byte(nil), framed...)
+	wrongCookie[2+4] ^= 0xff
+
+	tests := []struct {
+		name string
+		head []byte
+		want bool
+	}{
+		{name: "framed binding request", head: framed, want: true},
+		{name: "just the sniffed bytes", head: framed[:sniffLength], want: true},
+		{name: "unframed STUN", head: framed[2:], want: false},
+		{name: "wrong magic cookie", head: wrongCookie, want: false},
+		{name: "HTTP request", head: []byte("GET /sdp HTTP/1.1\r\nHost: example.com\r\n\r\n"), want: false},
+		{name: "HTTP/2 preface", head: []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"), want: false},
+		{name: "TLS client hello", head: []byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x01, 0x00, 0x01, 0xfc, 0x03, 0x03}, want: false},
+		{name: "too short", head: framed[:sniffLength-1], want: false},
+		{name: "empty", head: nil, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isFramedSTUN(tt.head); got != tt.want {
+				t.Errorf("isFramedSTUN = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTCPDemux(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	demux := NewTCPDemux(listener)
+
+	type accepted struct {
+		side string
+		conn net.Conn
+	}
+	conns := make(chan accepted)
+	for side, l := range map[string]net.Listener{"http": demux.HTTP(), "ice": demux.ICE()} {
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				conns <- accepted{side: side, conn: conn}
+			}
+		}()
+	}
+
+	tests := []struct {
+		name     string
+		payload  []byte
+		wantSide string
+	}{
+		{name: "ICE-TCP", payload: framedBindingRequest(t), wantSide: "ice"},
+		{name: "HTTP", payload: []byte("GET /ice-servers HTTP/1.1\r\nHost: localhost\r\n\r\n"), wantSide: "http"},
+		{name: "TLS", payload: []byte{0x16, 0x03, 0x01, 0x00, 0x05, 0x01, 0x00, 0x00, 0x01, 0x03, 0x03}, wantSide: "http"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			if _, err := client.Write(tt.payload); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case a := <-conns:
+				defer a.conn.Close()
+				if a.side != tt.wantSide {
+					t.Fatalf("routed to %s, want %s", a.side, tt.wantSide)
+				}
+				// the sniffed bytes are still there for whoever reads the connection
+				got := make([]byte, len(tt.payload))
+				_ = a.conn.SetReadDeadline(time.Now().Add(time.Second))
+				if _, err := io.ReadFull(a.conn, got); err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != string(tt.payload) {
+					t.Errorf("read %q, want %q", got, tt.payload)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("connection wasn't routed")
+			}
+		})
+	}
+
+	t.Run("connection closed before sending anything", func(t *testing.T) {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+		select {
+		case a := <-conns:
+			a.conn.Close()
+			t.Fatalf("routed to %s", a.side)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	t.Run("closing the listener closes both sides", func(t *testing.T) {
+		listener.Close()
+		for _, l := range []net.Listener{demux.HTTP(), demux.ICE()} {
+			done := make(chan error, 1)
+			go func() {
+				_, err := l.Accept()
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if !errors.Is(err, net.ErrClosed) {
+					t.Errorf("Accept returned %v, want net.ErrClosed", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Accept still blocks")
+			}
+		}
+	})
+}
@@ -5,11 +5,17 @@ package transport
 
 import (
 	// "encoding/binary"
+	"encoding/json"
 	"fmt"
 	"github.com/pion/stun"
+	"github.com/samyak112/monoport/metrics"
 	"net"
 )
 
+// stunPacketsDropped counts STUN packets the STUN handler never saw because it fell behind.
+var stunPacketsDropped = metrics.NewCounter("monoport_stun_packets_dropped_total",
+	"STUN packets dropped in CustomPacketConn.ReadFrom because DataForwardChan was full.")
+
 type PacketInfo struct {
 	Data []byte       // The actual packet data
 	Addr *net.UDPAddr // Where it came from
@@ -47,6 +53,7 @@ func (c *CustomPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error)
 			select {
 			case c.DataForwardChan <- PacketInfo{Data: dataCopy, Addr: udpAddr, Err: err, N: n}:
 			default:
+				stunPacketsDropped.Inc()
 				fmt.Println("Packet dropped because of full channel")
 			}
 		}
@@ -72,4 +79,15 @@ type SignalMessage struct {
 	SDP       string `json:"sdp,omitempty"`
 	Candidate string `json:"candidate,omitempty"` // JSON string of webrtc.ICECandidateInit
 	Ufrag     string `json:"ufrag,omitempty"`
+	RoomID    string `json:"roomId,omitempty"`  // room to join, only read from "join-room"
+	TrackID   string `json:"trackId,omitempty"` // global track ID a subscriber refers to
+	Layer     string `json:"layer,omitempty"`   // simulcast RID, or "auto" to let the server pick
+	// AutoSubscribe sets the subscription policy of the room in "join-room", only
+	// honoured when the peer creates the room and moderates it
+	AutoSubscribe *bool           `json:"autoSubscribe,omitempty"`
+	LastN         *int            `json:"lastN,omitempty"`        // last-N of the room in "join-room", same rule as AutoSubscribe
+	TargetPeerID  string          `json:"targetPeerId,omitempty"` // other peer a message refers to, e.g. the one to "pin"
+	RecordingID   string          `json:"recordingId,omitempty"`  // recording to stop in "stop-recording"
+	Token         string          `json:"token,omitempty"`        // access token, read from the first message of a websocket
+	Data          json.RawMessage `json:"data,omitempty"`         // payload of events the server sends, e.g. "tracks"
 }